@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path"
+	"strconv"
+
+	"github.com/RoaringBitmap/roaring/roaring64"
+)
+
+// #############################################################################
+
+func (cfg *Config) CheckpointPath(id int) string {
+	return path.Join(cfg.checkpointDir, cfg.session, strconv.Itoa(id))
+}
+
+func (cfg *Config) HasCheckpoint(id int) bool {
+	if cfg.checkpointDir == "" {
+		return false
+	}
+	_, err := os.Stat(cfg.CheckpointPath(id))
+	return err == nil
+}
+
+// Nil when checkpoint_dir is not set. A checkpoint is only resumed by a run
+// with the same options for the layout of the maps and their payloads.
+func (cfg *Config) OpenCheckpoint(p *Party) *Checkpoint {
+	if cfg.checkpointDir == "" {
+		return nil
+	}
+	c := &Checkpoint{dir: cfg.CheckpointPath(p.id), party: p}
+	Panic(os.MkdirAll(c.dir, 0700))
+
+	sess := cfg.Session()
+	meta := fmt.Sprintf("session=%s protocol=%s n=%d t=%d b=%d moduli=%d columns=%d l=%d moments=%t party_values=%t reveal=%t dp=%s epsilon=%g delta=%g suite=%s dst=%q\n", cfg.session, protoNames[cfg.proto], cfg.nParties, cfg.Threshold(), cfg.nBits, cfg.nModuli, cfg.cols, cfg.lim, cfg.moments, cfg.partyValues, cfg.reveal, cfg.dp, cfg.epsilon, cfg.delta, sess.Suite, sess.DST)
+	if old, err := os.ReadFile(c.path("meta")); err == nil {
+		if string(old) != meta {
+			Panic(fmt.Errorf("checkpoint %s belongs to another run: %s", c.dir, old))
+		}
+		p.log.Info(fmt.Sprintf("Resuming from checkpoint %s", c.dir), "checkpoint", c.dir)
+	} else {
+		Panic(os.WriteFile(c.path("meta"), []byte(meta), 0600))
+	}
+	p.ckpt = c
+	return c
+}
+
+func (c *Checkpoint) path(name string) string {
+	return path.Join(c.dir, name)
+}
+
+// Written like a message, so a crash never leaves a partial checkpoint
+func (c *Checkpoint) Save(name string, fn func(io.Writer)) {
+	if c != nil {
+		WriteMessage(c.path(name), fn)
+	}
+}
+
+// False if name was not checkpointed
+func (c *Checkpoint) Load(name string, fn func(io.Reader)) bool {
+	if c == nil {
+		return false
+	}
+	if _, err := os.Stat(c.path(name)); os.IsNotExist(err) {
+		return false
+	}
+	ReadMessage(c.path(name), c.party.log, fn)
+	c.party.log.Info(fmt.Sprintf("Resumed %s from checkpoint", name), "checkpoint", name)
+	return true
+}
+
+// Dropped once the party is done, along with the session directory once
+// every party is done
+func (c *Checkpoint) Remove() {
+	if c != nil {
+		Panic(os.RemoveAll(c.dir))
+		_ = os.Remove(path.Dir(c.dir))
+	}
+}
+
+// #############################################################################
+
+// Runs step unless an earlier attempt checkpointed its result as name
+func (p *Party) Step(name string, step func(), save func(io.Writer), load func(io.Reader)) {
+	if p.ckpt.Load(name, load) {
+		return
+	}
+	step()
+	p.ckpt.Save(name, save)
+}
+
+// ReceiveMessage, or the copy kept by an earlier attempt
+func (p *Party) Receive(fpath string, round int, fn func(io.Reader)) {
+	name := path.Base(fpath)
+	if p.ckpt.Load(name, fn) {
+		return
+	}
+	p.comm.Recv(round, p.ReceiveMessage(fpath, fn))
+	if p.ckpt != nil {
+		b, err := os.ReadFile(fpath)
+		Panic(err)
+		p.ckpt.Save(name, func(w io.Writer) { _, err := w.Write(b); Panic(err) })
+	}
+}
+
+func writeBitmap(w io.Writer, m *roaring64.Bitmap) {
+	b, err := m.ToBytes()
+	Panic(err)
+	writeBlob(w, b)
+}
+
+func readBitmap(r io.Reader) *roaring64.Bitmap {
+	m := roaring64.New()
+	Panic(m.UnmarshalBinary(readBlob(r)))
+	return m
+}
+
+// Only the identifiers, whose values the delegate holds
+func (d *Delegate) writeIntersection(w io.Writer) {
+	writeUint64(w, uint64(len(d.intersection)))
+	for _, k := range SortedKeys(d.intersection) {
+		writeBlob(w, []byte(k))
+	}
+}
+
+func (d *Delegate) readIntersection(r io.Reader) {
+	for n := readUint64(r); n > 0; n-- {
+		k := string(readBlob(r))
+		if d.intersection != nil {
+			d.intersection[k] = d.party.X[k]
+		}
+	}
+}
+
+// #############################################################################
+
+func (p *Party) writeKeys(w io.Writer) {
+	writeBlob(w, p.partial_sk.Bytes())
+	writeBlob(w, p.agg_pk.Serialize())
+}
+
+func (p *Party) readKeys(r io.Reader) {
+	p.partial_sk = new(big.Int).SetBytes(readBlob(r))
+	p.agg_pk = DHElementFromBytes(&p.ctx.ecc, readBlob(r))
+}
+
+// A resumed party keeps the keys of its first attempt
+func (p *Party) CheckpointKeys() {
+	p.Step("keys", func() {}, p.writeKeys, p.readKeys)
+}
+
+func (d *Delegate) CheckpointKeys() {
+	d.party.Step("keys", func() {}, func(w io.Writer) {
+		d.party.writeKeys(w)
+		writeBlob(w, (*big.Int)(d.alpha).Bytes())
+		writeBlob(w, d.aesKey)
+	}, func(r io.Reader) {
+		d.party.readKeys(r)
+		d.alpha = new(big.Int).SetBytes(readBlob(r))
+		d.aesKey = readBlob(r)
+		d.party.ctx.ecc.EC_BaseMultiply(d.alpha, &d.L)
+	})
+}
+
+// #############################################################################
@@ -0,0 +1,555 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/fatih/color"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// #############################################################################
+
+var commands = map[string]struct {
+	fn   func([]string) int
+	desc string
+}{
+	"generate": {CmdGenerate, "Generate sample data for all parties into data_dir"},
+	"keygen":   {CmdKeygen, "Generate shared parameters and party keys into key_dir"},
+	"run":      {CmdRun, "Run a single party (--role delegate|party --id i), exchanging messages via msg_dir"},
+	"verify":   {CmdVerify, "Compare the delegate's result_dir/result.txt against ground truth from data_dir"},
+	"bench":    {CmdBench, "Generate data and run all parties in-process, appending to result_dir/bench.csv (--sweep for parameter sweeps)"},
+}
+
+func Usage() {
+	fmt.Println("Usage: mps_operations <command> [--config config.yml] [flags]")
+	fmt.Println("")
+	fmt.Println("Commands:")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("  %-10s %s\n", name, commands[name].desc)
+	}
+	fmt.Println("")
+	fmt.Println("Every key in config.yml can be overridden by the flag of the same name, e.g. --n 5.")
+	fmt.Println("Run 'mps_operations <command> --help' for the flags of a command.")
+}
+
+func RunCLI(args []string) int {
+	if len(args) == 0 {
+		Usage()
+		return 2
+	}
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		Usage()
+		return 0
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", args[0])
+		Usage()
+		return 2
+	}
+	return cmd.fn(args[1:])
+}
+
+// #############################################################################
+
+// Flag defaults double as defaults for keys missing from the config file
+func ConfigFlags(name string) *pflag.FlagSet {
+	fs := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	fs.String("config", "", "Path to the config file (default ./config.yml)")
+	fs.String("protocol", "MPSI-Sum", "Protocol to run: MPSI / MPSI-Sum / MPSIU / MPSIU-Sum / OT-MPSI / OT-MPSI-Sum")
+	fs.Int("n", 3, "Number of participants (excluding delegate)")
+	fs.Int("x0", 32768, "Size of delegate's input set")
+	fs.Int("xi", 32768, "Size of non-delegates' input sets")
+	fs.IntSlice("sizes", nil, "Per-party set sizes |X_0|,...,|X_n| (overrides x0 / xi)")
+	fs.Int("i", 1024, "Size of the intersection / intersection-with-union")
+	fs.Int("t", 2, "Threshold of OT-MPSI: count the delegate's elements held by at least t of the n parties")
+	fs.Int("b", 17, "log_2(Size of hash map)")
+	fs.Int("l", 1024, "Upper bound on generated associated integers")
+	fs.Int("columns", 1, "Number of associated integers per identifier, summed separately by the -Sum protocols")
+	fs.Int64("seed", 0, "Seed for generated data (0 = pick a fresh seed)")
+	fs.Int("moduli", 0, "Number of CRT moduli for ElGamal sums (0 = size them and the BSGS table for the largest sum)")
+	fs.String("dp", "", "Noise the count, and the sums of the -Sum protocols, for differential privacy: laplace / gaussian (empty = exact outputs; not with reveal; gaussian needs epsilon below 1 per output)")
+	fs.Float64("epsilon", 1, "Epsilon of each run with dp, split evenly between the count and each sum")
+	fs.Float64("delta", 1e-6, "Delta of each run with dp, split like epsilon")
+	fs.Float64("epsilon_budget", 10, "Total epsilon each party may spend across runs with dp")
+	fs.Float64("delta_budget", 1e-5, "Total delta each party may spend across runs with dp")
+	fs.String("dp_ledger_dir", "", "Ledger of the epsilon and delta each party spent, in dp_ledger_dir/<id>.txt (empty = result_dir/dp_ledger)")
+	fs.Bool("party_values", false, "Also sum the values of the non-delegate parties that hold each element (MPSI-Sum / MPSIU-Sum)")
+	fs.Bool("moments", false, "Also sum the squares of the values, for the mean and variance of each column (-Sum protocols)")
+	fs.Bool("reveal", false, "Reveal the matched identifiers and their values to the delegate, in result_dir/intersection.txt (MPSI / MPSIU / OT-MPSI)")
+	fs.String("workload", "uniform", "Data generator: uniform / realistic")
+	fs.String("data_dir", "./data", "Location of generated identifiers")
+	fs.String("result_dir", "./results", "Location of results")
+	fs.String("key_dir", "./keys", "Location of shared parameters and party keys")
+	fs.String("msg_dir", "./messages", "Directory through which parties exchange messages")
+	fs.Bool("profile", false, "Enable profiling")
+	fs.Int("metrics_port", 0, "Serve the metrics of party i on port metrics_port + i (0 = disabled)")
+	fs.String("log_format", "color", "Log format: color / text / json")
+	fs.String("log_level", "info", "Minimum log level: debug / info / warn / error")
+	fs.String("session", "", "Session id of the run, bound into hashing, key derivation and the transcript (random if empty)")
+	fs.String("trace_file", "", "Append OTLP/JSON trace spans to result_dir/trace_file (empty = disabled)")
+	fs.Bool("progress", false, "Show the progress and ETA of each phase")
+	fs.String("h2c_suite", "", "RFC 9380 suite hashing identifiers to P-256: P256_XMD:SHA-256_SSWU_RO_ / P256_XMD:SHA-256_SSWU_NU_ / P256_XOF:SHAKE128_SSWU_RO_ / ... (empty = "+h2cSuite+")")
+	fs.String("h2c_dst", "", "Hash-to-curve domain separation tag of this deployment, 16 to 255 bytes (empty = "+dstPrefix+"<h2c_suite>)")
+	fs.String("h2c_cache_dir", "", "Keep the hash-to-curve points of each party of run under h2c_cache_dir/<id>, encrypted, for later runs with the same suite and DST (empty = disabled)")
+	fs.String("h2c_cache_secret", "", "File holding the long-lived secret the hash-to-curve cache is encrypted under, created on first use (empty = h2c_cache_dir/secret)")
+	fs.String("checkpoint_dir", "", "Checkpoint each party of run under checkpoint_dir/<session> to resume after a restart (empty = disabled)")
+	return fs
+}
+
+func LoadConfig(fs *pflag.FlagSet, args []string) (Config, error) {
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if fpath, _ := fs.GetString("config"); fpath != "" {
+		viper.SetConfigFile(fpath)
+	} else {
+		viper.SetConfigName("config")
+		viper.AddConfigPath(".")
+	}
+	viper.SetDefault("ids", "random")
+	viper.SetDefault("values", "uniform")
+	viper.SetDefault("zipf_s", 1.1)
+	viper.SetDefault("spread_s", 2.0)
+	Panic(viper.BindPFlags(fs))
+
+	if err := viper.ReadInConfig(); err != nil {
+		if _, ok := err.(viper.ConfigFileNotFoundError); !ok {
+			return Config{}, err
+		}
+	}
+	cfg := ReadConfig()
+	if err := ConfigureLogging(cfg.logFormat, cfg.logLevel); err != nil {
+		return cfg, err
+	}
+	if err := CheckDST(cfg.Session().DST); err != nil {
+		return cfg, err
+	}
+	if _, err := cfg.Session().HashToCurve(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func loadOrExit(fs *pflag.FlagSet, args []string) (Config, bool) {
+	cfg, err := LoadConfig(fs, args)
+	if err == pflag.ErrHelp {
+		return cfg, false
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return cfg, false
+	}
+	if cfg.logFormat == "color" {
+		color.New(color.FgBlue, color.Bold, color.Underline).Println("Multiparty Private Set Operations")
+		fmt.Println("")
+	}
+	return cfg, true
+}
+
+// #############################################################################
+
+func CmdGenerate(args []string) int {
+	cfg, ok := loadOrExit(ConfigFlags("generate"), args)
+	if !ok {
+		return 2
+	}
+
+	data := GenerateData(&cfg)
+	res := data.ComputeStats(cfg.Threshold(), cfg.partyValues)
+	logger := Report("{DATA}\t\t")
+	logger.Printf("Wrote %d sets to %s (seed = %d)\n", len(data.X_ADs), cfg.dataDir, data.Seed)
+	logger.Printf("True count = %d, sum = %s\n", int(res[0]), FormatFloats(cfg.TrueSums(res), " / "))
+	return 0
+}
+
+func CmdKeygen(args []string) int {
+	fs := ConfigFlags("keygen")
+	id := fs.Int("id", -1, "Only generate the key pair of party id (-1 = shared parameters and all keys)")
+	cfg, ok := loadOrExit(fs, args)
+	if !ok {
+		return 2
+	}
+	Panic(os.MkdirAll(cfg.keyDir, os.ModePerm))
+
+	var ctx EGContext
+	if *id < 0 {
+		eg := cfg.EGParams()
+		NewEGContext(&ctx, eg.nModuli, eg.maxBits, eg.countBits)
+		moduli := make([][]byte, ctx.nModuli)
+		for i := range moduli {
+			moduli[i] = ctx.n[i].Bytes()
+		}
+		WriteHex(path.Join(cfg.keyDir, "params"), moduli...)
+
+		// Every party of the run joins this session
+		session := cfg.session
+		if session == "" {
+			session = hex.EncodeToString(RandomBytes(16))
+		}
+		s := cfg.Session()
+		WriteHex(path.Join(cfg.keyDir, "session"), []byte(session), []byte(s.DST), []byte(s.Suite))
+	} else {
+		ctx = LoadEGContext(cfg.keyDir, cfg.EGParams().countBits)
+	}
+
+	for i := 0; i <= cfg.nParties; i++ {
+		if *id >= 0 && i != *id {
+			continue
+		}
+		sk := ctx.ecc.RandomScalar()
+		var pk DHElement
+		ctx.EGMP_PubKey(sk, &pk)
+		WriteHex(path.Join(cfg.keyDir, fmt.Sprintf("%d.sk", i)), sk.Bytes())
+		WriteHex(path.Join(cfg.keyDir, fmt.Sprintf("%d.pk", i)), pk.Serialize())
+
+		if i == 0 {
+			var L DHElement
+			alpha := ctx.ecc.RandomScalar()
+			ctx.ecc.EC_BaseMultiply(alpha, &L)
+			WriteHex(path.Join(cfg.keyDir, "delegate.sk"), alpha.Bytes(), RandomBytes(32))
+			WriteHex(path.Join(cfg.keyDir, "L.pk"), L.Serialize())
+		}
+	}
+	Report("{KEYS}\t\t").Printf("Wrote keys to %s\n", cfg.keyDir)
+	return 0
+}
+
+func CmdRun(args []string) int {
+	fs := ConfigFlags("run")
+	role := fs.String("role", "party", "Role of this process: delegate / party")
+	id := fs.Int("id", 1, "Party id in 1..n (the delegate is always 0)")
+	cfg, ok := loadOrExit(fs, args)
+	if !ok {
+		return 2
+	}
+	Panic(os.MkdirAll(cfg.msgDir, os.ModePerm))
+	_ = os.Mkdir(cfg.resDir, os.ModePerm)
+	ctx := LoadEGContext(cfg.keyDir, cfg.EGParams().countBits)
+
+	if err := cfg.JoinSession(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	// A resumed process was charged when it first started
+	pid := *id
+	if *role == "delegate" {
+		pid = 0
+	}
+	if !cfg.HasCheckpoint(pid) {
+		if err := cfg.ChargeBudget(pid, cfg.session); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	switch *role {
+	case "delegate":
+		// A restarted delegate resumes its own run
+		if _, err := os.Stat(MessagePath(&cfg, "M")); err == nil && !cfg.HasCheckpoint(0) {
+			fmt.Fprintf(os.Stderr, "%s already holds messages from another run\n", cfg.msgDir)
+			return 1
+		}
+		RunDelegate(&cfg, &ctx)
+	case "party":
+		if *id < 1 || *id > cfg.nParties {
+			fmt.Fprintf(os.Stderr, "--id must be in 1..%d\n", cfg.nParties)
+			return 2
+		}
+		RunParty(&cfg, *id, &ctx)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown role %q\n", *role)
+		return 2
+	}
+	return 0
+}
+
+func CmdVerify(args []string) int {
+	fs := ConfigFlags("verify")
+	tol := fs.Float64("tolerance", 5, "Maximum accepted error (%) of the computed count and sum")
+	cfg, ok := loadOrExit(fs, args)
+	if !ok {
+		return 2
+	}
+
+	data := NewSampleData(cfg.sizes, cfg.intCard, cfg.lim, cfg.cols, cfg.dataDir, true, (cfg.proto <= 1), 0)
+	res := data.ComputeStats(cfg.Threshold(), cfg.partyValues)
+	result := ReadResult(path.Join(cfg.resDir, "result.txt"))
+
+	count, _ := new(big.Float).SetInt(result["count"][0]).Float64()
+	sums := append(result["sum"], result["sum_sq"]...)
+	sum := make([]big.Int, len(sums))
+	for j, v := range sums {
+		sum[j].Set(v)
+	}
+	truth := cfg.TrueSums(res)
+	PrintResult(cfg.proto, count, res[0], sum, truth, cfg.moments)
+
+	// Sums are compared as big.Float, so that large ones are not truncated
+	within := func(v *big.Float, truth float64) bool {
+		t := big.NewFloat(truth)
+		if v.Cmp(t) == 0 {
+			return true
+		}
+		if truth == 0 {
+			return false
+		}
+		diff := new(big.Float).Sub(v, t)
+		diff.Mul(diff.Abs(diff), big.NewFloat(100))
+		return diff.Cmp(new(big.Float).Mul(big.NewFloat(*tol), t.Abs(t))) <= 0
+	}
+	if !within(new(big.Float).SetInt(result["count"][0]), res[0]) {
+		return 1
+	}
+	if cfg.proto%2 == 1 {
+		if len(sum) != len(truth) {
+			return 1
+		}
+		for j := range sum {
+			if !within(new(big.Float).SetInt(&sum[j]), truth[j]) {
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+func CmdBench(args []string) int {
+	fs := ConfigFlags("bench")
+	sweep := fs.Bool("sweep", false, "Run every combination of the lists in the sweep section of the config")
+	cfg, ok := loadOrExit(fs, args)
+	if !ok {
+		return 2
+	}
+	if *sweep {
+		RunSweep(cfg)
+	} else {
+		RunBench(cfg)
+	}
+	return 0
+}
+
+func abs(v float64) float64 {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+// #############################################################################
+
+func LoadEGContext(keyDir string, countBits uint) EGContext {
+	var ctx EGContext
+	hex := ReadHex(path.Join(keyDir, "params"))
+	moduli := make([]*big.Int, len(hex))
+	for i := range hex {
+		moduli[i] = new(big.Int).SetBytes(hex[i])
+	}
+	NewEGContextFromModuli(&ctx, moduli, countBits)
+	return ctx
+}
+
+// Takes the session id, DST and suite agreed at keygen, which the session,
+// h2c_dst and h2c_suite flags must match
+func (cfg *Config) JoinSession() error {
+	fpath := path.Join(cfg.keyDir, "session")
+	if _, err := os.Stat(fpath); err != nil {
+		return fmt.Errorf("%s holds no session id, run keygen again", cfg.keyDir)
+	}
+	params := ReadHex(fpath)
+	if len(params) < 3 {
+		return fmt.Errorf("%s holds no hash-to-curve DST and suite, run keygen again", fpath)
+	}
+	sid, DST, suite := string(params[0]), string(params[1]), string(params[2])
+	if cfg.session != "" && cfg.session != sid {
+		return fmt.Errorf("session %q differs from %q agreed at keygen", cfg.session, sid)
+	}
+	if cfg.dst != "" && cfg.dst != DST {
+		return fmt.Errorf("h2c_dst %q differs from %q agreed at keygen", cfg.dst, DST)
+	}
+	if cfg.suite != "" && cfg.suite != suite {
+		return fmt.Errorf("h2c_suite %q differs from %q agreed at keygen", cfg.suite, suite)
+	}
+	cfg.session, cfg.dst, cfg.suite = sid, DST, suite
+	return nil
+}
+
+func MessagePath(cfg *Config, name string) string {
+	return path.Join(cfg.msgDir, name)
+}
+
+func RunDelegate(cfg *Config, ctx *EGContext) {
+	var d Delegate
+	var M HashMapValues
+	var final HashMapFinal
+	sum := (cfg.proto%2 == 1)
+
+	SetLogContext(protoNames[cfg.proto], cfg.session)
+	d.Init(0, cfg.nParties, cfg.nBits, cfg.DataPaths()[0], cfg.resDir+"/log.txt", ctx)
+	d.LoadKeys(cfg.keyDir)
+	d.party.SetSession(cfg.Session())
+	d.moments = cfg.moments
+	cfg.OpenReveal(&d)
+	cfg.OpenDP(&d.party)
+	cfg.OpenCheckpoint(&d.party)
+	d.CheckpointKeys()
+	cache := cfg.OpenH2CCache(&d.party)
+	defer cfg.ServeMetrics(&d.party).Stop()
+	defer ExportSpans(cfg.TracePath(), cfg.StartTracing(&d.party, cfg.session))
+	d.party.showProgress = cfg.progress
+	comm := d.party.comm
+	d.party.CountSetup(cfg.nParties, true)
+
+	// Round 1
+	d.party.Step("M", func() {
+		d.DelegateStart(&M, sum)
+		cache.Save()
+	}, func(w io.Writer) {
+		M.Write(w)
+		d.party.writeSeen(w)
+	}, func(r io.Reader) {
+		M = ReadHashMapValues(r)
+		d.party.readSeen(r)
+	})
+	// Written once to the shared directory, but read by every party
+	comm.Send(Round1, d.party.SendMessage(MessagePath(cfg, "M"), M.Write), cfg.nParties)
+
+	// Round 2
+	d.party.Receive(MessagePath(cfg, "B"), Round1, func(r io.Reader) { final = ReadHashMapFinal(r) })
+	var count int
+	var ctSum []EGCiphertext
+	d.party.Step("count", func() { count, ctSum = d.DelegateFinish(&final, sum) }, func(w io.Writer) {
+		writeUint64(w, uint64(count))
+		if sum {
+			WriteCiphertexts(w, &d.party.ctx, ctSum)
+		}
+		d.writeIntersection(w)
+		d.transcript.Write(w)
+		d.party.writeSeen(w)
+	}, func(r io.Reader) {
+		count = int(readUint64(r))
+		if sum {
+			ctSum = ReadCiphertexts(r, &d.party.ctx)
+		}
+		d.readIntersection(r)
+		d.transcript = ReadTranscript(r)
+		d.party.readSeen(r)
+	})
+	result := map[string][]*big.Int{"count": {big.NewInt(int64(count))}}
+
+	if sum {
+		// Round 3
+		comm.Send(Round3, d.party.SendMessage(MessagePath(cfg, "ct"), func(w io.Writer) {
+			WriteCiphertexts(w, &d.party.ctx, ctSum)
+			d.transcript.Write(w)
+		}), cfg.nParties)
+		partials := make([][]DHElement, cfg.nParties+1)
+		d.party.parent = d.party.last
+		var err error
+		partials[0], err = d.party.Partial_Decrypt(ctSum, d.transcript)
+		Panic(err)
+		for i := 1; i <= cfg.nParties; i++ {
+			d.party.Receive(MessagePath(cfg, fmt.Sprintf("partial%d", i)), Round3, func(r io.Reader) { partials[i] = ReadPoints(r, &ctx.ecc) })
+		}
+		// With moments, the sums of squares follow the sums
+		sums := d.JointDecryption(ctSum, partials)
+		for j := range sums {
+			key := "sum"
+			if cfg.moments && j >= len(sums)/2 {
+				key = "sum_sq"
+			}
+			result[key] = append(result[key], new(big.Int).Set(&sums[j]))
+		}
+	}
+
+	WriteResult(path.Join(cfg.resDir, "result.txt"), result)
+	d.party.log.Info(fmt.Sprintf("Result written to %s/result.txt", cfg.resDir), "count", count)
+	cfg.WriteIntersection(&d)
+	d.party.LogCost()
+	d.party.ckpt.Remove()
+}
+
+func RunParty(cfg *Config, id int, ctx *EGContext) {
+	var p Party
+	var M, R HashMapValues
+	var final *HashMapFinal
+	sum := (cfg.proto%2 == 1)
+
+	SetLogContext(protoNames[cfg.proto], cfg.session)
+	p.Init(id, cfg.nParties, cfg.nBits, cfg.DataPaths()[id], cfg.resDir+"/log.txt", ctx)
+	p.LoadKeys(cfg.keyDir)
+	p.SetSession(cfg.Session())
+	cfg.OpenCheckpoint(&p)
+	p.CheckpointKeys()
+	cache := cfg.OpenH2CCache(&p)
+	L := DHElementFromBytes(&ctx.ecc, ReadHex(path.Join(cfg.keyDir, "L.pk"))[0])
+	defer cfg.ServeMetrics(&p).Stop()
+	defer ExportSpans(cfg.TracePath(), cfg.StartTracing(&p, cfg.session))
+	p.showProgress = cfg.progress
+	p.addValues = cfg.partyValues
+	cfg.OpenDP(&p)
+	comm := p.comm
+	p.CountSetup(cfg.nParties, false)
+
+	// Round 1
+	round1 := func() {
+		p.Receive(MessagePath(cfg, "M"), Round1, func(r io.Reader) { M = ReadHashMapValues(r) })
+		if id > 1 {
+			p.Receive(MessagePath(cfg, fmt.Sprintf("R%d", id-1)), Round1, func(r io.Reader) { R = ReadHashMapValues(r) })
+		}
+		final = p.Round1(cfg.proto, cfg.Threshold(), L, &M, &R)
+		cache.Save()
+	}
+	if id == cfg.nParties {
+		p.Step("B", round1, func(w io.Writer) {
+			final.Write(w)
+			p.writeSeen(w)
+		}, func(r io.Reader) {
+			B := ReadHashMapFinal(r)
+			final = &B
+			p.readSeen(r)
+		})
+		comm.Send(Round1, p.SendMessage(MessagePath(cfg, "B"), final.Write), 1)
+	} else {
+		out := fmt.Sprintf("R%d", id)
+		p.Step(out, round1, func(w io.Writer) {
+			R.Write(w)
+			p.writeSeen(w)
+		}, func(r io.Reader) {
+			R = ReadHashMapValues(r)
+			p.readSeen(r)
+		})
+		comm.Send(Round1, p.SendMessage(MessagePath(cfg, out), R.Write), 1)
+	}
+
+	if sum {
+		// Round 3
+		var ct []EGCiphertext
+		var t Transcript
+		p.Receive(MessagePath(cfg, "ct"), Round3, func(r io.Reader) {
+			ct = ReadCiphertexts(r, &p.ctx)
+			t = ReadTranscript(r)
+		})
+		partial, err := p.Partial_Decrypt(ct, t)
+		Panic(err)
+		comm.Send(Round3, p.SendMessage(MessagePath(cfg, fmt.Sprintf("partial%d", id)), func(w io.Writer) { WritePoints(w, partial) }), 1)
+	}
+
+	p.LogCost()
+	p.ckpt.Remove()
+}
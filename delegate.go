@@ -1,21 +1,26 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"math/big"
+	"path"
 	"time"
-
-	"github.com/fatih/color"
 )
 
 // #############################################################################
 
 func (p *Party) RunParallelDelegate(R *HashMapValues, pool *WorkerPool, fn WorkerFunc, ctx WorkerCtx) {
-	res := pool.Run(fn, ctx)
+	res := p.RunPool(pool, fn, ctx)
 	for i := 0; i < len(res); i++ {
 		data, ok := res[i].data.(DHOutput)
 		Assert(ok)
-		R.DHData[res[i].id] = HashMapValue{DHElement{}, data.S}
-		R.EncData[res[i].id] = data.Ct
+		R.S.Set(res[i].id, data.S[:])
+		if data.Ct.EG != nil {
+			R.EG.Set(res[i].id, data.Ct.EG)
+		} else {
+			R.AES[res[i].id] = data.Ct.AES
+		}
 	}
 }
 
@@ -28,46 +33,71 @@ func (d *Delegate) Init(id, n, nBits int, dPath, lPath string, ctx *EGContext) {
 	d.party.ctx.ecc.EC_BaseMultiply(d.alpha, &d.L)
 }
 
-func (d *Delegate) DelegateStart(M *HashMapValues, sum bool) {
-	color.Set(d.party.log_color)
-	defer color.Unset()
+func (d *Delegate) LoadKeys(keyDir string) {
+	d.party.LoadKeys(keyDir)
+	sk := ReadHex(path.Join(keyDir, "delegate.sk"))
+	d.alpha = new(big.Int).SetBytes(sk[0])
+	d.aesKey = sk[1]
+	d.party.ctx.ecc.EC_BaseMultiply(d.alpha, &d.L)
+}
 
+func (d *Delegate) DelegateStart(M *HashMapValues, sum bool) {
+	d.party.Phase(PhaseRound1)
 	defer Timer(time.Now(), d.party.log, "DelegateStart")
+	span := d.party.StartSpan("DelegateStart")
+	defer d.party.EndSpan(span)
 
-	*M = NewHashMap(d.party.nBits)
+	// One ciphertext per column of associated values, and one per column of
+	// their squares with moments
+	cols := Columns(d.party.X)
+	egStride := 0
+	if sum {
+		span.SetAttr("columns", cols)
+		if d.moments {
+			cols *= 2
+		}
+		egStride = int(66*d.party.ctx.nModuli) * cols
+	}
+	*M = NewDelegateHashMap(d.party.nBits, egStride)
 	unmodified := GetBitMap(M.Size())
+	span.SetAttr("slots", M.Size())
+	d.party.StartProgress("DelegateStart", M.Size())
+	defer d.party.EndProgress()
 
 	var ctxSum BlindCtxSum
 	var ctxInt BlindCtxInt
 
 	if sum {
-		ctxSum = BlindCtxSum{ctx: &d.party.ctx, alpha: d.alpha, pk: d.party.agg_pk, sk: d.party.partial_sk, h2c: d.party.h2c}
+		ctxSum = BlindCtxSum{ctx: &d.party.ctx, alpha: d.alpha, pk: d.party.agg_pk, sk: d.party.partial_sk, h2c: d.party.h2c, cols: cols, moments: d.moments}
 	} else {
 		ctxInt = BlindCtxInt{ctx: &d.party.ctx.ecc, alpha: d.alpha, sk: d.aesKey, h2c: d.party.h2c}
 	}
 
-	pool := NewWorkerPool(uint64(len(d.party.X)))
+	d.party.Step("blinded", func() {
+		pool := NewWorkerPool(uint64(len(d.party.X)))
+		for w, v := range d.party.X {
+			idx := GetIndex(w, M.nBits, d.party.sid)
+			if !unmodified.CheckedRemove(idx) {
+				continue
+			}
+			pool.InChan <- WorkerInput{data: BlindInput{w, v}, id: idx}
+		}
+		pool.nJobs = uint64(M.Size()) - unmodified.GetCardinality()
 
-	for w, v := range d.party.X {
-		idx := GetIndex(w, M.nBits)
-		if !unmodified.CheckedRemove(idx) {
-			continue
+		if sum {
+			d.party.RunParallelDelegate(M, pool, BlindEGWorker, ctxSum)
+		} else {
+			d.party.RunParallelDelegate(M, pool, BlindAESWorker, ctxInt)
 		}
-		pool.InChan <- WorkerInput{data: BlindInput{w, v}, id: idx}
-	}
+	}, func(w io.Writer) { M.Write(w); writeBitmap(w, unmodified) }, func(r io.Reader) { *M = ReadHashMapValues(r); unmodified = readBitmap(r) })
 
 	filled := uint64(M.Size()) - unmodified.GetCardinality()
-	pool.nJobs = filled
-
-	if sum {
-		d.party.RunParallelDelegate(M, pool, BlindEGWorker, ctxSum)
-	} else {
-		d.party.RunParallelDelegate(M, pool, BlindAESWorker, ctxInt)
-	}
+	d.party.modified = filled
 
-	d.party.log.Printf("Filled %d slots (%.3f x expected)\n", filled, float64(filled)/E_FullSlots(float64(M.Size()), float64(len(d.party.X))))
+	d.party.log.Info(fmt.Sprintf("Filled %d slots (%.3f x expected)", filled, float64(filled)/E_FullSlots(float64(M.Size()), float64(len(d.party.X)))), "filled", filled)
+	span.SetAttr("filled", filled)
 
-	pool = NewWorkerPool(unmodified.GetCardinality())
+	pool := NewWorkerPool(unmodified.GetCardinality())
 	k := unmodified.Iterator()
 	for k.HasNext() {
 		pool.InChan <- WorkerInput{id: k.Next(), data: RandomizeInput{}}
@@ -77,60 +107,140 @@ func (d *Delegate) DelegateStart(M *HashMapValues, sum bool) {
 	} else {
 		d.party.RunParallelDelegate(M, pool, RandomizeAESDelegateWorker, ctxInt)
 	}
-	d.party.log.Printf("Randomized %d unmodified slots\n", unmodified.GetCardinality())
+	d.party.log.Info(fmt.Sprintf("Randomized %d unmodified slots", unmodified.GetCardinality()), "randomized", unmodified.GetCardinality())
+	span.SetAttr("randomized", unmodified.GetCardinality())
+	d.party.Witness(0, MessageDigest(d.party.sid, M.Write))
 }
 
-func (d *Delegate) DelegateFinish(R *HashMapFinal, sum bool) (int, *EGCiphertext) {
-	color.Set(d.party.log_color)
+// Returns the count and, for the sum protocols, the encrypted sum of each
+// column
+func (d *Delegate) DelegateFinish(R *HashMapFinal, sum bool) (int, []EGCiphertext) {
+	d.party.Phase(PhaseRound2)
 	defer Timer(time.Now(), d.party.log, "DelegateFinish")
-
-	sz := len(R.Q)
-	pool := NewWorkerPool(uint64(sz))
-	for i := 0; i < sz; i++ {
-		pool.InChan <- WorkerInput{id: uint64(i), data: UnblindInput{Q: R.Q[i], AES: R.AES[i]}}
+	span := d.party.StartSpan("DelegateFinish")
+	defer d.party.EndSpan(span)
+
+	// B completes the transcript of Round 1
+	d.party.Witness(d.party.n, MessageDigest(d.party.sid, R.Write))
+	d.transcript = append(append(Transcript{}, R.T...), d.party.seen[d.party.n])
+
+	sz := R.Q.Len()
+	span.SetAttr("slots", sz)
+	d.party.StartProgress("DelegateFinish", sz)
+	defer d.party.EndProgress()
+	pool := NewWorkerPool(sz)
+	for i := uint64(0); i < sz; i++ {
+		pool.InChan <- WorkerInput{id: i, data: UnblindInput{Q: R.Q.At(i), AES: R.AES[i]}}
 	}
 
+	// A slot matched iff one of its lanes decrypts, so the delegate learns the
+	// count itself
 	var res []WorkerOutput
-	var ctSum EGCiphertext
+	var ctSum []EGCiphertext
 	count := 0
+	lanes := uint64(R.lanes)
+	matched := make(map[uint64]bool)
 	if sum {
-		res = pool.Run(UnblindEGWorker, BlindCtxSum{ctx: &d.party.ctx, alpha: d.alpha, pk: d.party.agg_pk, sk: d.party.partial_sk, h2c: d.party.h2c})
+		res = d.party.RunPool(pool, UnblindEGWorker, BlindCtxSum{ctx: &d.party.ctx, alpha: d.alpha, pk: d.party.agg_pk, sk: d.party.partial_sk, h2c: d.party.h2c})
 
-		first := true
 		for i := 0; i < len(res); i++ {
-			data, _ := res[i].data.(*EGCiphertext)
-			if data != nil {
+			data, _ := res[i].data.([]EGCiphertext)
+			if data != nil && !matched[res[i].id/lanes] {
+				matched[res[i].id/lanes] = true
 				count += 1
-				if first {
-					ctSum = *data
-					first = false
+				if ctSum == nil {
+					ctSum = data
 				} else {
-					d.party.ctx.EG_AddInplace(&ctSum, data)
+					for j := range ctSum {
+						d.party.ctx.EG_AddInplace(&ctSum[j], &data[j])
+					}
 				}
 			}
 		}
 	} else {
-		res = pool.Run(UnblindAESWorker, BlindCtxInt{ctx: &d.party.ctx.ecc, alpha: d.alpha, sk: d.aesKey, h2c: d.party.h2c})
+		res = d.party.RunPool(pool, UnblindAESWorker, BlindCtxInt{ctx: &d.party.ctx.ecc, alpha: d.alpha, sk: d.aesKey, h2c: d.party.h2c})
 
 		for i := 0; i < len(res); i++ {
 			data, _ := res[i].data.(string)
-			if data != "" {
+			if data != "" && !matched[res[i].id/lanes] {
+				matched[res[i].id/lanes] = true
 				count += 1
+				if d.intersection != nil {
+					d.Reveal([]byte(data))
+				}
 			}
 		}
 	}
 
+	// With dp, the count less the dummies the parties add on average, and the
+	// sums with the noise shares of the parties
+	if d.party.dp != nil {
+		count -= d.party.dp.Shift()
+	}
+	if d.party.dp != nil && sum {
+		noise := d.party.ctx.EG_DeserializeAll(R.Noise)
+		if ctSum == nil {
+			ctSum = noise
+		} else {
+			for j := range ctSum {
+				d.party.ctx.EG_AddInplace(&ctSum[j], &noise[j])
+			}
+		}
+	}
+
+	span.SetAttr("count", count)
 	if sum {
-		return count, &ctSum
+		d.transcript = append(d.transcript, MessageDigest(d.party.sid, func(w io.Writer) { WriteCiphertexts(w, &d.party.ctx, ctSum) }))
+		return count, ctSum
 	}
 	return count, nil
 }
 
-func (d *Delegate) JointDecryption(ctSum *EGCiphertext, partials [][]DHElement) big.Int {
-	color.Set(d.party.log_color)
-	defer Timer(time.Now(), d.party.log, "JointDecryption")
+// The inner layer of a matched slot holds the delegate's own identifier,
+// encrypted under its AES key
+func (d *Delegate) Reveal(ct []byte) {
+	w, err := d.party.ctx.ecc.AEAD_Decrypt(ct, d.aesKey)
+	Panic(err)
+	v, ok := d.party.X[string(w)]
+	Assert(ok)
+	d.intersection[string(w)] = v
+}
 
-	var result big.Int
-	d.party.ctx.EGMP_AggDecrypt(partials, &result, ctSum)
+// Nil when reveal is not set, so that the delegate only learns the count
+func (cfg *Config) OpenReveal(d *Delegate) {
+	if cfg.reveal {
+		d.intersection = make(map[string][]int)
+	}
+}
+
+func (cfg *Config) WriteIntersection(d *Delegate) {
+	if d.intersection == nil {
+		return
+	}
+	fpath := path.Join(cfg.resDir, "intersection.txt")
+	WriteFile(fpath, d.intersection)
+	d.party.log.Info(fmt.Sprintf("Intersection written to %s", fpath), "elements", len(d.intersection))
+}
+
+// Sum of each column, from the partial decryptions of every party
+func (d *Delegate) JointDecryption(ctSum []EGCiphertext, partials [][]DHElement) []big.Int {
+	d.party.Phase(PhaseRound3)
+	defer Timer(time.Now(), d.party.log, "JointDecryption")
+	span := d.party.StartSpan("JointDecryption")
+	defer d.party.EndSpan(span)
+	span.SetAttr("partials", len(partials))
+	span.SetAttr("columns", len(ctSum))
+
+	k := int(d.party.ctx.nModuli)
+	result := make([]big.Int, len(ctSum))
+	for j := range ctSum {
+		column := make([][]DHElement, len(partials))
+		for i := range partials {
+			Assert(len(partials[i]) == k*len(ctSum))
+			column[i] = partials[i][j*k : (j+1)*k]
+		}
+		d.party.ctx.EGMP_AggDecrypt(column, &result[j], &ctSum[j])
+		d.party.dp.Center(&result[j], d.party.ctx.N)
+	}
 	return result
 }
@@ -4,6 +4,7 @@ import (
 	"crypto/elliptic"
 	"math/big"
 	"strings"
+	"sync/atomic"
 
 	"lukechampine.com/frand"
 )
@@ -13,21 +14,31 @@ import (
 func NewDHContext(ret *DHContext) {
 	ret.Curve = elliptic.P256()
 	ret.G = DHElement{ret.Curve.Params().Gx, ret.Curve.Params().Gy}
+	ret.ops = new(OpCounts)
+}
+
+// Subsequent operations are counted in ops
+func (ctx *DHContext) CountInto(ops *OpCounts) {
+	ctx.ops = ops
 }
 
 func (ctx *DHContext) EC_BaseMultiply(s DHScalar, ret *DHElement) {
+	atomic.AddUint64(&ctx.ops.BaseMult, 1)
 	ret.x, ret.y = ctx.Curve.ScalarBaseMult((*s).Bytes())
 }
 
 func (ctx *DHContext) EC_Multiply(s DHScalar, p DHElement, ret *DHElement) {
+	atomic.AddUint64(&ctx.ops.ScalarMult, 1)
 	ret.x, ret.y = ctx.Curve.ScalarMult(p.x, p.y, (*s).Bytes())
 }
 
 func (ctx *DHContext) EC_Negate(a *DHElement) {
-	a.y.Neg(a.y)
+	a.y.Sub(ctx.Curve.Params().P, a.y)
+	a.y.Mod(a.y, ctx.Curve.Params().P)
 }
 
 func (ctx *DHContext) EC_Add(a, b DHElement, ret *DHElement) {
+	atomic.AddUint64(&ctx.ops.Add, 1)
 	if ret.x == nil {
 		ret.x = new(big.Int)
 	}
@@ -37,11 +48,44 @@ func (ctx *DHContext) EC_Add(a, b DHElement, ret *DHElement) {
 	ret.x, ret.y = ctx.Curve.Add(a.x, a.y, b.x, b.y)
 }
 
+func (ctx *DHContext) EC_HashToCurve(msg string, params *HtoCParams, ret *DHElement) {
+	if params.cache.Get(msg, ret) {
+		return
+	}
+	atomic.AddUint64(&ctx.ops.HashToCurve, 1)
+	params.ToCurve(msg, ret)
+	params.cache.Put(msg, ret)
+}
+
+func (ctx *DHContext) AEAD_Encrypt(pt []byte, key []byte) []byte {
+	atomic.AddUint64(&ctx.ops.AEAD, 1)
+	return AEAD_Encrypt(pt, key)
+}
+
+func (ctx *DHContext) AEAD_Decrypt(ct []byte, key []byte) ([]byte, error) {
+	atomic.AddUint64(&ctx.ops.AEAD, 1)
+	return AEAD_Decrypt(ct, key)
+}
+
 func (ctx *DHContext) DH_Reduce(L, T, P DHElement) (DHElement, DHElement) {
+	return ctx.dhReduce(L, T, P, nil)
+}
+
+// As DH_Reduce, for the point H of a hashed identifier, which stands for
+// T = k H with the session scalar k of params
+func (ctx *DHContext) DH_ReduceHashed(L, H, P DHElement, params *HtoCParams) (DHElement, DHElement) {
+	return ctx.dhReduce(L, H, P, params)
+}
+
+func (ctx *DHContext) dhReduce(L, T, P DHElement, params *HtoCParams) (DHElement, DHElement) {
 	var t1, t2, Q, S DHElement
 	beta := ctx.RandomScalar()
 	gamma := ctx.RandomScalar()
-	ctx.EC_Multiply(beta, T, &t1)
+	betaT := DHScalar(beta)
+	if params != nil {
+		betaT = params.Blind(beta)
+	}
+	ctx.EC_Multiply(betaT, T, &t1)
 	ctx.EC_Multiply(gamma, ctx.G, &t2)
 	ctx.EC_Add(t1, t2, &Q)
 	ctx.EC_Multiply(beta, P, &t1)
@@ -101,19 +145,28 @@ func (p *DHElement) Serialize() []byte {
 	return append(ret, byte(sign.Mod(p.y, &two).Int64()+2))
 }
 
+// Returns DHElement{} for the all-zero encoding of an unset slot
 func DHElementFromBytes(ctx *DHContext, b []byte) DHElement {
 	Assert(len(b) == 33)
-	var x, temp big.Int
-
-	x.SetBytes(b[:32])
-	y := ctx.YfromX(&x)
+	if b[32] == 0 {
+		return DHElement{}
+	}
 
-	parity := temp.Mod(y, &two).Int64()
+	// Serialize() places the SEC 1 parity tag last
+	enc := make([]byte, 33)
+	enc[0] = b[32]
+	copy(enc[1:], b[:32])
+	x, y := elliptic.UnmarshalCompressed(ctx.Curve, enc)
+	Assert(x != nil)
+	return DHElement{x, y}
+}
 
-	if int64(b[32])-2 != parity {
-		y.Sub(ctx.Curve.Params().P, y)
+func (p *DHElement) Compress() DHPoint {
+	var ret DHPoint
+	if p.x != nil {
+		copy(ret[:], p.Serialize())
 	}
-	return DHElement{&x, y}
+	return ret
 }
 
 func (p *DHElement) ByteSize() int {
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/big"
+	"math/bits"
+	"math/rand"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"lukechampine.com/frand"
+)
+
+// #############################################################################
+
+// Nil when dp is not set. The budget of a run is split evenly between the
+// count and each sum.
+func (cfg *Config) OpenDP(p *Party) *DPNoise {
+	if cfg.dp == "" {
+		return nil
+	}
+	p.dp = NewDPNoise(cfg.dp, cfg.epsilon, cfg.delta, cfg.Sensitivity(), cfg.nParties)
+	return p.dp
+}
+
+// Largest change of each sum when one element is added or removed: a value
+// below l, its square with moments, or the values of all n+1 parties. MPSI,
+// MPSIU and OT-MPSI have no sums, and spend the whole budget on the count.
+func (cfg *Config) Sensitivity() []float64 {
+	if cfg.proto%2 == 0 {
+		return nil
+	}
+	v := float64(cfg.lim - 1)
+	if cfg.partyValues {
+		v *= float64(cfg.nParties + 1)
+	}
+	sens := make([]float64, cfg.cols)
+	for j := range sens {
+		sens[j] = v
+	}
+	if cfg.moments {
+		for j := 0; j < cfg.cols; j++ {
+			sens = append(sens, v*v)
+		}
+	}
+	return sens
+}
+
+// The noise of the count and of each sum is split into shares, one per party,
+// so that no single party knows it. Each share of the count is shifted so
+// that it stays within [0, 2 shift] but with probability delta / (k n).
+func NewDPNoise(mech string, epsilon, delta float64, sens []float64, shares int) *DPNoise {
+	k, n := float64(1+len(sens)), float64(shares)
+	eps, del := epsilon/k, delta/k
+	dp := &DPNoise{mech: mech, shares: shares, rng: rand.New(frand.NewSource())}
+
+	switch mech {
+	case "laplace":
+		// Discrete Laplace of scale t: P(x) is proportional to exp(-|x| / t).
+		// A share is below a geometric of the same scale on either side.
+		dp.count = 1 / eps
+		dp.shift = int(math.Ceil(dp.count * math.Log(2*n/del)))
+		for _, s := range sens {
+			dp.sums = append(dp.sums, s/eps)
+		}
+	case "gaussian":
+		// Discrete Gaussian of parameter sigma, calibrated for eps < 1. The
+		// count spends half of its delta on the mechanism and half on the
+		// shifts.
+		Assert(eps < 1)
+		dp.count = dp.sigma(1, eps, del/2)
+		dp.shift = int(math.Ceil(dp.count / math.Sqrt(n) * math.Sqrt(2*math.Log(4*n/del))))
+		for _, s := range sens {
+			dp.sums = append(dp.sums, dp.sigma(s, eps, del))
+		}
+	default:
+		Panic(fmt.Errorf("unknown dp mechanism %q", mech))
+	}
+	return dp
+}
+
+// Parameter of the discrete Gaussian of sensitivity s within (eps, d). The
+// sum of the n shares of sigma / sqrt(n) is not a discrete Gaussian, but for
+// shares of sigma / sqrt(n) >= 1/2 its max divergence from the one of sigma,
+// both ways, is below tau (Kairouz, Liu and Steinke, "The Distributed Discrete
+// Gaussian Mechanism for Federated Learning with Secure Aggregation",
+// Proposition 14). Its statistical distance is then below e^tau - 1, which
+// adds (1 + e^eps)(e^tau - 1) to delta. Half of d goes to the mechanism and
+// half to this distance, and sigma grows until the distance fits.
+func (dp *DPNoise) sigma(s, eps, d float64) float64 {
+	n := float64(dp.shares)
+	sigma := s * math.Sqrt(2*math.Log(2.5/d)) / eps
+	for sigma/math.Sqrt(n) < 0.5 || (1+math.Exp(eps))*math.Expm1(gaussianTau(sigma/math.Sqrt(n), dp.shares)) > d/2 {
+		sigma *= 1.1
+	}
+	return sigma
+}
+
+// tau = 10 sum_{k=1}^{n-1} exp(-2 pi^2 sigma^2 k / (k + 1))
+func gaussianTau(sigma float64, n int) float64 {
+	tau := 0.0
+	for k := 1.0; k < float64(n); k++ {
+		tau += 10 * math.Exp(-2*math.Pi*math.Pi*sigma*sigma*k/(k+1))
+	}
+	return tau
+}
+
+// Bits of the largest noise of a sum, far in the tail
+func (dp *DPNoise) Bits() uint {
+	if dp == nil {
+		return 0
+	}
+	scale := 0.0
+	for _, s := range dp.sums {
+		scale = math.Max(scale, s)
+	}
+	return uint(bits.Len64(uint64(64*scale))) + 1
+}
+
+// One share of noise of the given scale. The shares of the n parties add up
+// to one draw of the mechanism.
+func (dp *DPNoise) share(scale float64) int64 {
+	if dp.mech == "laplace" {
+		// A discrete Laplace is the difference of two geometrics, each the
+		// sum of n Polya of parameter 1/n
+		r, alpha := 1/float64(dp.shares), math.Exp(-1/scale)
+		return dp.polya(r, alpha) - dp.polya(r, alpha)
+	}
+	// The sum of n discrete Gaussians of variance sigma^2 / n is close to one
+	// of variance sigma^2, and sigma covers the distance in delta
+	return dp.discreteGaussian(scale / math.Sqrt(float64(dp.shares)))
+}
+
+// The share of p of the noise of each sum
+func (dp *DPNoise) SumShares() []int64 {
+	ret := make([]int64, len(dp.sums))
+	for j, scale := range dp.sums {
+		ret[j] = dp.share(scale)
+	}
+	return ret
+}
+
+// Number of the dummies of p that match: its share of the count noise plus
+// shift, within [0, 2 shift]
+func (dp *DPNoise) CountDummies() int {
+	x := int64(dp.shift) + dp.share(dp.count)
+	if x < 0 {
+		return 0
+	}
+	if x > int64(2*dp.shift) {
+		return 2 * dp.shift
+	}
+	return int(x)
+}
+
+// Dummies each party adds, matching or not. The number is public, so that
+// the other parties do not learn the share.
+func (dp *DPNoise) Dummies() int {
+	return 2 * dp.shift
+}
+
+// Dummies the delegate subtracts from the count
+func (dp *DPNoise) Shift() int {
+	return dp.shares * dp.shift
+}
+
+// With dp, every slot of B of MPSI, MPSIU and OT-MPSI carries this payload
+// instead of the delegate's inner layer, which would tell dummies apart
+var dummyPayload = []byte("match")
+
+// Decrypted sums are residues mod N, which hold negative noisy sums near N
+func (dp *DPNoise) Center(m, N *big.Int) {
+	if dp != nil && m.Cmp(new(big.Int).Rsh(N, 1)) > 0 {
+		m.Sub(m, N)
+	}
+}
+
+// #############################################################################
+
+// Failures before the first success, with P(x) = (1 - alpha) alpha^x
+func (dp *DPNoise) geometric(alpha float64) int64 {
+	u := 1 - dp.rng.Float64()
+	return int64(math.Floor(math.Log(u) / math.Log(alpha)))
+}
+
+func (dp *DPNoise) discreteLaplace(t float64) int64 {
+	alpha := math.Exp(-1 / t)
+	return dp.geometric(alpha) - dp.geometric(alpha)
+}
+
+// Canonne, Kamath and Steinke, "The Discrete Gaussian for Differential
+// Privacy", Algorithm 3
+func (dp *DPNoise) discreteGaussian(sigma float64) int64 {
+	t := math.Floor(sigma) + 1
+	for {
+		y := dp.discreteLaplace(t)
+		d := math.Abs(float64(y)) - sigma*sigma/t
+		if dp.rng.Float64() < math.Exp(-d*d/(2*sigma*sigma)) {
+			return y
+		}
+	}
+}
+
+// Negative binomial of r failures and success probability 1 - alpha, as a
+// Poisson whose mean is Gamma distributed
+func (dp *DPNoise) polya(r, alpha float64) int64 {
+	return dp.poisson(dp.gamma(r) * alpha / (1 - alpha))
+}
+
+// Marsaglia and Tsang, boosted for shapes below 1
+func (dp *DPNoise) gamma(shape float64) float64 {
+	if shape < 1 {
+		return dp.gamma(shape+1) * math.Pow(dp.rng.Float64(), 1/shape)
+	}
+	d := shape - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := dp.rng.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		if math.Log(dp.rng.Float64()) < 0.5*x*x+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// Multiplication for small means, otherwise Hormann's transformed rejection
+// (PTRS)
+func (dp *DPNoise) poisson(lambda float64) int64 {
+	if lambda < 10 {
+		limit, prod := math.Exp(-lambda), dp.rng.Float64()
+		k := int64(0)
+		for prod > limit {
+			prod *= dp.rng.Float64()
+			k++
+		}
+		return k
+	}
+
+	slam, loglam := math.Sqrt(lambda), math.Log(lambda)
+	b := 0.931 + 2.53*slam
+	a := -0.059 + 0.02483*b
+	invalpha := 1.1239 + 1.1328/(b-3.4)
+	vr := 0.9277 - 3.6224/(b-2)
+	for {
+		u := dp.rng.Float64() - 0.5
+		v := dp.rng.Float64()
+		us := 0.5 - math.Abs(u)
+		k := math.Floor((2*a/us+b)*u + lambda + 0.43)
+		if us >= 0.07 && v <= vr {
+			return int64(k)
+		}
+		if k < 0 || (us < 0.013 && v > us) {
+			continue
+		}
+		lg, _ := math.Lgamma(k + 1)
+		if math.Log(v)+math.Log(invalpha)-math.Log(a/(us*us)+b) <= -lambda+k*loglam-lg {
+			return int64(k)
+		}
+	}
+}
+
+// #############################################################################
+
+func (cfg *Config) LedgerPath(id int) string {
+	dir := cfg.dpLedgerDir
+	if dir == "" {
+		dir = path.Join(cfg.resDir, "dp_ledger")
+	}
+	return path.Join(dir, fmt.Sprintf("%d.txt", id))
+}
+
+// Epsilon and delta that party id spent in earlier runs
+func (cfg *Config) Spent(id int) (float64, float64, error) {
+	fpath := cfg.LedgerPath(id)
+	file, err := os.Open(fpath)
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	var eps, del float64
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) != 4 {
+			return 0, 0, fmt.Errorf("%s:%d: want 4 tab-separated fields, got %d", fpath, line, len(fields))
+		}
+		e, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s:%d: epsilon: %w", fpath, line, err)
+		}
+		d, err := strconv.ParseFloat(fields[3], 64)
+		if err != nil {
+			return 0, 0, fmt.Errorf("%s:%d: delta: %w", fpath, line, err)
+		}
+		eps, del = eps+e, del+d
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, 0, fmt.Errorf("%s: %w", fpath, err)
+	}
+	return eps, del, nil
+}
+
+// Records the run of session in the ledger of party id, unless it would
+// exceed the budget. Runs are charged before they start, and add up by basic
+// composition.
+func (cfg *Config) ChargeBudget(id int, session string) error {
+	if cfg.dp == "" {
+		return nil
+	}
+	eps, del, err := cfg.Spent(id)
+	if err != nil {
+		return err
+	}
+	if eps+cfg.epsilon > cfg.epsilonBudget*(1+1e-9) || del+cfg.delta > cfg.deltaBudget*(1+1e-9) {
+		return fmt.Errorf("party %d has spent epsilon = %g, delta = %g of its budget (%g, %g) and cannot spend (%g, %g) more", id, eps, del, cfg.epsilonBudget, cfg.deltaBudget, cfg.epsilon, cfg.delta)
+	}
+
+	fpath := cfg.LedgerPath(id)
+	Panic(os.MkdirAll(path.Dir(fpath), 0700))
+	file, err := os.OpenFile(fpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	Panic(err)
+	defer file.Close()
+	_, err = fmt.Fprintf(file, "%s\t%s\t%g\t%g\n", session, cfg.dp, cfg.epsilon, cfg.delta)
+	Panic(err)
+	return nil
+}
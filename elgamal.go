@@ -4,9 +4,17 @@ import (
 	crand "crypto/rand"
 	"math"
 	"math/big"
+	"sync/atomic"
 )
 
-func NewEGContext(ret *EGContext, numModuli, maxBits uint) {
+// Bits of the BSGS table: 14 covers 30-bit residue sums
+const (
+	minTableBits = 14
+	maxTableBits = 16
+)
+
+// Sums below 2^maxBits of at most 2^countBits terms decrypt
+func NewEGContext(ret *EGContext, numModuli, maxBits, countBits uint) {
 	NewDHContext(&ret.ecc)
 	bitSize := uint(math.Ceil(float64(maxBits) / float64(numModuli)))
 
@@ -17,7 +25,48 @@ func NewEGContext(ret *EGContext, numModuli, maxBits uint) {
 
 	ret.genModuli(bitSize + 1)
 
-	ret.genTable(14) // Works for up to 32-bit sums
+	ret.genTable(TableBits(bitSize+1, countBits))
+}
+
+// Rebuilds a context from CRT moduli generated by another party
+func NewEGContextFromModuli(ret *EGContext, moduli []*big.Int, countBits uint) {
+	NewDHContext(&ret.ecc)
+
+	ret.nModuli = uint(len(moduli))
+	ret.N = new(big.Int)
+	ret.n = moduli
+	ret.Ny = make([]*big.Int, ret.nModuli)
+
+	ret.setCRT()
+	bitSize := 0
+	for _, n := range moduli {
+		if n.BitLen() > bitSize {
+			bitSize = n.BitLen()
+		}
+	}
+	ret.genTable(TableBits(uint(bitSize), countBits))
+}
+
+// A sum of 2^countBits residues of a modulus of modBits bits stays below
+// 2^(modBits+countBits), which BSGS covers with a table of 2^(bitSize+1)
+// points when 2*(bitSize+1) >= modBits+countBits
+func TableBits(modBits, countBits uint) uint {
+	bitSize := uint(minTableBits)
+	for 2*(bitSize+1) < modBits+countBits {
+		bitSize++
+	}
+	return bitSize
+}
+
+// Fewest CRT moduli for sums below 2^maxBits of at most 2^countBits terms
+// whose table stays within 2^(maxTableBits+1) points, keeping moduli of at
+// least 8 bits
+func AutoModuli(maxBits, countBits uint) uint {
+	k := uint(1)
+	for TableBits((maxBits+k-1)/k+1, countBits) > maxTableBits && (maxBits+k)/(k+1) >= 8 {
+		k++
+	}
+	return k
 }
 
 func (ctx *EGContext) genModuli(bitSize uint) {
@@ -25,7 +74,6 @@ func (ctx *EGContext) genModuli(bitSize uint) {
 	var err error
 
 	i := 0
-	ctx.N.SetInt64(1)
 	for i < int(ctx.nModuli) {
 		ctx.n[i], err = crand.Prime(crand.Reader, int(bitSize))
 		Panic(err)
@@ -37,11 +85,19 @@ func (ctx *EGContext) genModuli(bitSize uint) {
 			}
 		}
 		if coPrime {
-			ctx.N.Mul(ctx.N, ctx.n[i])
 			i += 1
 		}
 	}
 
+	ctx.setCRT()
+}
+
+func (ctx *EGContext) setCRT() {
+	ctx.N.SetInt64(1)
+	for i := 0; i < int(ctx.nModuli); i++ {
+		ctx.N.Mul(ctx.N, ctx.n[i])
+	}
+
 	var y big.Int
 	for i := 0; i < int(ctx.nModuli); i++ {
 		ctx.Ny[i] = new(big.Int).Div(ctx.N, ctx.n[i])
@@ -75,6 +131,7 @@ func (ctx *EGContext) BSGS(beta *DHElement) *big.Int {
 	gamma.y.Set(beta.y)
 
 	for i := int64(0); i < m; i++ {
+		atomic.AddUint64(&ctx.ecc.ops.BSGSSteps, 1)
 		j, ok := ctx.lookup(string(gamma.Serialize()))
 		if ok {
 			return new(big.Int).Add(&j, big.NewInt(i*m))
@@ -211,6 +268,25 @@ func (ctx *EGContext) EG_Deserialize(ctBytes []byte) EGCiphertext {
 	return ct
 }
 
+// One ciphertext per column, one after the other
+func (ctx *EGContext) EG_SerializeAll(cts []EGCiphertext) []byte {
+	var ret []byte
+	for i := range cts {
+		ret = append(ret, ctx.EG_Serialize(&cts[i])...)
+	}
+	return ret
+}
+
+func (ctx *EGContext) EG_DeserializeAll(ctBytes []byte) []EGCiphertext {
+	sz := int(66 * ctx.nModuli)
+	Assert(len(ctBytes) > 0 && len(ctBytes)%sz == 0)
+	cts := make([]EGCiphertext, len(ctBytes)/sz)
+	for i := range cts {
+		cts[i] = ctx.EG_Deserialize(ctBytes[i*sz : (i+1)*sz])
+	}
+	return cts
+}
+
 // #############################################################################
 
 func (ctx *EGContext) EGMP_PubKey(sk DHScalar, pk *DHElement) {
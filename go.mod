@@ -1,11 +1,12 @@
 module mps_operations
 
-go 1.18
+go 1.21
 
 require (
 	github.com/RoaringBitmap/roaring v0.9.4 // fast bitmaps
 	github.com/fatih/color v1.13.0 // colored logs
 	github.com/pkg/profile v1.6.0 // CPU profiling
+	github.com/spf13/pflag v1.0.5 // command-line flags
 	github.com/spf13/viper v1.11.0 // configuration
 	golang.org/x/crypto v0.0.0-20220411220226-7b82a4e95df4 // cryptographic primitives
 	lukechampine.com/frand v1.4.2 // userspace CSPRNG
@@ -26,7 +27,6 @@ require (
 	github.com/spf13/afero v1.8.2 // indirect
 	github.com/spf13/cast v1.4.1 // indirect
 	github.com/spf13/jwalterweatherman v1.1.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
 	github.com/subosito/gotenv v1.2.0 // indirect
 	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad // indirect
 	golang.org/x/text v0.3.7 // indirect
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/big"
+	"os"
+	"path"
+	"strconv"
+	"sync/atomic"
+)
+
+// #############################################################################
+
+// Nil when h2c_cache_dir is not set. The points of party p are kept in
+// h2c_cache_dir/<id>, encrypted under a key derived from the local secret in
+// h2c_cache_secret. They only depend on the suite and the DST of the
+// deployment, so the cache serves every later session.
+func (cfg *Config) OpenH2CCache(p *Party) *H2CCache {
+	if cfg.h2cCacheDir == "" {
+		return nil
+	}
+	Panic(os.MkdirAll(cfg.h2cCacheDir, 0700))
+	secret := cfg.CacheSecret()
+	c := &H2CCache{
+		path:   path.Join(cfg.h2cCacheDir, strconv.Itoa(p.id)),
+		key:    BLAKE2B(secret, "H2CCache:"+strconv.Itoa(p.id)),
+		tag:    BLAKE2B([]byte(p.h2c.suite+"|"+p.h2c.DST), "H2CCache"),
+		points: make(map[string][]byte),
+		log:    p.log,
+	}
+	c.Load()
+	p.h2c.cache = c
+	return c
+}
+
+// The secret of the cache keys, created on first use. It outlives keygen, so
+// it should be kept apart from the cache itself.
+func (cfg *Config) CacheSecret() []byte {
+	fpath := cfg.h2cCacheSecret
+	if fpath == "" {
+		fpath = path.Join(cfg.h2cCacheDir, "secret")
+	}
+	if _, err := os.Stat(fpath); os.IsNotExist(err) {
+		Panic(os.MkdirAll(path.Dir(fpath), 0700))
+		Panic(os.WriteFile(fpath+".tmp", RandomBytes(32), 0600))
+		Panic(os.Rename(fpath+".tmp", fpath))
+	}
+	secret, err := os.ReadFile(fpath)
+	Panic(err)
+	Assert(len(secret) == 32)
+	return secret
+}
+
+// Drops a cache written for another suite or DST, or under another key
+func (c *H2CCache) Load() {
+	b, err := os.ReadFile(c.path)
+	if err != nil {
+		return
+	}
+	if len(b) < len(c.tag)+12 || !bytes.Equal(b[:len(c.tag)], c.tag) {
+		c.log.Info("Hash-to-curve cache invalidated: suite or DST changed", "cache", c.path)
+		return
+	}
+	nonce, ct := b[len(c.tag):len(c.tag)+12], b[len(c.tag)+12:]
+	pt, err := getCipher(c.key).Open(nil, nonce, ct, c.tag)
+	if err != nil {
+		c.log.Warn("Hash-to-curve cache invalidated: written under another key", "cache", c.path)
+		return
+	}
+
+	r := bytes.NewReader(pt)
+	for n := readUint64(r); n > 0; n-- {
+		w := string(readBlob(r))
+		c.points[w] = readBlob(r)
+	}
+	c.log.Info(fmt.Sprintf("Loaded %d hash-to-curve points from %s", len(c.points), c.path), "cache", c.path, "points", len(c.points))
+}
+
+// Keeps the points looked up or added since Load, under a fresh nonce. A
+// resumed step that hashed nothing leaves the cache as it was.
+func (c *H2CCache) Save() {
+	if c == nil {
+		return
+	}
+	var pt bytes.Buffer
+	var n uint64
+	c.used.Range(func(_, _ interface{}) bool { n++; return true })
+	if n == 0 {
+		return
+	}
+	writeUint64(&pt, n)
+	c.used.Range(func(w, P interface{}) bool {
+		writeBlob(&pt, []byte(w.(string)))
+		writeBlob(&pt, P.([]byte))
+		return true
+	})
+
+	nonce := RandomBytes(12)
+	ct := getCipher(c.key).Seal(nil, nonce, pt.Bytes(), c.tag)
+	WriteMessage(c.path, func(w io.Writer) {
+		for _, b := range [][]byte{c.tag, nonce, ct} {
+			_, err := w.Write(b)
+			Panic(err)
+		}
+	})
+	c.log.Info(fmt.Sprintf("Hash-to-curve cache: %d hits, %d misses", c.hits, c.misses), "hits", c.hits, "misses", c.misses, "cache", c.path)
+}
+
+// False if w is not cached
+func (c *H2CCache) Get(w string, ret *DHElement) bool {
+	if c == nil {
+		return false
+	}
+	b, ok := c.points[w]
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	c.used.Store(w, b)
+	ret.x, ret.y = new(big.Int).SetBytes(b[:32]), new(big.Int).SetBytes(b[32:])
+	return true
+}
+
+func (c *H2CCache) Put(w string, P *DHElement) {
+	if c == nil {
+		return
+	}
+	b := make([]byte, 64)
+	P.x.FillBytes(b[:32])
+	P.y.FillBytes(b[32:])
+	c.used.Store(w, b)
+}
+
+// #############################################################################
@@ -4,8 +4,12 @@ import (
 	"crypto/elliptic"
 	"crypto/sha256"
 	"crypto/sha512"
+	"fmt"
 	"math"
 	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/sha3"
 )
 
 /* -------------------------------------------------------------------------- */
@@ -18,60 +22,99 @@ var four big.Int = *new(big.Int).SetInt64(4)
 
 /* -------------------------------------------------------------------------- */
 
-func NewHtoCParams(suite string) (*HtoCParams, error) {
+// Application DSTs must be at least 16 and at most 255 bytes long (Sec. 3.1)
+func CheckDST(DST string) error {
+	if len(DST) < 16 || len(DST) > 255 {
+		return fmt.Errorf("hash-to-curve DST must be 16 to 255 bytes long, got %d", len(DST))
+	}
+	return nil
+}
+
+// Suites of RFC 9380 (Sec. 8.2 to 8.4) on the NIST curves:
+// P256_XMD:SHA-256_SSWU_<RO|NU>_, P384_XMD:SHA-384_SSWU_<RO|NU>_ and
+// P521_XMD:SHA-512_SSWU_<RO|NU>_, or the same with expand_message_xof
+// (Sec. 5.3.2) as the expander, XOF:SHAKE128 on P-256 and XOF:SHAKE256 on any
+// of them. DST must not be empty, and one longer than 255 bytes is reduced
+// (Sec. 5.3.3).
+func NewHtoCParams(suite, DST string) (*HtoCParams, error) {
 	var A, B, q, Z *big.Int
-	var DST string
+	var curve elliptic.Curve
 	var k, m, L, h, b, s int
 	var ok bool
 	var H HashFunction
+	var xof func() sha3.ShakeHash
 
-	switch suite {
-	case "P256_XMD:SHA-256_SSWU_RO_":
+	parts := strings.Split(suite, "_")
+	if len(parts) != 5 || parts[2] != "SSWU" || (parts[3] != "RO" && parts[3] != "NU") || parts[4] != "" {
+		return nil, fmt.Errorf("unknown hash-to-curve suite %s", suite)
+	}
+
+	switch parts[0] {
+	case "P256":
 		A = new(big.Int).SetInt64(-3)
 		B, ok = new(big.Int).SetString("5ac635d8aa3a93e7b3ebbd55769886bc651d06b0cc53b0f63bce3c3e27d2604b", 16)
 		Assert(ok)
 		q, ok = new(big.Int).SetString("ffffffff00000001000000000000000000000000ffffffffffffffffffffffff", 16)
 		Assert(ok)
 		Z = new(big.Int).SetInt64(-10)
-		DST = "QUUX-V01-CS02-with-P256_XMD:SHA-256_SSWU_RO_"
+		curve = elliptic.P256()
 		k = 128
 		m = 1
 		h = 1
-		H = SHA256
-		b = 32
-		s = 64
-	case "P384_XMD:SHA-384_SSWU_RO_":
+	case "P384":
 		A = new(big.Int).SetInt64(-3)
 		B, ok = new(big.Int).SetString("b3312fa7e23ee7e4988e056be3f82d19181d9c6efe8141120314088f5013875ac656398d8a2ed19d2a85c8edd3ec2aef", 16)
 		Assert(ok)
 		q, ok = new(big.Int).SetString("fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffeffffffff0000000000000000ffffffff", 16)
 		Assert(ok)
 		Z = new(big.Int).SetInt64(-12)
-		DST = "QUUX-V01-CS02-with-P384_XMD:SHA-384_SSWU_RO_"
+		curve = elliptic.P384()
 		k = 192
 		m = 1
 		h = 1
-		H = SHA384
-		b = 48
-		s = 128
-	case "P521_XMD:SHA-512_SSWU_RO_":
+	case "P521":
 		A = new(big.Int).SetInt64(-3)
 		B, ok = new(big.Int).SetString("51953eb9618e1c9a1f929a21a0b68540eea2da725b99b315f3b8b489918ef109e156193951ec7e937b1652c0bd3bb1bf073573df883d2c34f1ef451fd46b503f00", 16)
 		Assert(ok)
 		q, ok = new(big.Int).SetString("1ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16)
 		Assert(ok)
 		Z = new(big.Int).SetInt64(-4)
-		DST = "QUUX-V01-CS02-with-P521_XMD:SHA-512_SSWU_RO_"
+		curve = elliptic.P521()
 		k = 256
 		m = 1
 		h = 1
-		H = SHA512
-		b = 64
-		s = 128
+	default:
+		return nil, fmt.Errorf("unknown hash-to-curve suite %s", suite)
+	}
+
+	// The XMD hash of each curve matches its k-bit security level, and an XOF
+	// must reach it (Sec. 5.3.2)
+	switch {
+	case parts[0]+"_"+parts[1] == "P256_XMD:SHA-256":
+		H, b, s = SHA256, 32, 64
+	case parts[0]+"_"+parts[1] == "P384_XMD:SHA-384":
+		H, b, s = SHA384, 48, 128
+	case parts[0]+"_"+parts[1] == "P521_XMD:SHA-512":
+		H, b, s = SHA512, 64, 128
+	case parts[1] == "XOF:SHAKE128" && k <= 128:
+		xof = sha3.NewShake128
+	case parts[1] == "XOF:SHAKE256":
+		xof = sha3.NewShake256
+	default:
+		return nil, fmt.Errorf("hash-to-curve suite %s is not defined by RFC 9380", suite)
 	}
 
+	if len(DST) == 0 {
+		return nil, fmt.Errorf("hash-to-curve DST must not be empty")
+	}
 	L = int(math.Ceil(float64(q.BitLen()+k) / 8)) // expansion size in bytes
-	return &HtoCParams{A: A, B: B, q: q, Z: Z, DST: DST, k: k, m: m, L: L, h: h, H: H, b: b, s: s}, nil
+	params := &HtoCParams{A: A, B: B, q: q, Z: Z, DST: DST, k: k, m: m, L: L, h: h, H: H, b: b, s: s, xof: xof, curve: curve, RO: parts[3] == "RO", suite: suite}
+	if len(DST) > 255 && xof != nil {
+		params.DST = string(params.XOF([]byte("H2C-OVERSIZE-DST-"+DST), (2*k+7)/8))
+	} else if len(DST) > 255 {
+		params.DST = string(H([]byte("H2C-OVERSIZE-DST-" + DST)))
+	}
+	return params, nil
 }
 
 /* -------------------------------------------------------------------------- */
@@ -140,6 +183,16 @@ func SHA512(msg []byte) []byte {
 	return ret[:]
 }
 
+func (params *HtoCParams) XOF(msg []byte, length int) []byte {
+	ret := make([]byte, length)
+	H := params.xof()
+	_, err := H.Write(msg)
+	Panic(err)
+	_, err = H.Read(ret)
+	Panic(err)
+	return ret
+}
+
 func Sqrt(x, p *big.Int) *big.Int {
 	var p1, exp, ret big.Int
 	p1.Add(p, &one)
@@ -189,11 +242,11 @@ func XOR(a, b []byte) []byte {
 
 /* -------------------------------------------------------------------------- */
 
-// From https://datatracker.ietf.org/doc/html/draft-irtf-cfrg-hash-to-curve-13#section-5.3
+// From https://www.rfc-editor.org/rfc/rfc9380#section-5
 
 func (params *HtoCParams) HashToField(msg string, count int) []big.Int {
 	len_in_bytes := count * params.m * params.L
-	uniform_bytes := params.ExpandMessageXMD(msg, params.DST, len_in_bytes)
+	uniform_bytes := params.ExpandMessage(msg, params.DST, len_in_bytes)
 	u := make([]big.Int, count)
 	for i := 0; i < count; i++ {
 		elm_offset := params.L * i
@@ -202,11 +255,19 @@ func (params *HtoCParams) HashToField(msg string, count int) []big.Int {
 	return u
 }
 
+// expand_message_xof for the XOF suites, expand_message_xmd otherwise
+func (params *HtoCParams) ExpandMessage(msg, DST string, len_in_bytes int) []byte {
+	if params.xof != nil {
+		return params.ExpandMessageXOF(msg, DST, len_in_bytes)
+	}
+	return params.ExpandMessageXMD(msg, DST, len_in_bytes)
+}
+
 func (params *HtoCParams) ExpandMessageXMD(msg, DST string, len_in_bytes int) []byte {
 	// 1. ell = ceil(len_in_bytes / b_in_bytes)
 	ell := math.Ceil(float64(len_in_bytes) / float64(params.b))
-	// 2.  ABORT if ell > 255
-	Assert(ell <= 255)
+	// 2.  ABORT if ell > 255 or len_in_bytes > 65535 or len(DST) > 255
+	Assert(ell <= 255 && len_in_bytes <= 65535 && len(DST) <= 255)
 	// 3.  DST_prime = DST || I2OSP(len(DST), 1)
 	DST_prime := DST + string(I2OSP_int(len(DST), 1))
 	// 4.  Z_pad = I2OSP(0, s_in_bytes)
@@ -232,6 +293,18 @@ func (params *HtoCParams) ExpandMessageXMD(msg, DST string, len_in_bytes int) []
 	return []byte(uniform_bytes[0:len_in_bytes])
 }
 
+func (params *HtoCParams) ExpandMessageXOF(msg, DST string, len_in_bytes int) []byte {
+	// 1. ABORT if len_in_bytes > 65535 or len(DST) > 255
+	Assert(len_in_bytes <= 65535 && len(DST) <= 255)
+	// 2. DST_prime = DST || I2OSP(len(DST), 1)
+	DST_prime := DST + string(I2OSP_int(len(DST), 1))
+	// 3. msg_prime = msg || I2OSP(len_in_bytes, 2) || DST_prime
+	msg_prime := msg + string(I2OSP_int(len_in_bytes, 2)) + DST_prime
+	// 4. uniform_bytes = H(msg_prime, len_in_bytes)
+	// 5. return uniform_bytes
+	return params.XOF([]byte(msg_prime), len_in_bytes)
+}
+
 func (params *HtoCParams) MapToCurveSWUStraight(u *big.Int) DHElement {
 	var tv1, tv2, tv3, tv4, tv5, tv6, x, y, negY big.Int
 	//  1.  tv1 = u^2
@@ -248,7 +321,7 @@ func (params *HtoCParams) MapToCurveSWUStraight(u *big.Int) DHElement {
 	tv3.Mul(params.B, &tv3)
 	//  7.  tv4 = CMOV(Z, -tv2, tv2 != 0)
 	tv2.Mod(&tv2, params.q)
-	tv4 = CMOV(params.Z, *tv4.Neg(&tv2), tv2.Cmp(&zero) != 0).(big.Int)
+	tv4 = CMOV(*params.Z, *tv4.Neg(&tv2), tv2.Cmp(&zero) != 0).(big.Int)
 	//  8.  tv4 = A * tv4
 	tv4.Mul(params.A, &tv4)
 	//  9.  tv2 = tv3^2
@@ -301,8 +374,14 @@ func (params *HtoCParams) ClearCofactor(R DHElement) DHElement {
 	}
 }
 
-// from https://datatracker.ietf.org/doc/html/draft-irtf-cfrg-hash-to-curve-13#section-3
-func HashToCurve_13(msg string, P *DHElement, curve elliptic.Curve, params *HtoCParams) {
+// From https://www.rfc-editor.org/rfc/rfc9380#section-3
+
+// Random oracle encoding (hash_to_curve), for _RO_ suites
+func HashToCurve(msg string, P *DHElement, curve elliptic.Curve, params *HtoCParams) {
+	if curve == elliptic.P256() {
+		*P = params.ClearCofactor(params.mapToCurveP256(msg, 2))
+		return
+	}
 	u := params.HashToField(msg, 2)
 
 	Q0 := params.MapToCurveSWUStraight(&u[0])
@@ -314,3 +393,28 @@ func HashToCurve_13(msg string, P *DHElement, curve elliptic.Curve, params *HtoC
 	Px, Py := curve.Add(Q0.x, Q0.y, Q1.x, Q1.y)
 	*P = params.ClearCofactor(DHElement{Px, Py})
 }
+
+// Nonuniform encoding (encode_to_curve), for _NU_ suites: one map to the
+// curve and no point addition, at the cost of reaching only a fraction of
+// the points
+func EncodeToCurve(msg string, P *DHElement, curve elliptic.Curve, params *HtoCParams) {
+	if curve == elliptic.P256() {
+		*P = params.ClearCofactor(params.mapToCurveP256(msg, 1))
+		return
+	}
+	u := params.HashToField(msg, 1)
+
+	Q := params.MapToCurveSWUStraight(&u[0])
+	Assert(curve.IsOnCurve(Q.x, Q.y))
+
+	*P = params.ClearCofactor(Q)
+}
+
+// The encoding of the suite of params
+func (params *HtoCParams) ToCurve(msg string, P *DHElement) {
+	if params.RO {
+		HashToCurve(msg, P, params.curve, params)
+	} else {
+		EncodeToCurve(msg, P, params.curve, params)
+	}
+}
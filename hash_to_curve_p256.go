@@ -0,0 +1,516 @@
+package main
+
+import (
+	"encoding/binary"
+	"math/big"
+	"math/bits"
+)
+
+/* -------------------------------------------------------------------------- */
+
+// p = 2^256 - 2^224 + 2^192 + 2^96 - 1
+var p256P = p256Element{0xffffffffffffffff, 0x00000000ffffffff, 0x0000000000000000, 0xffffffff00000001}
+
+var p256R2 p256Element // 2^512 mod p, to enter the Montgomery form
+var p256One, p256A, p256B, p256Z, p256C2 p256Element
+
+func init() {
+	q := new(big.Int).SetBytes(p256ToBytes(&p256P))
+	p256R2 = p256Limbs(new(big.Int).Exp(&two, big.NewInt(512), q))
+
+	p256FromBig(&p256One, &one)
+	p256FromBig(&p256A, big.NewInt(-3))
+	B, ok := new(big.Int).SetString("5ac635d8aa3a93e7b3ebbd55769886bc651d06b0cc53b0f63bce3c3e27d2604b", 16)
+	Assert(ok)
+	p256FromBig(&p256B, B)
+	p256FromBig(&p256Z, big.NewInt(-10))
+	p256FromBig(&p256C2, Sqrt(big.NewInt(10), q)) // sqrt(-Z)
+}
+
+// Plain limbs of 0 <= x < 2^256
+func p256Limbs(x *big.Int) p256Element {
+	var b [32]byte
+	x.FillBytes(b[:])
+	var z p256Element
+	for i := range z {
+		z[i] = binary.BigEndian.Uint64(b[24-8*i:])
+	}
+	return z
+}
+
+// Big-endian bytes of plain limbs
+func p256ToBytes(x *p256Element) []byte {
+	b := make([]byte, 32)
+	for i := range x {
+		binary.BigEndian.PutUint64(b[24-8*i:], x[i])
+	}
+	return b
+}
+
+func p256FromBig(z *p256Element, x *big.Int) {
+	var r big.Int
+	q := new(big.Int).SetBytes(p256ToBytes(&p256P))
+	*z = p256Limbs(r.Mod(x, q))
+	p256Mul(z, z, &p256R2)
+}
+
+func p256ToBig(x *p256Element) *big.Int {
+	var z p256Element
+	p256FromMont(&z, x)
+	return new(big.Int).SetBytes(p256ToBytes(&z))
+}
+
+// x * 2^-256 mod p, the plain value of x
+func p256FromMont(z, x *p256Element) {
+	one := p256Element{1}
+	p256Mul(z, x, &one)
+}
+
+// Plain limbs x < 2^256 to the Montgomery form; 2^256 < 2p, so one
+// conditional subtraction reduces x
+func p256Reduce(z, x *p256Element) {
+	var r p256Element
+	var b uint64
+	r[0], b = bits.Sub64(x[0], p256P[0], 0)
+	r[1], b = bits.Sub64(x[1], p256P[1], b)
+	r[2], b = bits.Sub64(x[2], p256P[2], b)
+	r[3], b = bits.Sub64(x[3], p256P[3], b)
+	p256Select(z, x, &r, b)
+	p256Mul(z, z, &p256R2)
+}
+
+// The 48 big-endian bytes of a hash_to_field output, reduced mod p as
+// hi * 2^256 + lo
+func p256FromWide(z *p256Element, b []byte) {
+	Assert(len(b) == 48)
+	var hi, lo p256Element
+	hi[1] = binary.BigEndian.Uint64(b[0:])
+	hi[0] = binary.BigEndian.Uint64(b[8:])
+	for i := range lo {
+		lo[i] = binary.BigEndian.Uint64(b[40-8*i:])
+	}
+	p256Reduce(&hi, &hi)
+	p256Mul(&hi, &hi, &p256R2)
+	p256Reduce(&lo, &lo)
+	p256Add(z, &hi, &lo)
+}
+
+/* -------------------------------------------------------------------------- */
+
+// z = a if borrow is 1, b if it is 0
+func p256Select(z, a, b *p256Element, borrow uint64) {
+	mask := -borrow
+	for i := range z {
+		z[i] = (a[i] & mask) | (b[i] &^ mask)
+	}
+}
+
+// z = b if c is 1, a if it is 0 (CMOV)
+func p256CMOV(z, a, b *p256Element, c uint64) {
+	p256Select(z, b, a, c)
+}
+
+func p256Add(z, x, y *p256Element) {
+	var s, r p256Element
+	var c, b uint64
+	s[0], c = bits.Add64(x[0], y[0], 0)
+	s[1], c = bits.Add64(x[1], y[1], c)
+	s[2], c = bits.Add64(x[2], y[2], c)
+	s[3], c = bits.Add64(x[3], y[3], c)
+	r[0], b = bits.Sub64(s[0], p256P[0], 0)
+	r[1], b = bits.Sub64(s[1], p256P[1], b)
+	r[2], b = bits.Sub64(s[2], p256P[2], b)
+	r[3], b = bits.Sub64(s[3], p256P[3], b)
+	_, b = bits.Sub64(c, 0, b)
+	p256Select(z, &s, &r, b)
+}
+
+func p256Sub(z, x, y *p256Element) {
+	var d p256Element
+	var b, c uint64
+	d[0], b = bits.Sub64(x[0], y[0], 0)
+	d[1], b = bits.Sub64(x[1], y[1], b)
+	d[2], b = bits.Sub64(x[2], y[2], b)
+	d[3], b = bits.Sub64(x[3], y[3], b)
+	mask := -b
+	z[0], c = bits.Add64(d[0], p256P[0]&mask, 0)
+	z[1], c = bits.Add64(d[1], p256P[1]&mask, c)
+	z[2], c = bits.Add64(d[2], p256P[2]&mask, c)
+	z[3], _ = bits.Add64(d[3], p256P[3]&mask, c)
+}
+
+func p256Neg(z, x *p256Element) {
+	var zero p256Element
+	p256Sub(z, &zero, x)
+}
+
+// Montgomery multiplication z = x * y * 2^-256 mod p
+func p256Mul(z, x, y *p256Element) {
+	var t0, t1, t2, t3, t4, t5, t6, t7, c uint64
+	// x * y[0]
+	c = 0
+	c, t0 = p256Mac(t0, x[0], y[0], c)
+	c, t1 = p256Mac(t1, x[1], y[0], c)
+	c, t2 = p256Mac(t2, x[2], y[0], c)
+	c, t3 = p256Mac(t3, x[3], y[0], c)
+	t4 = c
+	// x * y[1]
+	c = 0
+	c, t1 = p256Mac(t1, x[0], y[1], c)
+	c, t2 = p256Mac(t2, x[1], y[1], c)
+	c, t3 = p256Mac(t3, x[2], y[1], c)
+	c, t4 = p256Mac(t4, x[3], y[1], c)
+	t5 = c
+	// x * y[2]
+	c = 0
+	c, t2 = p256Mac(t2, x[0], y[2], c)
+	c, t3 = p256Mac(t3, x[1], y[2], c)
+	c, t4 = p256Mac(t4, x[2], y[2], c)
+	c, t5 = p256Mac(t5, x[3], y[2], c)
+	t6 = c
+	// x * y[3]
+	c = 0
+	c, t3 = p256Mac(t3, x[0], y[3], c)
+	c, t4 = p256Mac(t4, x[1], y[3], c)
+	c, t5 = p256Mac(t5, x[2], y[3], c)
+	c, t6 = p256Mac(t6, x[3], y[3], c)
+	t7 = c
+	p256MontReduce(z, t0, t1, t2, t3, t4, t5, t6, t7)
+}
+
+// Montgomery squaring, computing each product of distinct limbs once
+func p256Square(z, x *p256Element) {
+	var t0, t1, t2, t3, t4, t5, t6, t7, c uint64
+	c, t1 = p256Mac(0, x[0], x[1], 0)
+	c, t2 = p256Mac(0, x[0], x[2], c)
+	c, t3 = p256Mac(0, x[0], x[3], c)
+	t4 = c
+	c, t3 = p256Mac(t3, x[1], x[2], 0)
+	c, t4 = p256Mac(t4, x[1], x[3], c)
+	t5 = c
+	c, t5 = p256Mac(t5, x[2], x[3], 0)
+	t6 = c
+
+	// Doubled, plus the squares of the limbs
+	t7 = t6 >> 63
+	t6 = t6<<1 | t5>>63
+	t5 = t5<<1 | t4>>63
+	t4 = t4<<1 | t3>>63
+	t3 = t3<<1 | t2>>63
+	t2 = t2<<1 | t1>>63
+	t1 <<= 1
+	var hi, lo uint64
+	hi, t0 = bits.Mul64(x[0], x[0])
+	t1, c = bits.Add64(t1, hi, 0)
+	hi, lo = bits.Mul64(x[1], x[1])
+	t2, c = bits.Add64(t2, lo, c)
+	t3, c = bits.Add64(t3, hi, c)
+	hi, lo = bits.Mul64(x[2], x[2])
+	t4, c = bits.Add64(t4, lo, c)
+	t5, c = bits.Add64(t5, hi, c)
+	hi, lo = bits.Mul64(x[3], x[3])
+	t6, c = bits.Add64(t6, lo, c)
+	t7, c = bits.Add64(t7, hi, c)
+	p256MontReduce(z, t0, t1, t2, t3, t4, t5, t6, t7)
+}
+
+// z = t * 2^-256 mod p for t < p * 2^256, in four reduction steps. Since
+// p = -1 mod 2^64, the reduction factor of each limb is the limb itself, and
+// the limbs of p are 2^64 - 1, 2^32 - 1, 0 and 2^64 - 2^32 + 1, so each step
+// takes two multiplications.
+func p256MontReduce(z *p256Element, t0, t1, t2, t3, t4, t5, t6, t7 uint64) {
+	var c, top uint64
+	// Adds t0 * p, which clears t0
+	c = t0
+	c, t1 = p256Mac(t1, t0, p256P[1], c)
+	t2, c = bits.Add64(t2, c, 0)
+	c, t3 = p256Mac(t3, t0, p256P[3], c)
+	t4, c = bits.Add64(t4, c, 0)
+	t5, c = bits.Add64(t5, c, 0)
+	t6, c = bits.Add64(t6, c, 0)
+	t7, c = bits.Add64(t7, c, 0)
+	top += c
+	// Adds t1 * p, which clears t1
+	c = t1
+	c, t2 = p256Mac(t2, t1, p256P[1], c)
+	t3, c = bits.Add64(t3, c, 0)
+	c, t4 = p256Mac(t4, t1, p256P[3], c)
+	t5, c = bits.Add64(t5, c, 0)
+	t6, c = bits.Add64(t6, c, 0)
+	t7, c = bits.Add64(t7, c, 0)
+	top += c
+	// Adds t2 * p, which clears t2
+	c = t2
+	c, t3 = p256Mac(t3, t2, p256P[1], c)
+	t4, c = bits.Add64(t4, c, 0)
+	c, t5 = p256Mac(t5, t2, p256P[3], c)
+	t6, c = bits.Add64(t6, c, 0)
+	t7, c = bits.Add64(t7, c, 0)
+	top += c
+	// Adds t3 * p, which clears t3
+	c = t3
+	c, t4 = p256Mac(t4, t3, p256P[1], c)
+	t5, c = bits.Add64(t5, c, 0)
+	c, t6 = p256Mac(t6, t3, p256P[3], c)
+	t7, c = bits.Add64(t7, c, 0)
+	top += c
+
+	// The result is below 2p
+	r := p256Element{t4, t5, t6, t7}
+	var s p256Element
+	var b uint64
+	s[0], b = bits.Sub64(t4, p256P[0], 0)
+	s[1], b = bits.Sub64(t5, p256P[1], b)
+	s[2], b = bits.Sub64(t6, p256P[2], b)
+	s[3], b = bits.Sub64(t7, p256P[3], b)
+	_, b = bits.Sub64(top, 0, b)
+	p256Select(z, &r, &s, b)
+}
+
+// hi, lo = t + x * y + c, which cannot overflow
+func p256Mac(t, x, y, c uint64) (uint64, uint64) {
+	hi, lo := bits.Mul64(x, y)
+	lo, cc := bits.Add64(lo, t, 0)
+	hi += cc
+	lo, cc = bits.Add64(lo, c, 0)
+	return hi + cc, lo
+}
+
+// z = x^(2^n)
+func p256Sqr(z, x *p256Element, n int) {
+	p256Square(z, x)
+	for i := 1; i < n; i++ {
+		p256Square(z, z)
+	}
+}
+
+// x^(2^30 - 1) and x^(2^32 - 1), the runs of ones of the exponents below
+func p256Ones(x *p256Element) (x30, x32 p256Element) {
+	var x2, x3, x6, x12, x15 p256Element
+	p256Sqr(&x2, x, 1)
+	p256Mul(&x2, &x2, x)
+	p256Sqr(&x3, &x2, 1)
+	p256Mul(&x3, &x3, x)
+	p256Sqr(&x6, &x3, 3)
+	p256Mul(&x6, &x6, &x3)
+	p256Sqr(&x12, &x6, 6)
+	p256Mul(&x12, &x12, &x6)
+	p256Sqr(&x15, &x12, 3)
+	p256Mul(&x15, &x15, &x3)
+	p256Sqr(&x30, &x15, 15)
+	p256Mul(&x30, &x30, &x15)
+	p256Sqr(&x32, &x30, 2)
+	p256Mul(&x32, &x32, &x2)
+	return
+}
+
+// z = x^c1 with c1 = (p - 3) / 4, whose bits are 32 ones, 31 zeros, a one,
+// 96 zeros and 94 ones: 253 squarings and 11 multiplications
+func p256PowC1(z, x *p256Element) {
+	x30, x32 := p256Ones(x)
+	var t p256Element
+	p256Sqr(&t, &x32, 32)
+	p256Mul(&t, &t, x)
+	p256Sqr(&t, &t, 128)
+	p256Mul(&t, &t, &x32)
+	p256Sqr(&t, &t, 32)
+	p256Mul(&t, &t, &x32)
+	p256Sqr(&t, &t, 30)
+	p256Mul(z, &t, &x30)
+}
+
+// inv0: x^(p - 2) = x^(4 c1 + 1), which is 0 for x = 0
+func p256Inv(z, x *p256Element) {
+	var t p256Element
+	p256PowC1(&t, x)
+	p256Sqr(&t, &t, 2)
+	p256Mul(z, &t, x)
+}
+
+// 1 if x = 0, 0 otherwise
+func p256IsZero(x *p256Element) uint64 {
+	v := x[0] | x[1] | x[2] | x[3]
+	return ((v | -v) >> 63) ^ 1
+}
+
+// 1 if x = y, 0 otherwise
+func p256Equal(x, y *p256Element) uint64 {
+	var d p256Element
+	for i := range d {
+		d[i] = x[i] ^ y[i]
+	}
+	return p256IsZero(&d)
+}
+
+// Parity of the plain value of x
+func p256Sgn0(x *p256Element) uint64 {
+	var z p256Element
+	p256FromMont(&z, x)
+	return z[0] & 1
+}
+
+/* -------------------------------------------------------------------------- */
+
+// From https://www.rfc-editor.org/rfc/rfc9380#appendix-F.2.1.2 (q = 3 mod 4)
+func p256SqrtRatio(y, u, v *p256Element) uint64 {
+	var tv1, tv2, tv3, y1, y2 p256Element
+	//    1. tv1 = v^2
+	p256Square(&tv1, v)
+	//    2. tv2 = u * v
+	p256Mul(&tv2, u, v)
+	//    3. tv1 = tv1 * tv2
+	p256Mul(&tv1, &tv1, &tv2)
+	//    4. y1 = tv1^c1
+	p256PowC1(&y1, &tv1)
+	//    5. y1 = y1 * tv2
+	p256Mul(&y1, &y1, &tv2)
+	//    6. y2 = y1 * c2
+	p256Mul(&y2, &y1, &p256C2)
+	//    7. tv3 = y1^2
+	p256Square(&tv3, &y1)
+	//    8. tv3 = tv3 * v
+	p256Mul(&tv3, &tv3, v)
+	//    9. isQR = tv3 == u
+	isQR := p256Equal(&tv3, u)
+	//    10. y = CMOV(y2, y1, isQR)
+	p256CMOV(y, &y2, &y1, isQR)
+	//    11. return (isQR, y)
+	return isQR
+}
+
+// From https://www.rfc-editor.org/rfc/rfc9380#appendix-F.2, in projective
+// coordinates (X : Y : Z) so that the division of step 25 is left for the
+// conversion of the final point
+func p256MapToCurveSWU(X, Y, Z, u *p256Element) {
+	var tv1, tv2, tv3, tv4, tv5, tv6, negTv2, y1, negY p256Element
+	x, y := X, Y
+	//  1.  tv1 = u^2
+	p256Square(&tv1, u)
+	//  2.  tv1 = Z * tv1
+	p256Mul(&tv1, &p256Z, &tv1)
+	//  3.  tv2 = tv1^2
+	p256Square(&tv2, &tv1)
+	//  4.  tv2 = tv2 + tv1
+	p256Add(&tv2, &tv2, &tv1)
+	//  5.  tv3 = tv2 + 1
+	p256Add(&tv3, &tv2, &p256One)
+	//  6.  tv3 = B * tv3
+	p256Mul(&tv3, &p256B, &tv3)
+	//  7.  tv4 = CMOV(Z, -tv2, tv2 != 0)
+	p256Neg(&negTv2, &tv2)
+	p256CMOV(&tv4, &p256Z, &negTv2, p256IsZero(&tv2)^1)
+	//  8.  tv4 = A * tv4
+	p256Mul(&tv4, &p256A, &tv4)
+	//  9.  tv2 = tv3^2
+	p256Square(&tv2, &tv3)
+	//  10. tv6 = tv4^2
+	p256Square(&tv6, &tv4)
+	//  11. tv5 = A * tv6
+	p256Mul(&tv5, &p256A, &tv6)
+	//  12. tv2 = tv2 + tv5
+	p256Add(&tv2, &tv2, &tv5)
+	//  13. tv2 = tv2 * tv3
+	p256Mul(&tv2, &tv2, &tv3)
+	//  14. tv6 = tv6 * tv4
+	p256Mul(&tv6, &tv6, &tv4)
+	//  15. tv5 = B * tv6
+	p256Mul(&tv5, &p256B, &tv6)
+	//  16. tv2 = tv2 + tv5
+	p256Add(&tv2, &tv2, &tv5)
+	//  17.   x = tv1 * tv3
+	p256Mul(x, &tv1, &tv3)
+	//  18. (is_gx1_square, y1) = sqrt_ratio(tv2, tv6)
+	isGx1Square := p256SqrtRatio(&y1, &tv2, &tv6)
+	//  19.   y = tv1 * u
+	p256Mul(y, &tv1, u)
+	//  20.   y = y * y1
+	p256Mul(y, y, &y1)
+	//  21.   x = CMOV(x, tv3, is_gx1_square)
+	p256CMOV(x, x, &tv3, isGx1Square)
+	//  22.   y = CMOV(y, y1, is_gx1_square)
+	p256CMOV(y, y, &y1, isGx1Square)
+	//  23.  e1 = sgn0(u) == sgn0(y)
+	e1 := (p256Sgn0(u) ^ p256Sgn0(y)) ^ 1
+	//  24.   y = CMOV(-y, y, e1)
+	p256Neg(&negY, y)
+	p256CMOV(y, &negY, y, e1)
+	//  25.   x = x / tv4, as (x : y * tv4 : tv4)
+	p256Mul(Y, y, &tv4)
+	*Z = tv4
+	//  26. return (x, y)
+}
+
+// Complete addition of projective points on a curve with a = -3 (Renes,
+// Costello and Batina, "Complete addition formulas for prime order elliptic
+// curves", Algorithm 4)
+func p256AddPoints(X3, Y3, Z3, X1, Y1, Z1, X2, Y2, Z2 *p256Element) {
+	var t0, t1, t2, t3, t4, x3, y3, z3 p256Element
+	p256Mul(&t0, X1, X2)
+	p256Mul(&t1, Y1, Y2)
+	p256Mul(&t2, Z1, Z2)
+	p256Add(&t3, X1, Y1)
+	p256Add(&t4, X2, Y2)
+	p256Mul(&t3, &t3, &t4)
+	p256Add(&t4, &t0, &t1)
+	p256Sub(&t3, &t3, &t4)
+	p256Add(&t4, Y1, Z1)
+	p256Add(&x3, Y2, Z2)
+	p256Mul(&t4, &t4, &x3)
+	p256Add(&x3, &t1, &t2)
+	p256Sub(&t4, &t4, &x3)
+	p256Add(&x3, X1, Z1)
+	p256Add(&y3, X2, Z2)
+	p256Mul(&x3, &x3, &y3)
+	p256Add(&y3, &t0, &t2)
+	p256Sub(&y3, &x3, &y3)
+	p256Mul(&z3, &p256B, &t2)
+	p256Sub(&x3, &y3, &z3)
+	p256Add(&z3, &x3, &x3)
+	p256Add(&x3, &x3, &z3)
+	p256Sub(&z3, &t1, &x3)
+	p256Add(&x3, &t1, &x3)
+	p256Mul(&y3, &p256B, &y3)
+	p256Add(&t1, &t2, &t2)
+	p256Add(&t2, &t1, &t2)
+	p256Sub(&y3, &y3, &t2)
+	p256Sub(&y3, &y3, &t0)
+	p256Add(&t1, &y3, &y3)
+	p256Add(&y3, &t1, &y3)
+	p256Add(&t1, &t0, &t0)
+	p256Add(&t0, &t1, &t0)
+	p256Sub(&t0, &t0, &t2)
+	p256Mul(&t1, &t4, &y3)
+	p256Mul(&t2, &t0, &y3)
+	p256Mul(&y3, &x3, &z3)
+	p256Add(&y3, &y3, &t2)
+	p256Mul(&x3, &t3, &x3)
+	p256Sub(&x3, &x3, &t1)
+	p256Mul(&z3, &t4, &z3)
+	p256Mul(&t1, &t3, &t0)
+	p256Add(&z3, &z3, &t1)
+	*X3, *Y3, *Z3 = x3, y3, z3
+}
+
+// The affine point of (X : Y : Z), with a single inversion
+func p256ToAffine(X, Y, Z *p256Element) DHElement {
+	var zInv, x, y p256Element
+	p256Inv(&zInv, Z)
+	p256Mul(&x, X, &zInv)
+	p256Mul(&y, Y, &zInv)
+	return DHElement{p256ToBig(&x), p256ToBig(&y)}
+}
+
+// hash_to_field with count elements, the map of each to the curve and, for
+// two, their sum. The points stay in projective limbs until the end.
+func (params *HtoCParams) mapToCurveP256(msg string, count int) DHElement {
+	uniform_bytes := params.ExpandMessage(msg, params.DST, count*params.L)
+	var u, X, Y, Z, X1, Y1, Z1 p256Element
+	p256FromWide(&u, uniform_bytes[:params.L])
+	p256MapToCurveSWU(&X, &Y, &Z, &u)
+	if count == 2 {
+		p256FromWide(&u, uniform_bytes[params.L:])
+		p256MapToCurveSWU(&X1, &Y1, &Z1, &u)
+		p256AddPoints(&X, &Y, &Z, &X, &Y, &Z, &X1, &Y1, &Z1)
+	}
+	return p256ToAffine(&X, &Y, &Z)
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// #############################################################################
+
+var logFormats = []string{"color", "text", "json"}
+
+// Shared by the loggers of all parties in the process
+var logSettings = struct {
+	format, protocol, session string
+	level                     slog.Level
+}{format: "color", level: slog.LevelInfo}
+
+var logFiles = struct {
+	sync.Mutex
+	m map[string]*os.File
+}{m: make(map[string]*os.File)}
+
+var stdoutMu sync.Mutex
+
+func ConfigureLogging(format, level string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	if !slices.Contains(logFormats, format) {
+		return fmt.Errorf("unknown log format %q (want color, text or json)", format)
+	}
+	logSettings.format, logSettings.level = format, l
+	// Keep escape codes out of machine-readable output
+	color.NoColor = color.NoColor || (format != "color")
+	return nil
+}
+
+// Fields added to every party's records from here on
+func SetLogContext(protocol, session string) {
+	logSettings.protocol, logSettings.session = protocol, session
+}
+
+// Logs to stdout in the configured format and, if lPath is set, appends to
+// lPath in JSON (format json) or text (otherwise)
+func NewLogger(id int, lPath string) *slog.Logger {
+	logger := slog.New(newHandler(lPath)).With("party", id)
+	if logSettings.protocol != "" {
+		logger = logger.With("protocol", logSettings.protocol)
+	}
+	if logSettings.session != "" {
+		logger = logger.With("session", logSettings.session)
+	}
+	return logger
+}
+
+func newHandler(lPath string) slog.Handler {
+	opts := &slog.HandlerOptions{Level: logSettings.level}
+	var handlers fanoutHandler
+	switch logSettings.format {
+	case "json":
+		handlers = append(handlers, slog.NewJSONHandler(os.Stdout, opts))
+	case "text":
+		handlers = append(handlers, slog.NewTextHandler(os.Stdout, opts))
+	default:
+		handlers = append(handlers, &colorHandler{w: os.Stdout, level: opts.Level})
+	}
+
+	if lPath != "" {
+		if logSettings.format == "json" {
+			handlers = append(handlers, slog.NewJSONHandler(openLogFile(lPath), opts))
+		} else {
+			handlers = append(handlers, slog.NewTextHandler(openLogFile(lPath), opts))
+		}
+	}
+	return handlers
+}
+
+// Run-level reports such as "{RESULT}\t": prefixed lines in the color
+// format, records with a section field otherwise
+func Report(prefix string) *log.Logger {
+	if logSettings.level > slog.LevelInfo {
+		return log.New(io.Discard, "", 0)
+	}
+	if logSettings.format == "color" {
+		return log.New(os.Stdout, prefix, 0)
+	}
+	h := newHandler("")
+	if section := strings.Trim(prefix, "{}\t"); section != "" {
+		h = h.WithAttrs([]slog.Attr{slog.String("section", section)})
+	}
+	if logSettings.session != "" {
+		h = h.WithAttrs([]slog.Attr{slog.String("session", logSettings.session)})
+	}
+	return slog.NewLogLogger(h, slog.LevelInfo)
+}
+
+// Blank line between sections of the human-readable output
+func Blank() {
+	if logSettings.format == "color" && logSettings.level <= slog.LevelInfo {
+		fmt.Println("")
+	}
+}
+
+// Files stay open for the lifetime of the process
+func openLogFile(lPath string) *os.File {
+	logFiles.Lock()
+	defer logFiles.Unlock()
+	if f, ok := logFiles.m[lPath]; ok {
+		return f
+	}
+	f, err := os.OpenFile(lPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	Panic(err)
+	logFiles.m[lPath] = f
+	return f
+}
+
+func PartyColor(id int) color.Attribute {
+	if id <= 5 {
+		return map[int]color.Attribute{0: color.FgHiRed, 1: color.FgHiCyan, 2: color.FgHiYellow, 3: color.FgHiGreen, 4: color.FgHiBlue, 5: color.FgHiMagenta}[id]
+	}
+	return color.FgHiWhite
+}
+
+// #############################################################################
+
+// Sends each record to every handler that accepts its level
+type fanoutHandler []slog.Handler
+
+func (h fanoutHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, c := range h {
+		if c.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (h fanoutHandler) Handle(ctx context.Context, r slog.Record) error {
+	for _, c := range h {
+		if c.Enabled(ctx, r.Level) {
+			if err := c.Handle(ctx, r.Clone()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h fanoutHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	ret := make(fanoutHandler, len(h))
+	for i, c := range h {
+		ret[i] = c.WithAttrs(attrs)
+	}
+	return ret
+}
+
+func (h fanoutHandler) WithGroup(name string) slog.Handler {
+	ret := make(fanoutHandler, len(h))
+	for i, c := range h {
+		ret[i] = c.WithGroup(name)
+	}
+	return ret
+}
+
+// The human-readable "{LOG}\t\tParty i => message" lines, colored by party.
+// Attributes other than party and section are left to the other formats.
+type colorHandler struct {
+	w       io.Writer
+	level   slog.Leveler
+	party   int
+	section string
+}
+
+func (h *colorHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= h.level.Level()
+}
+
+func (h *colorHandler) Handle(_ context.Context, r slog.Record) error {
+	tag := "LOG"
+	switch {
+	case h.section != "":
+		tag = h.section
+	case r.Level >= slog.LevelError:
+		tag = "ERROR"
+	case r.Level >= slog.LevelWarn:
+		tag = "WARN"
+	case r.Level < slog.LevelInfo:
+		tag = "DEBUG"
+	}
+
+	c := color.New(PartyColor(h.party))
+	if h.section != "" {
+		c.Add(color.Bold)
+	}
+
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	if progressShown {
+		// Replace the progress line, it is redrawn on the next report
+		fmt.Fprint(h.w, "\r\x1b[K")
+		progressShown = false
+	}
+	_, err := c.Fprintf(h.w, "{%s}\t\tParty %d => %s\n", tag, h.party, r.Message)
+	return err
+}
+
+func (h *colorHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	ret := *h
+	for _, a := range attrs {
+		switch a.Key {
+		case "party":
+			ret.party = int(a.Value.Int64())
+		case "section":
+			ret.section = a.Value.String()
+		}
+	}
+	return &ret
+}
+
+func (h *colorHandler) WithGroup(name string) slog.Handler {
+	return h
+}
+
+// #############################################################################
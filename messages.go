@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// #############################################################################
+
+const (
+	RoundSetup = iota
+	Round1
+	Round3
+)
+
+var roundNames = []string{"Setup", "Round 1", "Round 3"}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+// Size of the message written by fn, as it would be sent over the wire
+func MessageSize(fn func(io.Writer)) uint64 {
+	c := countingWriter{w: io.Discard}
+	fn(&c)
+	return c.n
+}
+
+// A message sent to k recipients counts k times. Counters are updated
+// atomically so they can be scraped while the protocol runs.
+func (c *CommStats) Send(round int, nBytes uint64, k int) {
+	atomic.AddUint64(&c.sent[round], nBytes*uint64(k))
+}
+
+func (c *CommStats) Recv(round int, nBytes uint64) {
+	atomic.AddUint64(&c.recv[round], nBytes)
+}
+
+func (c *CommStats) Sent() uint64 {
+	return c.sent[0] + c.sent[1] + c.sent[2]
+}
+
+func (c *CommStats) Received() uint64 {
+	return c.recv[0] + c.recv[1] + c.recv[2]
+}
+
+// "setup/round1/round3" in bytes
+func (c *CommStats) Format(sent bool) string {
+	v := c.recv
+	if sent {
+		v = c.sent
+	}
+	return fmt.Sprintf("%d/%d/%d", v[0], v[1], v[2])
+}
+
+func (c *CommStats) Log(logger *slog.Logger) {
+	logger.Info(fmt.Sprintf("Communication: sent %f MB, received %f MB", float64(c.Sent())/1e6, float64(c.Received())/1e6), "bytes_sent", c.Sent(), "bytes_received", c.Received())
+	for i, name := range roundNames {
+		logger.Info(fmt.Sprintf("\t%s: sent %d B, received %d B", name, c.sent[i], c.recv[i]), "round", name, "bytes_sent", c.sent[i], "bytes_received", c.recv[i])
+	}
+}
+
+// #############################################################################
+
+func writeUint64(w io.Writer, v uint64) {
+	Panic(binary.Write(w, binary.BigEndian, v))
+}
+
+func readUint64(r io.Reader) uint64 {
+	var v uint64
+	Panic(binary.Read(r, binary.BigEndian, &v))
+	return v
+}
+
+func writeBlob(w io.Writer, b []byte) {
+	writeUint64(w, uint64(len(b)))
+	_, err := w.Write(b)
+	Panic(err)
+}
+
+func readBlob(r io.Reader) []byte {
+	b := make([]byte, readUint64(r))
+	_, err := io.ReadFull(r, b)
+	Panic(err)
+	return b
+}
+
+// #############################################################################
+
+func (s *PointSlab) Write(w io.Writer) {
+	writeUint64(w, uint64(s.stride))
+	writeBlob(w, s.data)
+}
+
+func ReadPointSlab(r io.Reader) PointSlab {
+	var s PointSlab
+	s.stride = int(readUint64(r))
+	s.data = readBlob(r)
+	return s
+}
+
+func writeAES(w io.Writer, AES [][]byte) {
+	writeUint64(w, uint64(len(AES)))
+	for _, ct := range AES {
+		writeBlob(w, ct)
+	}
+}
+
+func readAES(r io.Reader) [][]byte {
+	n := readUint64(r)
+	if n == 0 {
+		return nil
+	}
+	AES := make([][]byte, n)
+	for i := range AES {
+		AES[i] = readBlob(r)
+	}
+	return AES
+}
+
+func (m *HashMapValues) Write(w io.Writer) {
+	writeUint64(w, uint64(m.nBits))
+	m.Q.Write(w)
+	m.S.Write(w)
+	m.EG.Write(w)
+	writeAES(w, m.AES)
+	m.T.Write(w)
+	writeBlob(w, m.Noise)
+	m.DQ.Write(w)
+	m.DS.Write(w)
+}
+
+func ReadHashMapValues(r io.Reader) HashMapValues {
+	var m HashMapValues
+	m.nBits = int(readUint64(r))
+	m.Q = ReadPointSlab(r)
+	m.S = ReadPointSlab(r)
+	m.EG = ReadPointSlab(r)
+	m.AES = readAES(r)
+	m.T = ReadTranscript(r)
+	m.Noise = readBlob(r)
+	m.DQ = ReadPointSlab(r)
+	m.DS = ReadPointSlab(r)
+	return m
+}
+
+func (m *HashMapFinal) Write(w io.Writer) {
+	writeUint64(w, uint64(m.lanes))
+	m.Q.Write(w)
+	writeAES(w, m.AES)
+	m.T.Write(w)
+	writeBlob(w, m.Noise)
+}
+
+func ReadHashMapFinal(r io.Reader) HashMapFinal {
+	var m HashMapFinal
+	m.lanes = int(readUint64(r))
+	m.Q = ReadPointSlab(r)
+	m.AES = readAES(r)
+	m.T = ReadTranscript(r)
+	m.Noise = readBlob(r)
+	return m
+}
+
+func WriteCiphertext(w io.Writer, ctx *EGContext, ct *EGCiphertext) {
+	writeBlob(w, ctx.EG_Serialize(ct))
+}
+
+func ReadCiphertext(r io.Reader, ctx *EGContext) EGCiphertext {
+	return ctx.EG_Deserialize(readBlob(r))
+}
+
+// The sums of all columns
+func WriteCiphertexts(w io.Writer, ctx *EGContext, cts []EGCiphertext) {
+	writeUint64(w, uint64(len(cts)))
+	for i := range cts {
+		WriteCiphertext(w, ctx, &cts[i])
+	}
+}
+
+func ReadCiphertexts(r io.Reader, ctx *EGContext) []EGCiphertext {
+	cts := make([]EGCiphertext, readUint64(r))
+	for i := range cts {
+		cts[i] = ReadCiphertext(r, ctx)
+	}
+	return cts
+}
+
+func WritePoints(w io.Writer, P []DHElement) {
+	writeUint64(w, uint64(len(P)))
+	for i := range P {
+		_, err := w.Write(P[i].Serialize())
+		Panic(err)
+	}
+}
+
+func ReadPoints(r io.Reader, ctx *DHContext) []DHElement {
+	P := make([]DHElement, readUint64(r))
+	b := make([]byte, len(DHPoint{}))
+	for i := range P {
+		_, err := io.ReadFull(r, b)
+		Panic(err)
+		P[i] = DHElementFromBytes(ctx, b)
+	}
+	return P
+}
+
+// #############################################################################
+
+// Writes to a temporary file and renames it, so a reader polling for fpath
+// never sees a partial message. Returns the message size in bytes.
+func WriteMessage(fpath string, fn func(io.Writer)) uint64 {
+	tmp := fpath + ".tmp"
+	file, err := os.Create(tmp)
+	Panic(err)
+	w := bufio.NewWriter(file)
+	c := countingWriter{w: w}
+	fn(&c)
+	Panic(w.Flush())
+	Panic(file.Close())
+	Panic(os.Rename(tmp, fpath))
+	return c.n
+}
+
+// Blocks until fpath exists. Returns the message size in bytes.
+func ReadMessage(fpath string, logger *slog.Logger, fn func(io.Reader)) uint64 {
+	logged := false
+	for {
+		file, err := os.Open(fpath)
+		if err == nil {
+			defer file.Close()
+			c := countingReader{r: bufio.NewReader(file)}
+			fn(&c)
+			return c.n
+		}
+		Assert(os.IsNotExist(err))
+		if !logged {
+			logger.Info(fmt.Sprintf("Waiting for %s", fpath), "message", fpath)
+			logged = true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// #############################################################################
+
+const openMetricsType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Serves the metrics of p at http://addr/metrics until Stop. A port of 0
+// picks a free port, see Metrics.Addr.
+func StartMetrics(addr string, p *Party) *Metrics {
+	ln, err := net.Listen("tcp", addr)
+	Panic(err)
+
+	m := &Metrics{party: p.id, comm: p.comm, phase: PhaseInit, start: time.Now(), Addr: ln.Addr().String()}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", openMetricsType)
+		m.Write(w)
+	})
+	m.server = &http.Server{Handler: mux}
+	go m.server.Serve(ln)
+
+	p.metrics = m
+	return m
+}
+
+// Nil when metrics_port is not set
+func (cfg *Config) ServeMetrics(p *Party) *Metrics {
+	if cfg.metricsPort == 0 {
+		return nil
+	}
+	m := StartMetrics(fmt.Sprintf(":%d", cfg.metricsPort+p.id), p)
+	p.log.Info(fmt.Sprintf("Metrics served at http://%s/metrics", m.Addr), "addr", m.Addr)
+	return m
+}
+
+func (m *Metrics) Stop() {
+	if m != nil {
+		m.server.Close()
+	}
+}
+
+func (m *Metrics) SetPhase(phase int) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.elapsed[m.phase] += now.Sub(m.start)
+	m.phase, m.start = phase, now
+}
+
+// Reports the progress of pool until Untrack
+func (m *Metrics) Track(pool *WorkerPool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pool = pool
+}
+
+func (m *Metrics) Untrack(pool *WorkerPool) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.slots[m.phase] += pool.Done()
+	m.pool = nil
+}
+
+// #############################################################################
+
+func (m *Metrics) Write(w io.Writer) {
+	m.mu.Lock()
+	slots, elapsed, phase := m.slots, m.elapsed, m.phase
+	elapsed[phase] += time.Since(m.start)
+	depth := 0
+	if m.pool != nil {
+		slots[phase] += m.pool.Done()
+		depth = m.pool.QueueDepth()
+	}
+	m.mu.Unlock()
+
+	party := fmt.Sprintf("party=\"%d\"", m.party)
+
+	fmt.Fprintln(w, "# HELP mps_slots_processed Hash map slots processed by the worker pools.")
+	fmt.Fprintln(w, "# TYPE mps_slots_processed counter")
+	for i, name := range phaseNames {
+		fmt.Fprintf(w, "mps_slots_processed_total{%s,phase=%q} %d\n", party, name, slots[i])
+	}
+
+	fmt.Fprintln(w, "# HELP mps_slots_per_second Slots processed per second of each phase.")
+	fmt.Fprintln(w, "# TYPE mps_slots_per_second gauge")
+	for i, name := range phaseNames {
+		rate := 0.0
+		if elapsed[i] > 0 {
+			rate = float64(slots[i]) / elapsed[i].Seconds()
+		}
+		fmt.Fprintf(w, "mps_slots_per_second{%s,phase=%q} %f\n", party, name, rate)
+	}
+
+	fmt.Fprintln(w, "# HELP mps_pool_queue_depth Jobs waiting for a worker.")
+	fmt.Fprintln(w, "# TYPE mps_pool_queue_depth gauge")
+	fmt.Fprintf(w, "mps_pool_queue_depth{%s} %d\n", party, depth)
+
+	fmt.Fprintln(w, "# HELP mps_bytes_sent Bytes sent in each round.")
+	fmt.Fprintln(w, "# TYPE mps_bytes_sent counter")
+	for i, name := range roundNames {
+		fmt.Fprintf(w, "mps_bytes_sent_total{%s,round=%q} %d\n", party, name, atomic.LoadUint64(&m.comm.sent[i]))
+	}
+
+	fmt.Fprintln(w, "# HELP mps_bytes_received Bytes received in each round.")
+	fmt.Fprintln(w, "# TYPE mps_bytes_received counter")
+	for i, name := range roundNames {
+		fmt.Fprintf(w, "mps_bytes_received_total{%s,round=%q} %d\n", party, name, atomic.LoadUint64(&m.comm.recv[i]))
+	}
+
+	fmt.Fprintln(w, "# HELP mps_phase Phase the party is in.")
+	fmt.Fprintln(w, "# TYPE mps_phase stateset")
+	for i, name := range phaseNames {
+		state := 0
+		if i == phase {
+			state = 1
+		}
+		fmt.Fprintf(w, "mps_phase{%s,mps_phase=%q} %d\n", party, name, state)
+	}
+
+	fmt.Fprintln(w, "# EOF")
+}
+
+// #############################################################################
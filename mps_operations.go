@@ -1,9 +1,12 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
+	"io"
 	"log"
 	"math/big"
+	"math/bits"
 	"os"
 	"path"
 	"strconv"
@@ -17,7 +20,9 @@ import (
 
 // #############################################################################
 
-func PrintInfo(logger *log.Logger, protoName, dataDir, resDir string, nParties, nHashes0, nHashesI, intCard, nBits int, eProfile bool) {
+var protoNames = []string{"MPSI", "MPSI-Sum", "MPSIU", "MPSIU-Sum", "OT-MPSI", "OT-MPSI-Sum"}
+
+func PrintInfo(logger *log.Logger, protoName, dataDir, resDir string, nParties int, sizes []int, intCard, nBits int, seed int64, eProfile bool) {
 
 	color.Set(color.FgGreen, color.Bold)
 	defer color.Unset()
@@ -27,17 +32,38 @@ func PrintInfo(logger *log.Logger, protoName, dataDir, resDir string, nParties,
 	logger.Printf("Protocol%s%s\n", sep, protoName)
 	logger.Printf("Parties%s%d\n", sep, nParties)
 	logger.Printf("Delegate%sP_0\n", sep)
-	logger.Printf("|X_0|%s%d\n", sep, nHashes0)
-	logger.Printf("|X_i|%s%d\n", sep, nHashesI)
+	for i, sz := range sizes {
+		logger.Printf("|X_%d|%s%d\n", i, sep, sz)
+	}
 	logger.Printf("|I|%s%d\n", sep, intCard)
 	logger.Printf("|M|%s%d\n", sep, 1<<nBits)
+	logger.Printf("Seed%s%d\n", sep, seed)
 	logger.Printf("Data%s%s\n", sep, dataDir)
 	logger.Printf("Results%s%s\n", sep, resDir)
 	logger.Printf("Profile%s%s\n", sep, strconv.FormatBool(eProfile))
 }
 
-func Save(proto, nParties, nHashes0, nHashesI, nBits int, card, cardComputed float64, times []time.Duration, fname string) {
-	strs := []string{[]string{"MPSI", "MPSI-Sum", "MPSIU", "MPSIU-Sum"}[proto], strconv.Itoa(nParties), strconv.Itoa(nHashes0), strconv.Itoa(nHashesI), strconv.Itoa(nBits), fmt.Sprintf("%f", card), fmt.Sprintf("%f", cardComputed)}
+// Heterogeneous |X_1|, ..., |X_n| are written to the xi column separated by ';'
+func Save(proto, nParties int, sizes []int, nBits, lim int, seed int64, card, cardComputed float64, costs []PartyCost, times []time.Duration, fname string) {
+	xi := make([]string, 0, len(sizes)-1)
+	uniform := true
+	for _, sz := range sizes[1:] {
+		xi = append(xi, strconv.Itoa(sz))
+		uniform = uniform && (sz == sizes[1])
+	}
+	if uniform {
+		xi = xi[:1]
+	}
+
+	strs := []string{protoNames[proto], strconv.Itoa(nParties), strconv.Itoa(sizes[0]), strings.Join(xi, ";"), strconv.Itoa(nBits), strconv.Itoa(lim), strconv.FormatInt(seed, 10), fmt.Sprintf("%f", card), fmt.Sprintf("%f", cardComputed)}
+
+	// Bytes sent then received by each party, as setup/round1/round3
+	for i := 0; i < len(costs); i++ {
+		strs = append(strs, costs[i].Comm.Format(true))
+	}
+	for i := 0; i < len(costs); i++ {
+		strs = append(strs, costs[i].Comm.Format(false))
+	}
 
 	for i := 0; i < len(times); i++ {
 		strs = append(strs, times[i].String())
@@ -46,9 +72,26 @@ func Save(proto, nParties, nHashes0, nHashesI, nBits int, card, cardComputed flo
 	AppendFile(fname, []string{strings.Join(strs, ",")})
 }
 
+func ReadWorkloadParams(sizes []int, intCard, lim, cols int) *WorkloadParams {
+	p := WorkloadParams{Sizes: sizes, IntCard: intCard, Lim: lim, Cols: cols}
+	p.IDs = viper.GetString("ids")
+	p.Values = viper.GetString("values")
+	p.ZipfS = viper.GetFloat64("zipf_s")
+	p.SpreadS = viper.GetFloat64("spread_s")
+
+	var overlaps [][]float64
+	Panic(viper.UnmarshalKey("overlaps", &overlaps))
+	for _, o := range overlaps {
+		Assert(len(o) == 3)
+		p.Overlaps = append(p.Overlaps, PairOverlap{int(o[0]), int(o[1]), o[2]})
+	}
+	return &p
+}
+
 // #############################################################################
 
-func RunInit(nParties, nBits int, fpaths []string, lPath string) (Delegate, []Party, []time.Duration) {
+// All parties join the session s, with a fresh id if it has none
+func RunInit(nParties, nBits int, eg EGParams, fpaths []string, lPath string, s Session) (Delegate, []Party, []time.Duration) {
 	parties := make([]Party, nParties)
 	var delegate Delegate
 	var watch Stopwatch
@@ -57,7 +100,7 @@ func RunInit(nParties, nBits int, fpaths []string, lPath string) (Delegate, []Pa
 	pks := make([]DHElement, nParties+1)
 
 	// Initialize
-	NewEGContext(&ctx, 2, 33)
+	NewEGContext(&ctx, eg.nModuli, eg.maxBits, eg.countBits)
 	watch.Reset()
 	delegate.Init(0, nParties, nBits, fpaths[0], lPath, &ctx)
 	pks[0] = delegate.party.Partial_PubKey()
@@ -70,15 +113,25 @@ func RunInit(nParties, nBits int, fpaths []string, lPath string) (Delegate, []Pa
 		times = append(times, watch.Elapsed())
 	}
 
+	if s.ID == nil {
+		s.ID = RandomBytes(16)
+	}
 	delegate.party.Set_AggPubKey(pks)
+	delegate.party.CountSetup(nParties, true)
+	delegate.party.SetSession(s)
 	for i := 1; i <= nParties; i++ {
 		parties[i-1].Set_AggPubKey(pks)
+		parties[i-1].CountSetup(nParties, false)
+		parties[i-1].SetSession(s)
 	}
 
 	return delegate, parties, times
 }
 
-func RunProtocol(nParties int, delegate Delegate, parties []Party, proto int) (float64, *big.Int, []time.Duration) {
+// Returns the count, the sum of each column followed, with the moments of the
+// delegate, by the sum of squares of each column, the time of each step and
+// the cost of each party. t is the threshold of OT-MPSI.
+func RunProtocol(nParties int, delegate Delegate, parties []Party, proto, t int) (float64, []big.Int, []time.Duration, []PartyCost) {
 	var watch Stopwatch
 	var times []time.Duration
 	// Round1
@@ -90,17 +143,27 @@ func RunProtocol(nParties int, delegate Delegate, parties []Party, proto int) (f
 	watch.Reset()
 	delegate.DelegateStart(&M, sum) // TODO: change
 	times = append(times, watch.Elapsed())
+
+	// M is broadcast to every party
+	mSize := MessageSize(M.Write)
+	delegate.party.comm.Send(Round1, mSize, nParties)
 	for i := 0; i < nParties; i++ {
-		if proto <= 1 {
-			watch.Reset()
-			final = parties[i].MPSI(delegate.L, &M, &R, sum) // TODO: Change
-			times = append(times, watch.Elapsed())
-		} else {
-			watch.Reset()
-			final = parties[i].MPSIU(delegate.L, &M, &R, sum) // TODO: Change
-			times = append(times, watch.Elapsed())
+		parties[i].comm.Recv(Round1, mSize)
+		parties[i].parent = delegate.party.last
+		if i > 0 {
+			rSize := MessageSize(R.Write)
+			parties[i-1].comm.Send(Round1, rSize, 1)
+			parties[i].comm.Recv(Round1, rSize)
+			parties[i].parent = parties[i-1].last
 		}
+		watch.Reset()
+		final = parties[i].Round1(proto, t, delegate.L, &M, &R)
+		times = append(times, watch.Elapsed())
 	}
+	bSize := MessageSize(final.Write)
+	parties[nParties-1].comm.Send(Round1, bSize, 1)
+	delegate.party.comm.Recv(Round1, bSize)
+	delegate.party.parent = parties[nParties-1].last
 
 	// Round2
 	watch.Reset()
@@ -109,129 +172,337 @@ func RunProtocol(nParties int, delegate Delegate, parties []Party, proto int) (f
 	// TODO: Change
 	times = append(times, watch.Elapsed())
 
-	var computedSum big.Int
+	var computedSum []big.Int
 	if sum {
 		// Round 3
-		partials[0] = delegate.party.Partial_Decrypt(ctSum)
+		watch.Reset()
+		ctSpan := delegate.party.last
+		delegate.party.parent = ctSpan
+		var err error
+		partials[0], err = delegate.party.Partial_Decrypt(ctSum, delegate.transcript)
+		Panic(err)
 		for i := 1; i <= nParties; i++ {
-			partials[i] = parties[i-1].Partial_Decrypt(ctSum)
+			parties[i-1].parent = ctSpan
+			partials[i], err = parties[i-1].Partial_Decrypt(ctSum, delegate.transcript)
+			Panic(err)
 		}
+		delegate.party.parent = parties[nParties-1].last
 		computedSum = delegate.JointDecryption(ctSum, partials)
-	}
+		times = append(times, watch.Elapsed())
 
-	fmt.Println("")
+		// The delegate broadcasts the ciphertext and transcript, each party
+		// returns its partial decryption
+		ctSize := MessageSize(func(w io.Writer) {
+			WriteCiphertexts(w, &delegate.party.ctx, ctSum)
+			delegate.transcript.Write(w)
+		})
+		delegate.party.comm.Send(Round3, ctSize, nParties)
+		for i := 1; i <= nParties; i++ {
+			pSize := MessageSize(func(w io.Writer) { WritePoints(w, partials[i]) })
+			parties[i-1].comm.Recv(Round3, ctSize)
+			parties[i-1].comm.Send(Round3, pSize, 1)
+			delegate.party.comm.Recv(Round3, pSize)
+		}
+	}
 
-	color.Set(delegate.party.log_color, color.Bold)
-	delegate.party.log.SetPrefix("{COST}\t\tParty 0 => ")
-	delegate.party.log.Printf("Computation: %d EC point mul.\n", delegate.party.TComputation(proto, &R))
-	delegate.party.log.Printf("Communication: %f MB\n", float64(delegate.party.TCommunication(&R))/1e6)
-	color.Unset()
+	Blank()
 
+	costs := make([]PartyCost, nParties+1)
+	costs[0] = delegate.party.LogCost()
 	for i := 0; i < nParties; i++ {
-		color.Set(parties[i].log_color, color.Bold)
-		parties[i].log.SetPrefix(fmt.Sprintf("{COST}\t\tParty %d => ", parties[i].id))
-		parties[i].log.Printf("Computation: %d EC point mul.\n", parties[i].TComputation(proto, &R))
-		parties[i].log.Printf("Communication: %f MB\n", float64(delegate.party.TCommunication(&R))/1e6)
-		color.Unset()
+		costs[i+1] = parties[i].LogCost()
 	}
 
-	return float64(cardComputed), &computedSum, times
+	return float64(cardComputed), computedSum, times, costs
 }
 
 // #############################################################################
 
-func main() {
-	color.Set(color.FgBlue, color.Bold, color.Underline)
-	fmt.Println("Multiparty Private Set Operations")
-	fmt.Println("")
-	color.Unset()
+func ReadConfig() Config {
+	var cfg Config
+	cfg.proto = -1
+	for i, name := range protoNames {
+		if viper.GetString("protocol") == name {
+			cfg.proto = i
+		}
+	}
 
-	var nParties, nHashes0, nHashesI, intCard, lim, nBits, proto int
-	var dataDir, resDir string
-	var eProfile bool
+	cfg.nParties = viper.GetInt("n")
+	cfg.sizes = viper.GetIntSlice("sizes")
+	if len(cfg.sizes) == 0 {
+		cfg.sizes = UniformSizes(cfg.nParties, viper.GetInt("x0"), viper.GetInt("xi"))
+	}
+	cfg.intCard = viper.GetInt("i")
+	cfg.lim = viper.GetInt("l")
+	cfg.nBits = viper.GetInt("b")
+	cfg.seed = viper.GetInt64("seed")
+	cfg.nModuli = uint(viper.GetInt("moduli"))
+
+	cfg.dataDir = viper.GetString("data_dir")
+	cfg.resDir = viper.GetString("result_dir")
+	cfg.keyDir = viper.GetString("key_dir")
+	cfg.msgDir = viper.GetString("msg_dir")
+
+	cfg.eProfile = viper.GetBool("profile")
+	cfg.metricsPort = viper.GetInt("metrics_port")
+	cfg.logFormat = viper.GetString("log_format")
+	cfg.logLevel = viper.GetString("log_level")
+	cfg.session = viper.GetString("session")
+	cfg.traceFile = viper.GetString("trace_file")
+	cfg.progress = viper.GetBool("progress")
+	cfg.checkpointDir = viper.GetString("checkpoint_dir")
+	cfg.h2cCacheDir = viper.GetString("h2c_cache_dir")
+	cfg.h2cCacheSecret = viper.GetString("h2c_cache_secret")
+	cfg.suite = viper.GetString("h2c_suite")
+	cfg.dst = viper.GetString("h2c_dst")
+	cfg.threshold = viper.GetInt("t")
+	cfg.cols = viper.GetInt("columns")
+	cfg.moments = viper.GetBool("moments")
+	cfg.partyValues = viper.GetBool("party_values")
+	cfg.reveal = viper.GetBool("reveal")
+	cfg.dp = viper.GetString("dp")
+	cfg.epsilon = viper.GetFloat64("epsilon")
+	cfg.delta = viper.GetFloat64("delta")
+	cfg.epsilonBudget = viper.GetFloat64("epsilon_budget")
+	cfg.deltaBudget = viper.GetFloat64("delta_budget")
+	cfg.dpLedgerDir = viper.GetString("dp_ledger_dir")
+
+	Assert(cfg.proto >= 0 && cfg.proto < len(protoNames))
+	Assert(cfg.nParties > 1)
+	Assert(cfg.threshold >= 1 && cfg.threshold <= cfg.nParties)
+	Assert(cfg.cols >= 1)
+	Assert(!cfg.partyValues || ((cfg.proto == 1 || cfg.proto == 3) && !cfg.moments))
+	Assert(!cfg.reveal || cfg.proto%2 == 0)
+	Assert(cfg.dp == "" || cfg.dp == "laplace" || cfg.dp == "gaussian")
+	Assert(cfg.dp == "" || (!cfg.reveal && cfg.epsilon > 0 && cfg.delta > 0 && cfg.delta < 1))
+	Assert(len(cfg.sizes) == cfg.nParties+1)
+	Assert(cfg.sizes[0] >= cfg.intCard)
+	Panic(cfg.CheckIntCard())
+	Panic(cfg.CheckDP())
+	Assert(cfg.nBits > 9)
+	Assert(len(cfg.dataDir) > 0)
+	Assert(len(cfg.resDir) > 0)
+	return cfg
+}
 
-	viper.SetConfigName("config")
-	viper.AddConfigPath(".")
-	Panic(viper.ReadInConfig())
+// The intersection must fit in every set for MPSI, and in the union of the
+// non-delegate sets for MPSIU and OT-MPSI
+func (cfg *Config) CheckIntCard() error {
+	room := 0
+	for i, sz := range cfg.sizes[1:] {
+		if cfg.proto <= 1 && sz < cfg.intCard {
+			return fmt.Errorf("set of party %d holds %d elements, fewer than the intersection i = %d", i+1, sz, cfg.intCard)
+		}
+		room += sz
+	}
+	if room < cfg.intCard {
+		return fmt.Errorf("sets of parties 1 to %d hold %d elements, fewer than the intersection i = %d", cfg.nParties, room, cfg.intCard)
+	}
+	return nil
+}
 
-	switch viper.GetString("protocol") {
-	case "MPSI":
-		proto = 0
-	case "MPSI-Sum":
-		proto = 1
-	case "MPSIU":
-		proto = 2
-	case "MPSIU-Sum":
-		proto = 3
+// The classic Gaussian mechanism only holds for an epsilon below 1, and each
+// of the k outputs of a run gets epsilon / k
+func (cfg *Config) CheckDP() error {
+	if k := 1 + len(cfg.Sensitivity()); cfg.dp == "gaussian" && cfg.epsilon >= float64(k) {
+		return fmt.Errorf("dp = gaussian needs epsilon / %d below 1 for each of the %d outputs of a run, got epsilon = %g", k, k, cfg.epsilon)
 	}
+	return nil
+}
 
-	nParties = viper.GetInt("n")
-	nHashes0 = viper.GetInt("x0")
-	nHashesI = viper.GetInt("xi")
-	intCard = viper.GetInt("i")
-	lim = viper.GetInt("l")
-	nBits = viper.GetInt("b")
+func (cfg *Config) Session() Session {
+	return Session{ID: []byte(cfg.session), Suite: cfg.suite, DST: cfg.dst}.Resolve()
+}
 
-	dataDir = viper.GetString("data_dir")
-	resDir = viper.GetString("result_dir")
+// Sizes the ElGamal context for the largest sum of the run: at most |X_0|
+// values below l, or their squares with moments, or the sums of the values of
+// all n+1 parties. With dp, the sums also add the noise shares and the
+// dummies of every party, and may be negative.
+func (cfg *Config) EGParams() EGParams {
+	count := cfg.sizes[0]
+	var dp *DPNoise
+	if cfg.dp != "" {
+		dp = NewDPNoise(cfg.dp, cfg.epsilon, cfg.delta, cfg.Sensitivity(), cfg.nParties)
+		count += cfg.nParties * dp.Dummies()
+	}
+	countBits := uint(bits.Len(uint(count)))
+	maxBits := uint(bits.Len(uint(cfg.lim)))
+	if cfg.moments {
+		maxBits *= 2
+	}
+	if cfg.partyValues {
+		maxBits += uint(bits.Len(uint(cfg.nParties + 1)))
+	}
+	maxBits += countBits
+	if dp != nil {
+		if dp.Bits() > maxBits {
+			maxBits = dp.Bits()
+		}
+		maxBits += 2
+	}
 
-	eProfile = viper.GetBool("profile")
+	nModuli := cfg.nModuli
+	if nModuli == 0 {
+		nModuli = AutoModuli(maxBits, countBits)
+	}
+	return EGParams{nModuli, maxBits, countBits}
+}
 
-	Assert(proto >= 0 || proto <= 3)
-	Assert(nParties > 1)
-	Assert(nHashesI >= nHashes0)
-	Assert(nBits > 9)
-	Assert(len(dataDir) > 0)
-	Assert(len(resDir) > 0)
+// The sums of the ground truth stats that the run computes: one per column,
+// then one sum of squares per column with moments
+func (cfg *Config) TrueSums(stats []float64) []float64 {
+	if cfg.moments {
+		return stats[1:]
+	}
+	return stats[1 : 1+len(stats)/2]
+}
 
-	if eProfile {
-		defer profile.Start(profile.ProfilePath("./" + resDir)).Stop()
+// Number of parties that must hold an element of the delegate for it to count
+func (cfg *Config) Threshold() int {
+	switch {
+	case cfg.proto <= 1:
+		return cfg.nParties
+	case cfg.proto <= 3:
+		return 1
 	}
+	return cfg.threshold
+}
 
-	// var watch Stopwatch
-	var times []time.Duration
-	fpaths := make([]string, nParties+1)
-	protoName := []string{"MPSI", "MPSI-Sum", "MPSIU", "MPSIU-Sum"}
+func (cfg *Config) DataPaths() []string {
+	fpaths := make([]string, cfg.nParties+1)
 	for i := range fpaths {
-		fpaths[i] = path.Join(dataDir, fmt.Sprintf("%d.txt", i))
+		fpaths[i] = path.Join(cfg.dataDir, fmt.Sprintf("%d.txt", i))
 	}
+	return fpaths
+}
 
-	_ = os.Mkdir(dataDir, os.ModePerm)
-	_ = os.Mkdir(resDir, os.ModePerm)
-
-	data := NewSampleData(nParties+1, nHashes0, nHashesI, intCard, lim, dataDir, false, (proto <= 1))
-	res := data.ComputeStats((proto <= 1))
-	trueCard, trueSum := res[0], res[1]
+func GenerateData(cfg *Config) *SampleData {
+	_ = os.Mkdir(cfg.dataDir, os.ModePerm)
+	if viper.GetString("workload") == "realistic" {
+		return NewWorkloadData(ReadWorkloadParams(cfg.sizes, cfg.intCard, cfg.lim, cfg.cols), cfg.dataDir, (cfg.proto <= 1), cfg.seed)
+	}
+	return NewSampleData(cfg.sizes, cfg.intCard, cfg.lim, cfg.cols, cfg.dataDir, false, (cfg.proto <= 1), cfg.seed)
+}
 
-	// times = append(times, watch.Elapsed())
+// sumComputed and trueSum hold one sum per column, followed with moments by
+// one sum of squares per column
+func PrintResult(proto int, cardComputed, trueCard float64, sumComputed []big.Int, trueSum []float64, moments bool) {
+	color.Set(color.FgMagenta, color.Bold)
+	defer color.Unset()
 
-	stdout := log.New(os.Stdout, "", 0)
-	stdout.SetPrefix("{CONFIG}\t")
-	PrintInfo(stdout, protoName[proto], dataDir, resDir, nParties, nHashes0, nHashesI, intCard, nBits, eProfile)
-	fmt.Println("")
+	logger := Report("{RESULT}\t")
+	e1 := (cardComputed - trueCard) * 100 / trueCard
+	logger.Printf("Count = %d (True: %d / Error: %.2f%%)\n", int(cardComputed), int(trueCard), e1)
 
-	delegate, parties, _times := RunInit(nParties, nBits, fpaths, resDir+"/log.txt")
-	times = append(times, _times...)
+	if proto%2 == 1 {
+		cols := len(sumComputed)
+		if moments {
+			cols /= 2
+		}
+		for j := 0; j < cols; j++ {
+			suffix := ""
+			if cols > 1 {
+				suffix = fmt.Sprintf(" %d", j+1)
+			}
+			sum, _ := new(big.Float).SetInt(&sumComputed[j]).Float64()
+			e2 := (sum - trueSum[j]) * 100 / trueSum[j]
+			logger.Printf("Sum%s = %s (True: %.0f / Error: %.2f%%)\n", suffix, sumComputed[j].Text(10), trueSum[j], e2)
+			logger.Printf("Mean%s = %.3f (True: %.3f)\n", suffix, sum/cardComputed, trueSum[j]/trueCard)
+			if !moments {
+				continue
+			}
+
+			sumSq, _ := new(big.Float).SetInt(&sumComputed[cols+j]).Float64()
+			trueSq := trueSum[cols+j]
+			logger.Printf("Sum of squares%s = %s (True: %.0f / Error: %.2f%%)\n", suffix, sumComputed[cols+j].Text(10), trueSq, (sumSq-trueSq)*100/trueSq)
+			variance, trueVariance := Variance(cardComputed, sum, sumSq), Variance(trueCard, trueSum[j], trueSq)
+			logger.Printf("Variance%s = %.3f (True: %.3f)\n", suffix, variance, trueVariance)
+		}
+	}
+}
 
-	cardComputed, sumComputed, _times := RunProtocol(nParties, delegate, parties, proto)
-	times = append(times, _times...)
+// Generates data and runs all parties in-process. No ledger is charged: each
+// party charges its own when it runs as a process of its own.
+func RunTrial(cfg Config) TrialResult {
+	var res TrialResult
+	var peak MemoryPeak
+	fpaths := cfg.DataPaths()
+	_ = os.Mkdir(cfg.resDir, os.ModePerm)
+
+	peak.Start()
+	data := GenerateData(&cfg)
+	stats := data.ComputeStats(cfg.Threshold(), cfg.partyValues)
+	res.seed, res.trueCard, res.trueSum = data.Seed, stats[0], cfg.TrueSums(stats)
+
+	session := cfg.session
+	if session == "" {
+		session = hex.EncodeToString(RandomBytes(8))
+	}
+	SetLogContext(protoNames[cfg.proto], session)
 
-	fmt.Println("")
-	color.Set(color.FgMagenta, color.Bold)
+	PrintInfo(Report("{CONFIG}\t"), protoNames[cfg.proto], cfg.dataDir, cfg.resDir, cfg.nParties, cfg.sizes, cfg.intCard, cfg.nBits, data.Seed, cfg.eProfile)
+	Blank()
 
-	e1 := (cardComputed - trueCard) * 100 / trueCard
-	fmt.Printf("{RESULT}\tCount = %d (True: %d / Error: %.2f%%)\n", int(cardComputed), int(trueCard), e1)
+	delegate, parties, initTimes := RunInit(cfg.nParties, cfg.nBits, cfg.EGParams(), fpaths, cfg.resDir+"/log.txt", Session{ID: []byte(session), Suite: cfg.suite, DST: cfg.dst})
+	defer cfg.ServeMetrics(&delegate.party).Stop()
+	for i := range parties {
+		defer cfg.ServeMetrics(&parties[i]).Stop()
+	}
+	tracers := []*Tracer{cfg.StartTracing(&delegate.party, session)}
+	delegate.party.showProgress = cfg.progress
+	cfg.OpenDP(&delegate.party)
+	for i := range parties {
+		tracers = append(tracers, cfg.StartTracing(&parties[i], session))
+		parties[i].showProgress = cfg.progress
+		parties[i].addValues = cfg.partyValues
+		cfg.OpenDP(&parties[i])
+	}
+	defer ExportSpans(cfg.TracePath(), tracers...)
+	delegate.moments = cfg.moments
+	cfg.OpenReveal(&delegate)
+	res.card, res.sum, res.times, res.costs = RunProtocol(cfg.nParties, delegate, parties, cfg.proto, cfg.Threshold())
+	res.memPeak = peak.Stop()
+	cfg.WriteIntersection(&delegate)
+
+	// RunProtocol times DelegateStart, each party, DelegateFinish and,
+	// for sums, the joint decryption
+	n := cfg.nParties
+	for _, t := range initTimes {
+		res.phases[0] += t
+	}
+	res.phases[1] = res.times[0]
+	for _, t := range res.times[1 : n+1] {
+		res.phases[2] += t
+	}
+	res.phases[3] = res.times[n+1]
+	if len(res.times) > n+2 {
+		res.phases[4] = res.times[n+2]
+	}
+	res.times = append(initTimes, res.times...)
+	return res
+}
 
-	if proto%2 == 1 {
-		e2 := (float64(sumComputed.Int64()) - trueSum) * 100 / trueSum
-		fmt.Printf("{RESULT}\tSum = %s (True: %d / Error: %.2f%%)\n", sumComputed.Text(10), int(trueSum), e2)
+// Runs one trial and appends it to bench.csv
+func RunBench(cfg Config) {
+	if cfg.eProfile {
+		defer profile.Start(profile.ProfilePath("./" + cfg.resDir)).Stop()
 	}
-	color.Unset()
 
-	Save(proto, nParties, nHashes0, nHashesI, nBits, trueCard, cardComputed, times, resDir+"/bench.csv")
+	res := RunTrial(cfg)
+
+	Blank()
+	PrintResult(cfg.proto, res.card, res.trueCard, res.sum, res.trueSum, cfg.moments)
+
+	Save(cfg.proto, cfg.nParties, cfg.sizes, cfg.nBits, cfg.lim, res.seed, res.trueCard, res.card, res.costs, res.times, cfg.resDir+"/bench.csv")
 
 	color.Set(color.FgBlue)
-	fmt.Printf("\nBenchmark written to %s/bench.csv\n", resDir)
+	Blank()
+	Report("").Printf("Benchmark written to %s/bench.csv\n", cfg.resDir)
+	color.Unset()
+}
+
+func main() {
+	os.Exit(RunCLI(os.Args[1:]))
 }
 
 // #############################################################################
@@ -3,12 +3,19 @@ package main
 import (
 	"bytes"
 	"crypto/elliptic"
+	"encoding/hex"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math"
 	"math/big"
+	"net/http"
 	"os"
+	"path"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -30,7 +37,7 @@ func EGSingle(b *testing.B) {
 	var pk DHElement
 	var m, mPrime big.Int
 
-	NewEGContext(&ctx, 3, 35)
+	NewEGContext(&ctx, 3, 35, 10)
 	sk := ctx.ecc.RandomScalar()
 	ctx.EG_PubKey(sk, &pk)
 
@@ -50,7 +57,7 @@ func EGMulti(b *testing.B) {
 	var apk DHElement
 	var m, mPrime big.Int
 
-	NewEGContext(&ctx, 3, 35)
+	NewEGContext(&ctx, 3, 35, 10)
 	nParties := 5
 
 	sk := make([]*big.Int, nParties)
@@ -80,7 +87,7 @@ func EGArithmetic(b *testing.B) {
 	var pk DHElement
 	var m1, m2, s, sPrime big.Int
 
-	NewEGContext(&ctx, 3, 35)
+	NewEGContext(&ctx, 3, 35, 10)
 	sk := ctx.ecc.RandomScalar()
 	ctx.EG_PubKey(sk, &pk)
 
@@ -105,7 +112,7 @@ func EGRerandom(b *testing.B) {
 	var pk DHElement
 	var m, mPrime big.Int
 
-	NewEGContext(&ctx, 3, 35)
+	NewEGContext(&ctx, 3, 35, 10)
 	sk := ctx.ecc.RandomScalar()
 	ctx.EG_PubKey(sk, &pk)
 
@@ -121,7 +128,7 @@ func EGRerandom(b *testing.B) {
 
 func ECCSerialization(b *testing.B) {
 	var ctx EGContext
-	NewEGContext(&ctx, 3, 35)
+	NewEGContext(&ctx, 3, 35, 10)
 
 	var e, ePrime DHElement
 	for i := 0; i < b.N; i++ {
@@ -139,7 +146,7 @@ func EGSerialization(b *testing.B) {
 	var pk DHElement
 	var m, mPrime big.Int
 
-	NewEGContext(&ctx, 3, 35)
+	NewEGContext(&ctx, 3, 35, 10)
 	sk := ctx.ecc.RandomScalar()
 	ctx.EG_PubKey(sk, &pk)
 
@@ -212,14 +219,75 @@ func BenchmarkAES(b *testing.B) {
 
 // #############################################################################
 
+// Slot layout used before compressed slabs, kept for comparison
+type bigIntHashMapValue struct {
+	Q, S DHElement
+}
+
+func heapAndGC(b *testing.B, fill func() interface{}) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+
+	m := fill()
+	runtime.GC()
+
+	// Time a full collection with only the map live
+	start := time.Now()
+	runtime.GC()
+	gcTime := time.Since(start)
+	runtime.ReadMemStats(&after)
+	runtime.KeepAlive(m)
+
+	b.ReportMetric(float64(after.HeapAlloc-before.HeapAlloc)/1e6, "heap-MB")
+	b.ReportMetric(float64(gcTime.Microseconds())/1e3, "gc-ms")
+}
+
+func BenchmarkHashMapMemory(b *testing.B) {
+	var ctx DHContext
+	NewDHContext(&ctx)
+	const bits = 20
+	size := 1 << bits
+	points := ctx.RandomElements(64)
+
+	b.Run("DHElement", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			heapAndGC(b, func() interface{} {
+				m := make([]bigIntHashMapValue, size)
+				for i := range m {
+					P := points[i%len(points)]
+					m[i].Q = DHElement{new(big.Int).Set(P.x), new(big.Int).Set(P.y)}
+					m[i].S = DHElement{new(big.Int).Set(P.x), new(big.Int).Set(P.y)}
+				}
+				return m
+			})
+		}
+	})
+
+	b.Run("Compressed", func(b *testing.B) {
+		for n := 0; n < b.N; n++ {
+			heapAndGC(b, func() interface{} {
+				m := NewHashMap(bits)
+				for i := uint64(0); i < m.Size(); i++ {
+					P := points[i%uint64(len(points))].Compress()
+					m.Q.Set(i, P[:])
+					m.S.Set(i, P[:])
+				}
+				return &m
+			})
+		}
+	})
+}
+
+// #############################################################################
+
 func benchmarkInit(b *testing.B, intCard int, proto string, showP bool) (Delegate, []Party, []float64) {
 	runtime.GOMAXPROCS(128)
 	// debug.SetGCPercent(-1)
 	fmt.Println("GOMAXPROCS:", runtime.GOMAXPROCS(0))
 	// fmt.Println("GCPercent:", debug.SetGCPercent(-1))
 	fmt.Println("nModuli:", uint(*nModuli))
-	logger := log.New(os.Stdout, "go test: ", log.Flags())
-	defer Timer(time.Now(), logger, "benchmarkInit")
+	defer Timer(time.Now(), slog.Default(), "benchmarkInit")
 
 	var ctx EGContext
 	var delegate Delegate
@@ -228,14 +296,18 @@ func benchmarkInit(b *testing.B, intCard int, proto string, showP bool) (Delegat
 	fpaths := []string{"data/0.txt", "data/1.txt", "data/2.txt", "data/3.txt"}
 
 	mpsi := (proto == "MPSI")
-	data := NewSampleData(*nParties+1, *x0, *xi, intCard, 1000, "data", false, mpsi)
-	res := data.ComputeStats(mpsi)
+	data := NewSampleData(UniformSizes(*nParties, *x0, *xi), intCard, 1000, 1, "data", false, mpsi, 0)
+	t := 1
+	if mpsi {
+		t = *nParties
+	}
+	res := data.ComputeStats(t, false)
 
-	NewEGContext(&ctx, uint(*nModuli), uint(*maxBits))
-	delegate.Init(0, *nParties, *nBits, fpaths[0], *logFile, showP, &ctx)
+	NewEGContext(&ctx, uint(*nModuli), uint(*maxBits), 16)
+	delegate.Init(0, *nParties, *nBits, fpaths[0], *logFile, &ctx)
 	pks[0] = delegate.party.Partial_PubKey()
 	for i := 1; i <= *nParties; i++ {
-		parties[i-1].Init(i, *nParties, *nBits, fpaths[i], *logFile, showP, &ctx)
+		parties[i-1].Init(i, *nParties, *nBits, fpaths[i], *logFile, &ctx)
 		pks[i] = parties[i-1].Partial_PubKey()
 	}
 
@@ -282,9 +354,12 @@ func benchmarkU(b *testing.B, sum bool) {
 	cardComputed, ctSum := delegate.DelegateFinish(final, sum)
 	partials := make([][]DHElement, *nParties+1)
 	if sum {
-		partials[0] = delegate.party.Partial_Decrypt(ctSum)
+		var err error
+		partials[0], err = delegate.party.Partial_Decrypt(ctSum, delegate.transcript)
+		Panic(err)
 		for i := 1; i <= *nParties; i++ {
-			partials[i] = parties[i-1].Partial_Decrypt(ctSum)
+			partials[i], err = parties[i-1].Partial_Decrypt(ctSum, delegate.transcript)
+			Panic(err)
 		}
 		fmt.Println("Finished: Round 2.")
 	}
@@ -295,10 +370,10 @@ func benchmarkU(b *testing.B, sum bool) {
 		// Round 3
 		computedSum := delegate.JointDecryption(ctSum, partials)
 		fmt.Println("Finished: JointDecryption")
-		fmt.Println("Sum:", computedSum.Text(10))
+		fmt.Println("Sum:", computedSum[0].Text(10))
 	}
 
-	delegate.party.log.Println("---------------------------------")
+	delegate.party.log.Info("---------------------------------")
 }
 
 func BenchmarkMPSIUS(b *testing.B) {
@@ -351,9 +426,12 @@ func benchmarkI(b *testing.B, sum bool) {
 	cardComputed, ctSum := delegate.DelegateFinish(final, sum)
 	partials := make([][]DHElement, *nParties+1)
 	if sum {
-		partials[0] = delegate.party.Partial_Decrypt(ctSum)
+		var err error
+		partials[0], err = delegate.party.Partial_Decrypt(ctSum, delegate.transcript)
+		Panic(err)
 		for i := 1; i <= *nParties; i++ {
-			partials[i] = parties[i-1].Partial_Decrypt(ctSum)
+			partials[i], err = parties[i-1].Partial_Decrypt(ctSum, delegate.transcript)
+			Panic(err)
 		}
 		fmt.Println("Finished: Round 2.")
 	}
@@ -364,30 +442,972 @@ func benchmarkI(b *testing.B, sum bool) {
 		// Round 3
 		computedSum := delegate.JointDecryption(ctSum, partials)
 		fmt.Println("Finished: JointDecryption")
-		fmt.Println("Sum:", computedSum.Text(10))
+		fmt.Println("Sum:", computedSum[0].Text(10))
+	}
+
+	delegate.party.log.Info("---------------------------------")
+}
+
+func TestSampleDataSeed(t *testing.T) {
+	for _, mpsi := range []bool{true, false} {
+		dir := t.TempDir()
+		a := NewSampleData([]int{300, 400, 250, 500}, 50, 100, 1, dir, false, mpsi, 42)
+		aBytes, err := os.ReadFile(dir + "/1.txt")
+		Panic(err)
+
+		b := NewSampleData([]int{300, 400, 250, 500}, 50, 100, 1, dir, false, mpsi, 42)
+		bBytes, err := os.ReadFile(dir + "/1.txt")
+		Panic(err)
+
+		if !bytes.Equal(aBytes, bBytes) {
+			t.Fatalf("mpsi=%v: same seed produced different files", mpsi)
+		}
+		for i := range a.X_ADs {
+			if len(a.X_ADs[i]) != len(b.X_ADs[i]) {
+				t.Fatalf("mpsi=%v: party %d differs", mpsi, i)
+			}
+			for w, v := range a.X_ADs[i] {
+				if !EqualInts(b.X_ADs[i][w], v) {
+					t.Fatalf("mpsi=%v: party %d differs at %s", mpsi, i, w)
+				}
+			}
+		}
+
+		_ = NewSampleData([]int{300, 400, 250, 500}, 50, 100, 1, dir, false, mpsi, 43)
+		cBytes, err := os.ReadFile(dir + "/1.txt")
+		Panic(err)
+		if bytes.Equal(aBytes, cBytes) {
+			t.Fatalf("mpsi=%v: different seeds produced the same data", mpsi)
+		}
+	}
+}
+
+func TestWorkloadGenerator(t *testing.T) {
+	p := WorkloadParams{Sizes: []int{200, 500, 300, 400}, IntCard: 40, Lim: 1000, IDs: "email", Values: "zipf", ZipfS: 1.3, SpreadS: 1.5, Overlaps: []PairOverlap{{1, 2, 0.5}}}
+
+	for _, mpsi := range []bool{true, false} {
+		data := NewWorkloadData(&p, t.TempDir(), mpsi, 7)
+		for i, X := range data.X_ADs {
+			if len(X) != p.Sizes[i] {
+				t.Fatalf("mpsi=%v: |X_%d| = %d, want %d", mpsi, i, len(X), p.Sizes[i])
+			}
+			for w, v := range X {
+				if !strings.Contains(w, "@") || len(v) != 1 || v[0] < 0 || v[0] >= p.Lim {
+					t.Fatalf("mpsi=%v: bad entry %q => %v", mpsi, w, v)
+				}
+			}
+		}
+		shared := NewSet(data.X_ADs[1]).Intersection(NewSet(data.X_ADs[2])).Size()
+		if shared < 150 {
+			t.Fatalf("mpsi=%v: X_1 and X_2 share %d identifiers, want >= 150", mpsi, shared)
+		}
+		threshold := 1
+		if mpsi {
+			threshold = len(p.Sizes) - 1
+		}
+		if card := Cardinality(data.X_ADs, threshold, false)[0]; card != p.IntCard {
+			t.Fatalf("mpsi=%v: |I| = %d, want %d", mpsi, card, p.IntCard)
+		}
+	}
+
+	// For MPSIU, the intersection only has to fit in the union of the others
+	small := WorkloadParams{Sizes: []int{60, 20, 20, 15}, IntCard: 50, Lim: 100, SpreadS: 1.5}
+	data := NewWorkloadData(&small, t.TempDir(), false, 7)
+	if card := Cardinality(data.X_ADs, 1, false)[0]; card != small.IntCard || len(data.X_ADs[3]) != 15 {
+		t.Fatalf("|I| = %d and |X_3| = %d, want %d and 15", card, len(data.X_ADs[3]), small.IntCard)
+	}
+	for proto, ok := range map[int]bool{0: false, 2: true, 4: true} {
+		cfg := Config{proto: proto, nParties: 3, sizes: small.Sizes, intCard: small.IntCard}
+		if (cfg.CheckIntCard() == nil) != ok {
+			t.Fatalf("%s: CheckIntCard() = %v", protoNames[proto], cfg.CheckIntCard())
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for s, want := range map[string][]int{"7": {7}, "1:4": {1, 2, 3, 4}, "10:30:+10": {10, 20, 30}, "1024:8192:x2": {1024, 2048, 4096, 8192}} {
+		got, err := ParseRange(s)
+		if err != nil || fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("ParseRange(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"a", "4:1", "1:4:x1", "1:2:3:4"} {
+		if _, err := ParseRange(s); err == nil {
+			t.Fatalf("ParseRange(%q) should fail", s)
+		}
+	}
+}
+
+func TestCommunicationCounters(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{proto: 1, nParties: 3, sizes: []int{300, 400, 250, 500}, intCard: 50, lim: 100, nBits: 12, nModuli: 2, seed: 7, dataDir: dir + "/data", resDir: dir + "/results"}
+	res := RunTrial(cfg)
+
+	// Every byte sent is received by someone, in the same round
+	for r := range roundNames {
+		var sent, recv uint64
+		for _, c := range res.costs {
+			sent += c.Comm.sent[r]
+			recv += c.Comm.recv[r]
+		}
+		if sent == 0 || sent != recv {
+			t.Fatalf("%s: sent %d B, received %d B", roundNames[r], sent, recv)
+		}
+	}
+
+	// The file transport counts exactly what is on disk
+	M := NewHashMap(cfg.nBits)
+	fpath := dir + "/M"
+	n := WriteMessage(fpath, M.Write)
+	info, err := os.Stat(fpath)
+	Panic(err)
+	if n != uint64(info.Size()) || n != MessageSize(M.Write) {
+		t.Fatalf("WriteMessage counted %d B, file has %d B", n, info.Size())
+	}
+	if m := ReadMessage(fpath, slog.Default(), func(r io.Reader) { ReadHashMapValues(r) }); m != n {
+		t.Fatalf("ReadMessage counted %d B, want %d B", m, n)
+	}
+}
+
+func filledSlots(X map[string][]int, nBits int, sid []byte) uint64 {
+	slots := make(map[uint64]bool)
+	for w := range X {
+		slots[GetIndex(w, nBits, sid)] = true
+	}
+	return uint64(len(slots))
+}
+
+// The delegate and parties of a run of cfg in session sid (random if empty),
+// with the options of cfg applied as in RunTrial. The caller generates the
+// data.
+func initFixture(t *testing.T, cfg *Config, sid string) (Delegate, []Party) {
+	t.Helper()
+	s := Session{Suite: cfg.suite, DST: cfg.dst}
+	if sid != "" {
+		s.ID = []byte(sid)
+	}
+	delegate, parties, _ := RunInit(cfg.nParties, cfg.nBits, cfg.EGParams(), cfg.DataPaths(), path.Join(t.TempDir(), "log.txt"), s)
+	delegate.moments = cfg.moments
+	cfg.OpenReveal(&delegate)
+	cfg.OpenDP(&delegate.party)
+	for i := range parties {
+		parties[i].addValues = cfg.partyValues
+		cfg.OpenDP(&parties[i])
+	}
+	return delegate, parties
+}
+
+type fixture struct {
+	delegate Delegate
+	parties  []Party
+	card     int
+	sum      []big.Int
+	costs    []PartyCost
+}
+
+// Runs cfg.proto on the fixture of cfg
+func runFixture(t *testing.T, cfg *Config, sid string) fixture {
+	t.Helper()
+	delegate, parties := initFixture(t, cfg, sid)
+	card, sum, _, costs := RunProtocol(cfg.nParties, delegate, parties, cfg.proto, cfg.Threshold())
+	return fixture{delegate, parties, int(card), sum, costs}
+}
+
+// Expected operation counts from the cost analysis of each protocol, given
+// the number of slots m, moduli k and slots x_i filled by each party
+func TestOperationCounters(t *testing.T) {
+	dir := t.TempDir()
+	const n, k, nBits = 3, 2, 10
+	m := uint64(1) << nBits
+
+	for proto := 0; proto < 4; proto++ {
+		sum := (proto%2 == 1)
+		cfg := Config{proto: proto, nParties: n, sizes: []int{300, 400, 250, 500}, intCard: 50, lim: 100, nBits: nBits, nModuli: k, seed: 11, dataDir: fmt.Sprintf("%s/data%d", dir, proto)}
+		GenerateData(&cfg)
+		f := runFixture(t, &cfg, "")
+		delegate, parties, costs := f.delegate, f.parties, f.costs
+		c := uint64(f.card)
+
+		want := make([]PhaseOps, n+1)
+		x0 := filledSlots(delegate.party.X, nBits, delegate.party.sid)
+		want[0][PhaseInit] = OpCounts{BaseMult: 2, Add: n}
+		if sum {
+			want[0][PhaseRound1] = OpCounts{HashToCurve: x0, ScalarMult: x0 + k*m, BaseMult: 2*k*x0 + (m-x0)*(1+k), Add: k * x0}
+			want[0][PhaseRound2] = OpCounts{ScalarMult: m, AEAD: m, Add: 2 * k * (c - 1)}
+			// Each BSGS search adds one point fewer than the steps it takes
+			steps := costs[0].Ops[PhaseRound3].BSGSSteps
+			want[0][PhaseRound3] = OpCounts{ScalarMult: k, BaseMult: k, Add: k*(n+1) + steps - k, BSGSSteps: steps}
+		} else {
+			want[0][PhaseRound1] = OpCounts{HashToCurve: x0, ScalarMult: x0, AEAD: x0, BaseMult: m - x0}
+			want[0][PhaseRound2] = OpCounts{ScalarMult: m, AEAD: m}
+		}
+
+		for i := 1; i <= n; i++ {
+			xi := filledSlots(parties[i-1].X, nBits, parties[i-1].sid)
+			w := &want[i]
+			w[PhaseInit] = OpCounts{BaseMult: 1, Add: n}
+			w[PhaseRound1] = OpCounts{HashToCurve: xi, ScalarMult: 4 * xi, Add: 2 * xi}
+			if proto <= 1 {
+				w[PhaseRound1].BaseMult = 2 * (m - xi)
+				if i > 1 {
+					w[PhaseRound1].Add += 2 * xi
+				}
+			} else if i == 1 {
+				w[PhaseRound1].BaseMult = 2 * (m - xi)
+			} else {
+				w[PhaseRound1].ScalarMult += 4 * (m - xi)
+				w[PhaseRound1].Add += 2 * (m - xi)
+			}
+			if i == n {
+				w[PhaseRound1].AEAD = m
+				if sum {
+					w[PhaseRound1].BaseMult += k * m
+					w[PhaseRound1].ScalarMult += k * m
+					w[PhaseRound1].Add += 2 * k * m
+				}
+			}
+			if sum {
+				w[PhaseRound3] = OpCounts{ScalarMult: k}
+			}
+		}
+
+		for i := range want {
+			if want[i] != costs[i].Ops {
+				t.Fatalf("%s, party %d: counted %+v, want %+v", protoNames[proto], i, costs[i].Ops, want[i])
+			}
+		}
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	dir := t.TempDir()
+	const n, nBits = 3, 10
+	cfg := Config{proto: 0, nParties: n, sizes: []int{300, 400, 250, 500}, intCard: 50, lim: 100, nBits: nBits, nModuli: 2, seed: 3, dataDir: dir}
+	GenerateData(&cfg)
+	delegate, parties := initFixture(t, &cfg, "")
+	m := StartMetrics("127.0.0.1:0", &parties[0])
+	defer m.Stop()
+	RunProtocol(n, delegate, parties, cfg.proto, cfg.Threshold())
+
+	resp, err := http.Get("http://" + m.Addr + "/metrics")
+	Panic(err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	Panic(err)
+	text := string(body)
+
+	if resp.Header.Get("Content-Type") != openMetricsType || !strings.HasSuffix(text, "# EOF\n") {
+		t.Fatalf("not an OpenMetrics exposition: %q", resp.Header.Get("Content-Type"))
+	}
+	// P_1 reduces or randomizes every slot of R in Round 1
+	for _, line := range []string{
+		fmt.Sprintf("mps_slots_processed_total{party=\"1\",phase=\"Round 1\"} %d", 1<<nBits),
+		fmt.Sprintf("mps_bytes_sent_total{party=\"1\",round=\"Round 1\"} %d", parties[0].comm.sent[Round1]),
+		fmt.Sprintf("mps_bytes_received_total{party=\"1\",round=\"Round 1\"} %d", parties[0].comm.recv[Round1]),
+		"mps_pool_queue_depth{party=\"1\"} 0",
+		"mps_phase{party=\"1\",mps_phase=\"Round 1\"} 1",
+	} {
+		if !strings.Contains(text, line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, text)
+		}
+	}
+}
+
+func TestStructuredLogging(t *testing.T) {
+	dir := t.TempDir()
+	cfg := Config{proto: 0, nParties: 2, sizes: []int{30, 40, 50}, intCard: 5, lim: 10, nBits: 10, nModuli: 1, seed: 5, dataDir: dir}
+	GenerateData(&cfg)
+	defer SetLogContext("", "")
+	defer ConfigureLogging("color", "info")
+
+	var ctx EGContext
+	NewEGContext(&ctx, 1, 10, 10)
+	lPath := dir + "/log.json"
+	for _, level := range []string{"info", "warn"} {
+		Panic(ConfigureLogging("json", level))
+		SetLogContext("MPSI", "s-"+level)
+		var p Party
+		p.Init(2, cfg.nParties, cfg.nBits, cfg.DataPaths()[2], lPath, &ctx)
+		p.Phase(PhaseRound1)
+		p.log.Warn("warning")
+	}
+
+	file, err := os.ReadFile(lPath)
+	Panic(err)
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(string(file)), "\n") {
+		var r map[string]interface{}
+		Panic(json.Unmarshal([]byte(line), &r))
+		records = append(records, r)
+	}
+
+	// Init took ... and one warning at info, only the warning at warn
+	if len(records) != 3 {
+		t.Fatalf("got %d records, want 3", len(records))
+	}
+	want := []map[string]interface{}{
+		{"msg": records[0]["msg"], "level": "INFO", "party": 2.0, "protocol": "MPSI", "session": "s-info", "phase": "Init"},
+		{"msg": "warning", "level": "WARN", "party": 2.0, "protocol": "MPSI", "session": "s-info", "phase": "Round 1"},
+		{"msg": "warning", "level": "WARN", "party": 2.0, "protocol": "MPSI", "session": "s-warn", "phase": "Round 1"},
+	}
+	for i, w := range want {
+		for k, v := range w {
+			if records[i][k] != v {
+				t.Fatalf("record %d: %s = %v, want %v", i, k, records[i][k], v)
+			}
+		}
+	}
+}
+
+func TestTracingSpans(t *testing.T) {
+	dir := t.TempDir()
+	const n = 2
+	cfg := Config{proto: 1, nParties: n, sizes: []int{300, 400, 250}, intCard: 50, lim: 100, nBits: 10, nModuli: 2, seed: 9, dataDir: dir + "/data", resDir: dir + "/results", traceFile: "trace.json"}
+	RunTrial(cfg)
+
+	file, err := os.ReadFile(cfg.TracePath())
+	Panic(err)
+	var export struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+					Attributes   []struct {
+						Key   string
+						Value map[string]interface{}
+					}
+				}
+			}
+		}
+	}
+	Panic(json.Unmarshal(file, &export))
+	if len(export.ResourceSpans) != n+1 {
+		t.Fatalf("got %d resources, want %d", len(export.ResourceSpans), n+1)
+	}
+
+	// Spans by "party/name", all in the trace started by DelegateStart
+	spans := make(map[string][2]string)
+	traceID := ""
+	for _, rs := range export.ResourceSpans {
+		for _, s := range rs.ScopeSpans[0].Spans {
+			party := ""
+			for _, a := range s.Attributes {
+				if a.Key == "party.id" {
+					party = a.Value["intValue"].(string)
+				}
+			}
+			if traceID == "" {
+				traceID = s.TraceID
+			}
+			if s.TraceID != traceID {
+				t.Fatalf("%s of party %s is in trace %s, want %s", s.Name, party, s.TraceID, traceID)
+			}
+			spans[party+"/"+s.Name] = [2]string{s.SpanID, s.ParentSpanID}
+		}
+	}
+
+	// Each span follows the span whose output it consumes
+	for child, parent := range map[string]string{
+		"0/DelegateStart":   "",
+		"1/MPSI-Sum":        "0/DelegateStart",
+		"2/MPSI-Sum":        "1/MPSI-Sum",
+		"2/BlindEncrypt":    "2/MPSI-Sum",
+		"2/Shuffle":         "2/BlindEncrypt",
+		"0/DelegateFinish":  "2/MPSI-Sum",
+		"0/Partial_Decrypt": "0/DelegateFinish",
+		"1/Partial_Decrypt": "0/DelegateFinish",
+		"2/Partial_Decrypt": "0/DelegateFinish",
+		"0/JointDecryption": "2/Partial_Decrypt",
+	} {
+		s, ok := spans[child]
+		if !ok {
+			t.Fatalf("missing span %s", child)
+		}
+		if s[1] != spans[parent][0] {
+			t.Fatalf("parent of %s is %q, want %s", child, s[1], parent)
+		}
+	}
+
+	// Networked runs pass the context next to each message
+	var sender, receiver Party
+	sender.tracer = NewTracer(1, "MPSI", "")
+	sender.EndSpan(sender.StartSpan("MPSI"))
+	fpath := dir + "/R1"
+	n1 := sender.SendMessage(fpath, func(w io.Writer) { writeUint64(w, 1) })
+	n2 := receiver.ReceiveMessage(fpath, func(r io.Reader) { readUint64(r) })
+	if n1 != 8 || n2 != 8 || receiver.parent != sender.last {
+		t.Fatalf("received %d B with context %+v, sent %d B with %+v", n2, receiver.parent, n1, sender.last)
+	}
+}
+
+func TestPoolProgress(t *testing.T) {
+	const nJobs = 200
+	pool := NewWorkerPool(nJobs)
+	for i := uint64(0); i < nJobs; i++ {
+		pool.InChan <- WorkerInput{id: i, data: RandomizeInput{}}
+	}
+
+	var reports [][2]uint64
+	var last time.Duration
+	pool.OnProgress(time.Millisecond, func(done, total uint64, eta time.Duration) {
+		reports = append(reports, [2]uint64{done, total})
+		last = eta
+	})
+	pool.Run(func(WorkerCtx, interface{}) interface{} {
+		time.Sleep(100 * time.Microsecond)
+		return nil
+	}, nil)
+
+	// Reports never go back and the last one is complete
+	for i, r := range reports {
+		if r[1] != nJobs || (i > 0 && r[0] < reports[i-1][0]) {
+			t.Fatalf("report %d: %d/%d after %v", i, r[0], r[1], reports[:i])
+		}
+	}
+	if n := len(reports); n == 0 || reports[n-1][0] != nJobs || last != 0 {
+		t.Fatalf("last report %v, ETA %s", reports, last)
+	}
+	if eta := ETA(time.Second, 25, 100); eta != 3*time.Second {
+		t.Fatalf("ETA after 1s for 25/100 jobs = %s, want 3s", eta)
+	}
+}
+
+func TestCheckpointResume(t *testing.T) {
+	dir := t.TempDir()
+	const n, nBits = 2, 10
+	cfg := Config{proto: 0, nParties: n, sizes: []int{300, 400, 250}, intCard: 50, lim: 100, nBits: nBits, nModuli: 1, seed: 13, dataDir: dir + "/data", checkpointDir: dir + "/ckpt", session: "s1"}
+	GenerateData(&cfg)
+	delegate, parties := initFixture(t, &cfg, "")
+	var M HashMapValues
+	delegate.DelegateStart(&M, false)
+
+	// The first attempt of P_1 reduces its slots, the second resumes them
+	first, second := parties[0], parties[0]
+	var R1, R2 HashMapValues
+	cfg.OpenCheckpoint(&first)
+	first.MPSI(delegate.L, &M, &R1, false)
+	second.ops = new(PhaseOps)
+	cfg.OpenCheckpoint(&second)
+	second.MPSI(delegate.L, &M, &R2, false)
+
+	if ops := second.ops[PhaseRound1]; ops.HashToCurve != 0 || second.modified != first.modified {
+		t.Fatalf("resumed attempt hashed %d identifiers and modified %d slots, want 0 and %d", ops.HashToCurve, second.modified, first.modified)
+	}
+	for w := range first.X {
+		idx := GetIndex(w, nBits, first.sid)
+		if !bytes.Equal(R1.Q.At(idx), R2.Q.At(idx)) || !bytes.Equal(R1.S.At(idx), R2.S.At(idx)) {
+			t.Fatalf("slot %d differs after resuming", idx)
+		}
+	}
+
+	// Checkpoints of other runs are never resumed
+	for name, change := range map[string]func(*Config){
+		"b":            func(c *Config) { c.nBits++ },
+		"columns":      func(c *Config) { c.cols = 2 },
+		"moments":      func(c *Config) { c.moments = true },
+		"party_values": func(c *Config) { c.partyValues = true },
+		"dp":           func(c *Config) { c.dp, c.epsilon, c.delta = "laplace", 1, 1e-6 },
+		"suite":        func(c *Config) { c.suite = "P256_XMD:SHA-256_SSWU_NU_" },
+		"dst":          func(c *Config) { c.dst = "OTHER-DEPLOYMENT-DST" },
+	} {
+		other := cfg
+		change(&other)
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("resumed a checkpoint written with another %s", name)
+				}
+			}()
+			other.OpenCheckpoint(&first)
+		}()
+	}
+
+	first.ckpt.Remove()
+	if cfg.HasCheckpoint(1) {
+		t.Fatalf("checkpoint of P_1 left after Remove")
+	}
+}
+
+func TestTranscriptBinding(t *testing.T) {
+	dir := t.TempDir()
+	const n, nBits = 2, 10
+	cfg := Config{proto: 1, nParties: n, sizes: []int{300, 400, 250}, intCard: 50, lim: 100, nBits: nBits, nModuli: 1, seed: 17, dataDir: dir + "/data"}
+	GenerateData(&cfg)
+	delegate, parties := initFixture(t, &cfg, "s1")
+
+	var M, R HashMapValues
+	var final *HashMapFinal
+	delegate.DelegateStart(&M, true)
+	for i := range parties {
+		final = parties[i].MPSI(delegate.L, &M, &R, true)
+	}
+	_, ct := delegate.DelegateFinish(final, true)
+
+	for i := range parties {
+		if _, err := parties[i].Partial_Decrypt(ct, delegate.transcript); err != nil {
+			t.Fatalf("P_%d refused the transcript of its own run: %v", i+1, err)
+		}
+	}
+
+	// P_2 received R_1, so it refuses a transcript with another R_1
+	tampered := append(Transcript{}, delegate.transcript...)
+	tampered[1] = BLAKE2B([]byte("R1"), "")
+	if _, err := parties[1].Partial_Decrypt(ct, tampered); err == nil {
+		t.Fatalf("P_2 accepted a transcript with an altered R_1")
+	}
+	if _, err := parties[0].Partial_Decrypt(ct, delegate.transcript[:n]); err == nil {
+		t.Fatalf("P_1 accepted a truncated transcript")
+	}
+
+	// A ciphertext of another run does not complete the transcript
+	other := []EGCiphertext{ct[0]}
+	other[0].c1 = append([]DHElement{}, ct[0].c1...)
+	other[0].c1[0] = delegate.L
+	if _, err := parties[0].Partial_Decrypt(other, delegate.transcript); err == nil {
+		t.Fatalf("P_1 accepted a ciphertext outside the transcript")
+	}
+
+	// Hashing and key derivation depend on the session
+	msg := []byte("0123456789")
+	if bytes.Equal(AES_KDF(msg, []byte("s1")), AES_KDF(msg, []byte("s2"))) {
+		t.Fatalf("AES_KDF is the same in two sessions")
+	}
+	same := 0
+	for w := range parties[0].X {
+		if GetIndex(w, nBits, []byte("s1")) == GetIndex(w, nBits, []byte("s2")) {
+			same++
+		}
+	}
+	if same == len(parties[0].X) {
+		t.Fatalf("GetIndex is the same in two sessions")
+	}
+}
+
+// OT-MPSI counts the delegate's elements held by at least t of the n parties,
+// which is MPSIU for t = 1 and MPSI for t = n
+func TestOTMPSI(t *testing.T) {
+	dir := t.TempDir()
+	const n, nBits = 3, 11
+	cfg := Config{proto: 4, nParties: n, sizes: []int{30, 40, 35, 45}, intCard: 20, lim: 100, nBits: nBits, nModuli: 1, seed: 23, dataDir: dir}
+	data := GenerateData(&cfg)
+
+	for threshold := 1; threshold <= n; threshold++ {
+		want := Cardinality(data.X_ADs, threshold, false)
+		for _, proto := range []int{4, 5} {
+			cfg.proto, cfg.threshold = proto, threshold
+			f := runFixture(t, &cfg, "ot")
+			if f.card != want[0] {
+				t.Fatalf("%s, t = %d: count %d, want %d", protoNames[proto], threshold, f.card, want[0])
+			}
+			if proto == 5 && int(f.sum[0].Int64()) != want[1] {
+				t.Fatalf("%s, t = %d: sum %d, want %d", protoNames[proto], threshold, f.sum[0].Int64(), want[1])
+			}
+		}
+	}
+
+	if Cardinality(data.X_ADs, 1, false)[0] != cfg.intCard || Cardinality(data.X_ADs, n, false)[0] >= cfg.intCard {
+		t.Fatalf("generated sets do not exercise the threshold")
+	}
+	if got := len(Subsets(5, 2)); got != 10 {
+		t.Fatalf("%d 2-subsets of 5 parties, want 10", got)
+	}
+}
+
+// Each column is summed separately in one run, and adding columns leaves the
+// first one of a seed unchanged
+func TestSumColumns(t *testing.T) {
+	dir := t.TempDir()
+	const n, nBits, cols = 2, 12, 3
+	one := NewSampleData([]int{40, 50, 45}, 20, 100, 1, dir, false, false, 31)
+	for _, proto := range []int{1, 3} {
+		cfg := Config{proto: proto, nParties: n, sizes: []int{40, 50, 45}, intCard: 20, lim: 100, cols: cols, nBits: nBits, nModuli: 1, seed: 31, dataDir: dir}
+		data := GenerateData(&cfg)
+		for i := range data.X_ADs {
+			for w, v := range data.X_ADs[i] {
+				if len(v) != cols || (proto == 3 && v[0] != one.X_ADs[i][w][0]) {
+					t.Fatalf("%s: X_%d[%s] = %v", protoNames[proto], i, w, v)
+				}
+			}
+		}
+
+		f := runFixture(t, &cfg, "columns")
+		want := Cardinality(data.X_ADs, cfg.Threshold(), false)
+		if f.card != want[0] || len(f.sum) != cols {
+			t.Fatalf("%s: count %d and %d sums, want %d and %d", protoNames[proto], f.card, len(f.sum), want[0], cols)
+		}
+		for j := range f.sum {
+			if int(f.sum[j].Int64()) != want[j+1] {
+				t.Fatalf("%s: sum of column %d is %d, want %d", protoNames[proto], j+1, f.sum[j].Int64(), want[j+1])
+			}
+		}
+	}
+}
+
+// With moments, the -Sum protocols also return the sum of squares of each
+// column, from which the mean and variance follow
+func TestMoments(t *testing.T) {
+	dir := t.TempDir()
+	const n, nBits, cols = 2, 12, 2
+	for _, proto := range []int{1, 3} {
+		cfg := Config{proto: proto, nParties: n, sizes: []int{40, 50, 45}, intCard: 20, lim: 100, cols: cols, moments: true, nBits: nBits, seed: 37, dataDir: dir}
+		data := GenerateData(&cfg)
+		f := runFixture(t, &cfg, "moments")
+		want := Cardinality(data.X_ADs, cfg.Threshold(), false)
+		if f.card != want[0] || len(f.sum) != 2*cols {
+			t.Fatalf("%s: count %d and %d sums, want %d and %d", protoNames[proto], f.card, len(f.sum), want[0], 2*cols)
+		}
+		for j := range f.sum {
+			if int(f.sum[j].Int64()) != want[j+1] {
+				t.Fatalf("%s: sum %d is %d, want %d", protoNames[proto], j+1, f.sum[j].Int64(), want[j+1])
+			}
+		}
+	}
+	if v := Variance(4, 2+4+4+6, 4+16+16+36); v != 2 {
+		t.Fatalf("variance of 2, 4, 4, 6 is %f, want 2", v)
+	}
+}
+
+// With party values, each party adds its own values for the elements it
+// holds, here drawn apart from those of the delegate
+func TestPartyValues(t *testing.T) {
+	dir := t.TempDir()
+	const n, nBits, cols = 2, 12, 2
+	for _, proto := range []int{1, 3} {
+		cfg := Config{proto: proto, nParties: n, sizes: []int{40, 50, 45}, intCard: 20, lim: 100, cols: cols, partyValues: true, nBits: nBits, seed: 41, dataDir: dir}
+		data := GenerateData(&cfg)
+		for i := 1; i <= n; i++ {
+			for w, v := range data.X_ADs[i] {
+				u := make([]int, cols)
+				for j := range u {
+					u[j] = v[j] + 1000*i + j
+				}
+				data.X_ADs[i][w] = u
+			}
+			WriteFile(cfg.DataPaths()[i], data.X_ADs[i])
+		}
+		cfg.lim += 1000 * n
+
+		f := runFixture(t, &cfg, "sums")
+		want := Cardinality(data.X_ADs, cfg.Threshold(), true)
+		if f.card != want[0] || len(f.sum) != cols || want[1] == Cardinality(data.X_ADs, cfg.Threshold(), false)[1] {
+			t.Fatalf("%s: count %d and %d sums, want %d and %d", protoNames[proto], f.card, len(f.sum), want[0], cols)
+		}
+		for j := range f.sum {
+			if int(f.sum[j].Int64()) != want[j+1] {
+				t.Fatalf("%s: sum of column %d is %d, want %d", protoNames[proto], j+1, f.sum[j].Int64(), want[j+1])
+			}
+		}
+	}
+}
+
+// With reveal, the delegate writes the identifiers counted in each run and
+// its values, and otherwise learns nothing more than the count
+func TestReveal(t *testing.T) {
+	dir := t.TempDir()
+	const n, nBits = 3, 11
+	cfg := Config{nParties: n, sizes: []int{30, 40, 35, 45}, intCard: 20, lim: 100, nBits: nBits, nModuli: 1, threshold: 2, seed: 23, dataDir: dir, resDir: dir, reveal: true}
+	data := GenerateData(&cfg)
+
+	for _, proto := range []int{0, 2, 4} {
+		cfg.proto = proto
+		f := runFixture(t, &cfg, "ot")
+		cfg.WriteIntersection(&f.delegate)
+
+		got := ReadFile(dir + "/intersection.txt")
+		if f.card != Cardinality(data.X_ADs, cfg.Threshold(), false)[0] || len(got) != f.card {
+			t.Fatalf("%s: %d identifiers revealed for a count of %d", protoNames[proto], len(got), f.card)
+		}
+		for w, v := range got {
+			holders := 0
+			for _, X := range data.X_ADs[1:] {
+				if _, ok := X[w]; ok {
+					holders++
+				}
+			}
+			if holders < cfg.Threshold() || fmt.Sprint(v) != fmt.Sprint(data.X_ADs[0][w]) {
+				t.Fatalf("%s: revealed %q with values %v, held by %d parties", protoNames[proto], w, v, holders)
+			}
+		}
+	}
+
+	cfg.proto, cfg.reveal = 0, false
+	if f := runFixture(t, &cfg, "ot"); f.delegate.intersection != nil {
+		t.Fatalf("identifiers revealed without reveal")
+	}
+}
+
+// With dp, the count and sums are noised and each party charges its runs to
+// its own ledger
+func TestDifferentialPrivacy(t *testing.T) {
+	dir := t.TempDir()
+	const n, nBits = 2, 12
+
+	// A large epsilon leaves the dummies of every party and noise of at most a
+	// few units on the sum
+	cfg := Config{proto: 1, nParties: n, sizes: []int{40, 50, 45}, intCard: 20, lim: 100, cols: 1, nBits: nBits, seed: 43, dataDir: dir, resDir: dir, dp: "laplace", epsilon: 1000, delta: 1e-6, epsilonBudget: 1500, deltaBudget: 1, threshold: 1}
+	data := GenerateData(&cfg)
+	for _, proto := range []int{0, 1, 2, 4} {
+		cfg.proto = proto
+		f := runFixture(t, &cfg, "sums")
+		want := Cardinality(data.X_ADs, cfg.Threshold(), false)
+		if f.delegate.party.dp.shift < 1 || f.card != want[0] || (proto%2 == 1 && abs(float64(f.sum[0].Int64()-int64(want[1]))) > 10) {
+			t.Fatalf("%s: noisy count %d and sum %v, want %d and %d", protoNames[proto], f.card, f.sum, want[0], want[1])
+		}
+	}
+
+	// The Gaussian mechanism needs epsilon below 1 for the count and each sum
+	for _, c := range []struct {
+		proto int
+		eps   float64
+		ok    bool
+	}{{0, 0.99, true}, {0, 1, false}, {1, 1.9, true}, {1, 2, false}} {
+		g := Config{proto: c.proto, cols: 1, lim: 100, dp: "gaussian", epsilon: c.eps}
+		if (g.CheckDP() == nil) != c.ok {
+			t.Fatalf("%s with epsilon %g: CheckDP() = %v", protoNames[c.proto], c.eps, g.CheckDP())
+		}
+	}
+
+	// With many parties, the Gaussian shares grow until their sum is within
+	// a part of delta of one discrete Gaussian
+	for _, shares := range []int{3, 1000} {
+		dp := NewDPNoise("gaussian", 0.9, 1e-6, nil, shares)
+		share := dp.count / math.Sqrt(float64(shares))
+		if dist := (1 + math.Exp(0.9)) * math.Expm1(gaussianTau(share, shares)); share < 0.5 || dist > 1e-6/4 {
+			t.Fatalf("%d shares of sigma %f, %g from a discrete Gaussian", shares, share, dist)
+		}
+	}
+
+	// The shares of the n parties add up to the noise of the mechanism
+	for _, mech := range []string{"laplace", "gaussian"} {
+		dp := NewDPNoise(mech, 1, 1e-6, []float64{50}, 3)
+		scale := dp.sums[0]
+		wantVar := scale * scale
+		if mech == "laplace" {
+			alpha := math.Exp(-1 / scale)
+			wantVar = 2 * alpha / ((1 - alpha) * (1 - alpha))
+		}
+		var mean, variance, dummies float64
+		const draws = 5000
+		for i := 0; i < draws; i++ {
+			x := 0.0
+			for k := 0; k < 3; k++ {
+				x += float64(dp.SumShares()[0])
+			}
+			mean, variance = mean+x/draws, variance+x*x/draws
+			dummies += float64(dp.CountDummies()) / draws
+		}
+		variance -= mean * mean
+		if abs(variance/wantVar-1) > 0.15 || abs(mean) > 4*math.Sqrt(wantVar/draws) || abs(dummies-float64(dp.shift)) > 0.5+float64(dp.shift)/10 {
+			t.Fatalf("%s: noise of mean %f and variance %f, want 0 and %f, and %f dummies, want %d", mech, mean, variance, wantVar, dummies, dp.shift)
+		}
+	}
+
+	// Every party draws a share of the count noise, so any n - 1 of them keep
+	// most of its variance
+	for _, mech := range []string{"laplace", "gaussian"} {
+		const k, draws = 3, 5000
+		dps := make([]*DPNoise, k)
+		for i := range dps {
+			dps[i] = NewDPNoise(mech, 0.9, 1e-6, nil, k)
+		}
+		// Moments of the number of matching dummies of all parties (index k)
+		// and of all parties but i
+		var mean, sq [k + 1]float64
+		for d := 0; d < draws; d++ {
+			x := make([]float64, k)
+			all := 0.0
+			for i := range x {
+				x[i] = float64(dps[i].CountDummies())
+				all += x[i]
+			}
+			for i := 0; i <= k; i++ {
+				y := all
+				if i < k {
+					y -= x[i]
+				}
+				mean[i], sq[i] = mean[i]+y/draws, sq[i]+y*y/draws
+			}
+		}
+		variance := sq[k] - mean[k]*mean[k]
+		if abs(mean[k]-float64(dps[0].Shift())) > 4*math.Sqrt(variance/draws) {
+			t.Fatalf("%s: %f matching dummies on average, want %d", mech, mean[k], dps[0].Shift())
+		}
+		for i := 0; i < k; i++ {
+			if v := sq[i] - mean[i]*mean[i]; abs(v/variance-float64(k-1)/k) > 0.15 {
+				t.Fatalf("%s: count noise without party %d has variance %f, want %f", mech, i+1, v, variance*(k-1)/k)
+			}
+		}
+	}
+
+	// The run above was not charged; two more exceed the budget
+	for id := 0; id <= n; id++ {
+		if err := cfg.ChargeBudget(id, "s1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.ChargeBudget(id, "s2"); err == nil {
+			t.Fatalf("party %d spent past its budget", id)
+		}
+		if eps, del, err := cfg.Spent(id); err != nil || eps != 1000 || del != 1e-6 {
+			t.Fatalf("party %d spent (%g, %g), %v, want (1000, 1e-06)", id, eps, del, err)
+		}
+	}
+
+	// A truncated ledger is an error naming its line, not a panic
+	f, err := os.OpenFile(cfg.LedgerPath(1), os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(f, "s3\tlaplace\t1")
+	f.Close()
+	if err := cfg.ChargeBudget(1, "s4"); err == nil || !strings.Contains(err.Error(), cfg.LedgerPath(1)+":2:") {
+		t.Fatalf("truncated ledger: %v", err)
+	}
+}
+
+// Sums past 2^63 survive the result file
+func TestResultFile(t *testing.T) {
+	fpath := t.TempDir() + "/result.txt"
+	big70 := new(big.Int).Lsh(big.NewInt(3), 70)
+	neg := new(big.Int).Neg(big70)
+	WriteResult(fpath, map[string][]*big.Int{"count": {big.NewInt(7)}, "sum": {big70, neg}})
+	got := ReadResult(fpath)
+	if len(got) != 2 || got["count"][0].Int64() != 7 || got["sum"][0].Cmp(big70) != 0 || got["sum"][1].Cmp(neg) != 0 {
+		t.Fatalf("read back %v", got)
+	}
+}
+
+// The moduli and BSGS table fit the largest sum: 2^10 squares below 2^24
+// exceed 2^33 but still decrypt
+func TestEGSizing(t *testing.T) {
+	cfg := Config{sizes: []int{32768}, lim: 1024}
+	if k := cfg.EGParams().nModuli; k != 2 {
+		t.Fatalf("%d moduli for the default workload, want 2", k)
+	}
+	cfg.moments = true
+	if k := cfg.EGParams().nModuli; k != 3 {
+		t.Fatalf("%d moduli with moments, want 3", k)
+	}
+
+	var ctx EGContext
+	var pk DHElement
+	var ct, sum EGCiphertext
+	var m, got big.Int
+	cfg = Config{sizes: []int{1000}, lim: 4096, moments: true}
+	eg := cfg.EGParams()
+	NewEGContext(&ctx, eg.nModuli, eg.maxBits, eg.countBits)
+	sk := ctx.ecc.RandomScalar()
+	ctx.EG_PubKey(sk, &pk)
+	m.SetInt64(4095 * 4095)
+	ctx.EG_Encrypt(&pk, &m, &ct)
+	ctx.EG_EncryptZero(&pk, &sum)
+	for i := 0; i < 1000; i++ {
+		ctx.EG_AddInplace(&sum, &ct)
+	}
+	ctx.EG_Decrypt(sk, &got, &sum)
+	if m.Mul(&m, big.NewInt(1000)); got.Cmp(&m) != 0 {
+		t.Fatalf("sum decrypted to %s, want %s", got.Text(10), m.Text(10))
+	}
+}
+
+func TestH2CCache(t *testing.T) {
+	dir := t.TempDir()
+	const n, nBits = 2, 14
+	cfg := Config{proto: 0, nParties: n, sizes: []int{300, 400, 250}, intCard: 50, lim: 100, nBits: nBits, nModuli: 1, seed: 19, dataDir: dir + "/data", h2cCacheDir: dir + "/cache"}
+	GenerateData(&cfg)
+	s := Session{ID: []byte("s1")}
+	delegate, parties := initFixture(t, &cfg, string(s.ID))
+	var M HashMapValues
+	delegate.DelegateStart(&M, false)
+
+	// The first run hashes the set of P_1, the second, in the next session
+	// and with fresh keys, reads the cache
+	first, second := parties[0], parties[0]
+	var R1, R2 HashMapValues
+	first.ops = new(PhaseOps)
+	cfg.OpenH2CCache(&first)
+	first.MPSI(delegate.L, &M, &R1, false)
+	first.h2c.cache.Save()
+
+	next := Session{ID: []byte("s2")}
+	delegate.party.SetSession(next)
+	delegate.DelegateStart(&M, false)
+	second.SetSession(next)
+	second.partial_sk = second.ctx.ecc.RandomScalar()
+	second.ops = new(PhaseOps)
+	cache := cfg.OpenH2CCache(&second)
+	second.MPSI(delegate.L, &M, &R2, false)
+	// Slots collide differently in each session, so a few identifiers may be
+	// new
+	hashed := first.ops[PhaseRound1].HashToCurve
+	if ops := second.ops[PhaseRound1]; ops.HashToCurve != cache.misses || cache.hits < hashed*9/10 {
+		t.Fatalf("second run hashed %d identifiers and hit %d times, want at most a tenth of %d hashed", ops.HashToCurve, cache.hits, hashed)
+	}
+	var P, Q DHElement
+	for w := range second.X {
+		if !cache.Get(w, &Q) {
+			continue
+		}
+		second.h2c.ToCurve(w, &P)
+		if P.x.Cmp(Q.x) != 0 || P.y.Cmp(Q.y) != 0 {
+			t.Fatalf("cached point of %s differs", w)
+		}
+		b, err := os.ReadFile(cache.path)
+		Panic(err)
+		if bytes.Contains(b, []byte(w)) {
+			t.Fatalf("cache holds %s in the clear", w)
+		}
+		break
 	}
 
-	delegate.party.log.Println("---------------------------------")
+	// The cached points still match in the new session, but for the few
+	// elements lost to colliding slots
+	var final *HashMapFinal
+	R := R2
+	for i := 1; i < n; i++ {
+		parties[i].SetSession(next)
+		final = parties[i].MPSI(delegate.L, &M, &R, false)
+	}
+	if count, _ := delegate.DelegateFinish(final, false); count > cfg.intCard || count < cfg.intCard*9/10 {
+		t.Fatalf("count = %d with cached points, want about %d", count, cfg.intCard)
+	}
+
+	// Another DST or another secret invalidates the cache
+	other := parties[0]
+	other.SetSession(Session{ID: s.ID, DST: "MPS-OPERATIONS-TEST-V02-with-" + h2cSuite})
+	if c := cfg.OpenH2CCache(&other); len(c.points) != 0 {
+		t.Fatalf("loaded %d points hashed with another DST", len(c.points))
+	}
+	other.SetSession(s)
+	Panic(os.Remove(path.Join(cfg.h2cCacheDir, "secret")))
+	if c := cfg.OpenH2CCache(&other); len(c.points) != 0 {
+		t.Fatalf("loaded %d points encrypted under another secret", len(c.points))
+	}
 }
 
+// Messages of the test vectors of RFC 9380
+var h2cMsgs = []string{"", "abc", "abcdef0123456789", "q128_qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqq", "a512_aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+
 func HToC_Tester(t *testing.T, suite string, testRes [][]string, curve elliptic.Curve) {
 	var P DHElement
-	params, err := NewHtoCParams(suite)
+	params, err := NewHtoCParams(suite, "QUUX-V01-CS02-with-"+suite)
 	Panic(err)
 
 	fmt.Println("Testing:", suite)
-	msgs := []string{"", "abc", "abcdef0123456789", "q128_qqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqqq", "a512_aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"}
+	msgs := h2cMsgs
 
 	for i, p := range testRes {
 		fmt.Println("msg:", msgs[i])
-		HashToCurve_13(msgs[i], &P, curve, params)
+		Assert(params.curve == curve)
+		params.ToCurve(msgs[i], &P)
 		Assert(p[0] == P.x.Text(16))
 		Assert(p[1] == P.y.Text(16))
 	}
 }
 
 func TestHashToCurveIETF13(t *testing.T) {
-
 	HToC_Tester(t, "P256_XMD:SHA-256_SSWU_RO_", [][]string{
 		{"2c15230b26dbc6fc9a37051158c95b79656e17a1a920b11394ca91c44247d3e4",
 			"8a7a74985cc5c776cdfe4b1f19884970453912e9d31528c060be9ab5c43e8415"},
@@ -416,13 +1436,240 @@ func TestHashToCurveIETF13(t *testing.T) {
 	}, elliptic.P521())
 }
 
-func BenchmarkHashToCurveIETF13(b *testing.B) {
+// Appendix J.1.2, J.2.2 and J.3.2 of RFC 9380
+func TestEncodeToCurveRFC9380(t *testing.T) {
+	HToC_Tester(t, "P256_XMD:SHA-256_SSWU_NU_", [][]string{
+		{"f871caad25ea3b59c16cf87c1894902f7e7b2c822c3d3f73596c5ace8ddd14d1", "87b9ae23335bee057b99bac1e68588b18b5691af476234b8971bc4f011ddc99b"},
+		{"fc3f5d734e8dce41ddac49f47dd2b8a57257522a865c124ed02b92b5237befa4", "fe4d197ecf5a62645b9690599e1d80e82c500b22ac705a0b421fac7b47157866"},
+		{"f164c6674a02207e414c257ce759d35eddc7f55be6d7f415e2cc177e5d8faa84", "3aa274881d30db70485368c0467e97da0e73c18c1d00f34775d012b6fcee7f97"},
+		{"324532006312be4f162614076460315f7a54a6f85544da773dc659aca0311853", "8d8197374bcd52de2acfefc8a54fe2c8d8bebd2a39f16be9b710e4b1af6ef883"},
+		{"5c4bad52f81f39c8e8de1260e9a06d72b8b00a0829a8ea004a610b0691bea5d9", "c801e7c0782af1f74f24fc385a8555da0582032a3ce038de637ccdcb16f7ef7b"},
+	}, elliptic.P256())
+
+	HToC_Tester(t, "P384_XMD:SHA-384_SSWU_NU_", [][]string{
+		{"de5a893c83061b2d7ce6a0d8b049f0326f2ada4b966dc7e72927256b033ef61058029a3bfb13c1c7ececd6641881ae20", "63f46da6139785674da315c1947e06e9a0867f5608cf24724eb3793a1f5b3809ee28eb21a0c64be3be169afc6cdb38ca"},
+		{"1f08108b87e703c86c872ab3eb198a19f2b708237ac4be53d7929fb4bd5194583f40d052f32df66afe5249c9915d139b", "1369dc8d5bf038032336b989994874a2270adadb67a7fcc32f0f8824bc5118613f0ac8de04a1041d90ff8a5ad555f96c"},
+		{"4dac31ec8a82ee3c02ba2d7c9fa431f1e59ffe65bf977b948c59e1d813c2d7963c7be81aa6db39e78ff315a10115c0d0", "845333cdb5702ad5c525e603f302904d6fc84879f0ef2ee2014a6b13edd39131bfd66f7bd7cdc2d9ccf778f0c8892c3f"},
+		{"13c1f8c52a492183f7c28e379b0475486718a7e3ac1dfef39283b9ce5fb02b73f70c6c1f3dfe0c286b03e2af1af12d1d", "57e101887e73e40eab8963324ed16c177d55eb89f804ec9df06801579820420b5546b579008df2145fd770f584a1a54c"},
+		{"af129727a4207a8cb9e9dce656d88f79fce25edbcea350499d65e9bf1204537bdde73c7cefb752a6ed5ebcd44e183302", "ce68a3d5e161b2e6a968e4ddaa9e51504ad1516ec170c7eef3ca6b5327943eca95d90b23b009ba45f58b72906f2a99e2"},
+	}, elliptic.P384())
+
+	HToC_Tester(t, "P521_XMD:SHA-512_SSWU_NU_", [][]string{
+		{"1ec604b4e1e3e4c7449b7a41e366e876655538acf51fd40d08b97be066f7d020634e906b1b6942f9174b417027c953d75fb6ec64b8cee2a3672d4f1987d13974705", "944fc439b4aad2463e5c9cfa0b0707af3c9a42e37c5a57bb4ecd12fef9fb21508568aedcdd8d2490472df4bbafd79081c81e99f4da3286eddf19be47e9c4cf0e91"},
+		{"c720ab56aa5a7a4c07a7732a0a4e1b909e32d063ae1b58db5f0eb5e09f08a9884bff55a2bef4668f715788e692c18c1915cd034a6b998311fcf46924ce66a2be9a", "3570e87f91a4f3c7a56be2cb2a078ffc153862a53d5e03e5dad5bccc6c529b8bab0b7dbb157499e1949e4edab21cf5d10b782bc1e945e13d7421ad8121dbc72b1d"},
+		{"bcaf32a968ff7971b3bbd9ce8edfbee1309e2019d7ff373c38387a782b005dce6ceffccfeda5c6511c8f7f312f343f3a891029c5858f45ee0bf370aba25fc990cc", "923517e767532d82cb8a0b59705eec2b7779ce05f9181c7d5d5e25694ef8ebd4696343f0bc27006834d2517215ecf79482a84111f50c1bae25044fe1dd77744bbd"},
+		{"1ac69014869b6c4ad7aa8c443c255439d36b0e48a0f57b03d6fe9c40a66b4e2eaed2a93390679a5cc44b3a91862b34b673f0e92c83187da02bf3db967d867ce748", "d5603d530e4d62b30fccfa1d90c2206654d74291c1db1c25b86a051ee3fffc294e5d56f2e776853406bd09206c63d40f37ad8829524cf89ad70b5d6e0b4a3b7341"},
+		{"1801de044c517a80443d2bd4f503a9e6866750d2f94a22970f62d721f96e4310e4a828206d9cdeaa8f2d476705cc3bbc490a6165c687668f15ec178a17e3d27349b", "68889ea2e1442245fe42bfda9e58266828c0263119f35a61631a3358330f3bb84443fcb54fcd53a1d097fccbe310489b74ee143fc2938959a83a1f7dd4a6fd395b"},
+	}, elliptic.P521())
+}
+
+// Appendix K.1 to K.3 (expand_message_xmd) and K.4 to K.6
+// (expand_message_xof) of RFC 9380, for the messages of HToC_Tester
+func TestExpandMessageRFC9380(t *testing.T) {
+	for _, v := range []struct {
+		suite, DST string
+		uniform    [2][]string // 0x20 and 0x80 bytes
+	}{
+		{"P256_XMD:SHA-256_SSWU_RO_", "QUUX-V01-CS02-with-expander-SHA256-128", [2][]string{{
+			"68a985b87eb6b46952128911f2a4412bbc302a9d759667f87f7a21d803f07235",
+			"d8ccab23b5985ccea865c6c97b6e5b8350e794e603b4b97902f53a8a0d605615",
+			"eff31487c770a893cfb36f912fbfcbff40d5661771ca4b2cb4eafe524333f5c1",
+			"b23a1d2b4d97b2ef7785562a7e8bac7eed54ed6e97e29aa51bfe3f12ddad1ff9",
+			"4623227bcc01293b8c130bf771da8c298dede7383243dc0993d2d94823958c4c",
+		}, {
+			"af84c27ccfd45d41914fdff5df25293e221afc53d8ad2ac06d5e3e29485dadbee0d121587713a3e0dd4d5e69e93eb7cd4f5df4cd103e188cf60cb02edc3edf18eda8576c412b18ffb658e3dd6ec849469b979d444cf7b26911a08e63cf31f9dcc541708d3491184472c2c29bb749d4286b004ceb5ee6b9a7fa5b646c993f0ced",
+			"abba86a6129e366fc877aab32fc4ffc70120d8996c88aee2fe4b32d6c7b6437a647e6c3163d40b76a73cf6a5674ef1d890f95b664ee0afa5359a5c4e07985635bbecbac65d747d3d2da7ec2b8221b17b0ca9dc8a1ac1c07ea6a1e60583e2cb00058e77b7b72a298425cd1b941ad4ec65e8afc50303a22c0f99b0509b4c895f40",
+			"ef904a29bffc4cf9ee82832451c946ac3c8f8058ae97d8d629831a74c6572bd9ebd0df635cd1f208e2038e760c4994984ce73f0d55ea9f22af83ba4734569d4bc95e18350f740c07eef653cbb9f87910d833751825f0ebefa1abe5420bb52be14cf489b37fe1a72f7de2d10be453b2c9d9eb20c7e3f6edc5a60629178d9478df",
+			"80be107d0884f0d881bb460322f0443d38bd222db8bd0b0a5312a6fedb49c1bbd88fd75d8b9a09486c60123dfa1d73c1cc3169761b17476d3c6b7cbbd727acd0e2c942f4dd96ae3da5de368d26b32286e32de7e5a8cb2949f866a0b80c58116b29fa7fabb3ea7d520ee603e0c25bcaf0b9a5e92ec6a1fe4e0391d1cdbce8c68a",
+			"546aff5444b5b79aa6148bd81728704c32decb73a3ba76e9e75885cad9def1d06d6792f8a7d12794e90efed817d96920d728896a4510864370c207f99bd4a608ea121700ef01ed879745ee3e4ceef777eda6d9e5e38b90c86ea6fb0b36504ba4a45d22e86f6db5dd43d98a294bebb9125d5b794e9d2a81181066eb954966a487",
+		}}},
+		{"P256_XMD:SHA-256_SSWU_RO_", "QUUX-V01-CS02-with-expander-SHA256-128-long-DST-" + strings.Repeat("1", 208), [2][]string{{
+			"e8dc0c8b686b7ef2074086fbdd2f30e3f8bfbd3bdf177f73f04b97ce618a3ed3",
+			"52dbf4f36cf560fca57dedec2ad924ee9c266341d8f3d6afe5171733b16bbb12",
+			"35387dcf22618f3728e6c686490f8b431f76550b0b2c61cbc1ce7001536f4521",
+			"01b637612bb18e840028be900a833a74414140dde0c4754c198532c3a0ba42bc",
+			"20cce7033cabc5460743180be6fa8aac5a103f56d481cf369a8accc0c374431b",
+		}, {
+			"14604d85432c68b757e485c8894db3117992fc57e0e136f71ad987f789a0abc287c47876978e2388a02af86b1e8d1342e5ce4f7aaa07a87321e691f6fba7e0072eecc1218aebb89fb14a0662322d5edbd873f0eb35260145cd4e64f748c5dfe60567e126604bcab1a3ee2dc0778102ae8a5cfd1429ebc0fa6bf1a53c36f55dfc",
+			"1a30a5e36fbdb87077552b9d18b9f0aee16e80181d5b951d0471d55b66684914aef87dbb3626eaabf5ded8cd0686567e503853e5c84c259ba0efc37f71c839da2129fe81afdaec7fbdc0ccd4c794727a17c0d20ff0ea55e1389d6982d1241cb8d165762dbc39fb0cee4474d2cbbd468a835ae5b2f20e4f959f56ab24cd6fe267",
+			"d2ecef3635d2397f34a9f86438d772db19ffe9924e28a1caf6f1c8f15603d4028f40891044e5c7e39ebb9b31339979ff33a4249206f67d4a1e7c765410bcd249ad78d407e303675918f20f26ce6d7027ed3774512ef5b00d816e51bfcc96c3539601fa48ef1c07e494bdc37054ba96ecb9dbd666417e3de289d4f424f502a982",
+			"ed6e8c036df90111410431431a232d41a32c86e296c05d426e5f44e75b9a50d335b2412bc6c91e0a6dc131de09c43110d9180d0a70f0d6289cb4e43b05f7ee5e9b3f42a1fad0f31bac6a625b3b5c50e3a83316783b649e5ecc9d3b1d9471cb5024b7ccf40d41d1751a04ca0356548bc6e703fca02ab521b505e8e45600508d32",
+			"78b53f2413f3c688f07732c10e5ced29a17c6a16f717179ffbe38d92d6c9ec296502eb9889af83a1928cd162e845b0d3c5424e83280fed3d10cffb2f8431f14e7a23f4c68819d40617589e4c41169d0b56e0e3535be1fd71fbb08bb70c5b5ffed953d6c14bf7618b35fc1f4c4b30538236b4b08c9fbf90462447a8ada60be495",
+		}}},
+		{"P521_XMD:SHA-512_SSWU_RO_", "QUUX-V01-CS02-with-expander-SHA512-256", [2][]string{{
+			"6b9a7312411d92f921c6f68ca0b6380730a1a4d982c507211a90964c394179ba",
+			"0da749f12fbe5483eb066a5f595055679b976e93abe9be6f0f6318bce7aca8dc",
+			"087e45a86e2939ee8b91100af1583c4938e0f5fc6c9db4b107b83346bc967f58",
+			"7336234ee9983902440f6bc35b348352013becd88938d2afec44311caf8356b3",
+			"57b5f7e766d5be68a6bfe1768e3c2b7f1228b3e4b3134956dd73a59b954c66f4",
+		}, {
+			"41b037d1734a5f8df225dd8c7de38f851efdb45c372887be655212d07251b921b052b62eaed99b46f72f2ef4cc96bfaf254ebbbec091e1a3b9e4fb5e5b619d2e0c5414800a1d882b62bb5cd1778f098b8eb6cb399d5d9d18f5d5842cf5d13d7eb00a7cff859b605da678b318bd0e65ebff70bec88c753b159a805d2c89c55961",
+			"7f1dddd13c08b543f2e2037b14cefb255b44c83cc397c1786d975653e36a6b11bdd7732d8b38adb4a0edc26a0cef4bb45217135456e58fbca1703cd6032cb1347ee720b87972d63fbf232587043ed2901bce7f22610c0419751c065922b488431851041310ad659e4b23520e1772ab29dcdeb2002222a363f0c2b1c972b3efe1",
+			"3f721f208e6199fe903545abc26c837ce59ac6fa45733f1baaf0222f8b7acb0424814fcb5eecf6c1d38f06e9d0a6ccfbf85ae612ab8735dfdf9ce84c372a77c8f9e1c1e952c3a61b7567dd0693016af51d2745822663d0c2367e3f4f0bed827feecc2aaf98c949b5ed0d35c3f1023d64ad1407924288d366ea159f46287e61ac",
+			"b799b045a58c8d2b4334cf54b78260b45eec544f9f2fb5bd12fb603eaee70db7317bf807c406e26373922b7b8920fa29142703dd52bdf280084fb7ef69da78afdf80b3586395b433dc66cde048a258e476a561e9deba7060af40adf30c64249ca7ddea79806ee5beb9a1422949471d267b21bc88e688e4014087a0b592b695ed",
+			"05b0bfef265dcee87654372777b7c44177e2ae4c13a27f103340d9cd11c86cb2426ffcad5bd964080c2aee97f03be1ca18e30a1f14e27bc11ebbd650f305269cc9fb1db08bf90bfc79b42a952b46daf810359e7bc36452684784a64952c343c52e5124cd1f71d474d5197fefc571a92929c9084ffe1112cf5eea5192ebff330b",
+		}}},
+		{"P256_XOF:SHAKE128_SSWU_RO_", "QUUX-V01-CS02-with-expander-SHAKE128", [2][]string{{
+			"86518c9cd86581486e9485aa74ab35ba150d1c75c88e26b7043e44e2acd735a2",
+			"8696af52a4d862417c0763556073f47bc9b9ba43c99b505305cb1ec04a9ab468",
+			"912c58deac4821c3509dbefa094df54b34b8f5d01a191d1d3108a2c89077acca",
+			"1adbcc448aef2a0cebc71dac9f756b22e51839d348e031e63b33ebb50faeaf3f",
+			"df3447cc5f3e9a77da10f819218ddf31342c310778e0e4ef72bbaecee786a4fe",
+		}, {
+			"7314ff1a155a2fb99a0171dc71b89ab6e3b2b7d59e38e64419b8b6294d03ffee42491f11370261f436220ef787f8f76f5b26bdcd850071920ce023f3ac46847744f4612b8714db8f5db83205b2e625d95afd7d7b4d3094d3bdde815f52850bb41ead9822e08f22cf41d615a303b0d9dde73263c049a7b9898208003a739a2e57",
+			"c952f0c8e529ca8824acc6a4cab0e782fc3648c563ddb00da7399f2ae35654f4860ec671db2356ba7baa55a34a9d7f79197b60ddae6e64768a37d699a78323496db3878c8d64d909d0f8a7de4927dcab0d3dbbc26cb20a49eceb0530b431cdf47bc8c0fa3e0d88f53b318b6739fbed7d7634974f1b5c386d6230c76260d5337a",
+			"19b65ee7afec6ac06a144f2d6134f08eeec185f1a890fe34e68f0e377b7d0312883c048d9b8a1d6ecc3b541cb4987c26f45e0c82691ea299b5e6889bbfe589153016d8131717ba26f07c3c14ffbef1f3eff9752e5b6183f43871a78219a75e7000fbac6a7072e2b83c790a3a5aecd9d14be79f9fd4fb180960a3772e08680495",
+			"ca1b56861482b16eae0f4a26212112362fcc2d76dcc80c93c4182ed66c5113fe41733ed68be2942a3487394317f3379856f4822a611735e50528a60e7ade8ec8c71670fec6661e2c59a09ed36386513221688b35dc47e3c3111ee8c67ff49579089d661caa29db1ef10eb6eace575bf3dc9806e7c4016bd50f3c0e2a6481ee6d",
+			"9d763a5ce58f65c91531b4100c7266d479a5d9777ba761693d052acd37d149e7ac91c796a10b919cd74a591a1e38719fb91b7203e2af31eac3bff7ead2c195af7d88b8bc0a8adf3d1e90ab9bed6ddc2b7f655dd86c730bdeaea884e73741097142c92f0e3fc1811b699ba593c7fbd81da288a29d423df831652e3a01a9374999",
+		}}},
+		{"P256_XOF:SHAKE128_SSWU_RO_", "QUUX-V01-CS02-with-expander-SHAKE128-long-DST-" + strings.Repeat("1", 210), [2][]string{{
+			"827c6216330a122352312bccc0c8d6e7a146c5257a776dbd9ad9d75cd880fc53",
+			"690c8d82c7213b4282c6cb41c00e31ea1d3e2005f93ad19bbf6da40f15790c5c",
+			"979e3a15064afbbcf99f62cc09fa9c85028afcf3f825eb0711894dcfc2f57057",
+			"c5a9220962d9edc212c063f4f65b609755a1ed96e62f9db5d1fd6adb5a8dc52b",
+			"f7b96a5901af5d78ce1d071d9c383cac66a1dfadb508300ec6aeaea0d62d5d62",
+		}, {
+			"3890dbab00a2830be398524b71c2713bbef5f4884ac2e6f070b092effdb19208c7df943dc5dcbaee3094a78c267ef276632ee2c8ea0c05363c94b6348500fae4208345dd3475fe0c834c2beac7fa7bc181692fb728c0a53d809fc8111495222ce0f38468b11becb15b32060218e285c57a60162c2c8bb5b6bded13973cd41819",
+			"41b7ffa7a301b5c1441495ebb9774e2a53dbbf4e54b9a1af6a20fd41eafd69ef7b9418599c5545b1ee422f363642b01d4a53449313f68da3e49dddb9cd25b97465170537d45dcbdf92391b5bdff344db4bd06311a05bca7dcd360b6caec849c299133e5c9194f4e15e3e23cfaab4003fab776f6ac0bfae9144c6e2e1c62e7d57",
+			"55317e4a21318472cd2290c3082957e1242241d9e0d04f47026f03401643131401071f01aa03038b2783e795bdfa8a3541c194ad5de7cb9c225133e24af6c86e748deb52e560569bd54ef4dac03465111a3a44b0ea490fb36777ff8ea9f1a8a3e8e0de3cf0880b4b2f8dd37d3a85a8b82375aee4fa0e909f9763319b55778e71",
+			"19fdd2639f082e31c77717ac9bb032a22ff0958382b2dbb39020cdc78f0da43305414806abf9a561cb2d0067eb2f7bc544482f75623438ed4b4e39dd9e6e2909dd858bd8f1d57cd0fce2d3150d90aa67b4498bdf2df98c0100dd1a173436ba5d0df6be1defb0b2ce55ccd2f4fc05eb7cb2c019c35d5398b85adc676da4238bc7",
+			"945373f0b3431a103333ba6a0a34f1efab2702efde41754c4cb1d5216d5b0a92a67458d968562bde7fa6310a83f53dda1383680a276a283438d58ceebfa7ab7ba72499d4a3eddc860595f63c93b1c5e823ea41fc490d938398a26db28f61857698553e93f0574eb8c5017bfed6249491f9976aaa8d23d9485339cc85ca329308",
+		}}},
+		{"P521_XOF:SHAKE256_SSWU_RO_", "QUUX-V01-CS02-with-expander-SHAKE256", [2][]string{{
+			"2ffc05c48ed32b95d72e807f6eab9f7530dd1c2f013914c8fed38c5ccc15ad76",
+			"b39e493867e2767216792abce1f2676c197c0692aed061560ead251821808e07",
+			"245389cf44a13f0e70af8665fe5337ec2dcd138890bb7901c4ad9cfceb054b65",
+			"719b3911821e6428a5ed9b8e600f2866bcf23c8f0515e52d6c6c019a03f16f0e",
+			"9181ead5220b1963f1b5951f35547a5ea86a820562287d6ca4723633d17ccbbc",
+		}, {
+			"7a1361d2d7d82d79e035b8880c5a3c86c5afa719478c007d96e6c88737a3f631dd74a2c88df79a4cb5e5d9f7504957c70d669ec6bfedc31e01e2bacc4ff3fdf9b6a00b17cc18d9d72ace7d6b81c2e481b4f73f34f9a7505dccbe8f5485f3d20c5409b0310093d5d6492dea4e18aa6979c23c8ea5de01582e9689612afbb353df",
+			"a54303e6b172909783353ab05ef08dd435a558c3197db0c132134649708e0b9b4e34fb99b92a9e9e28fc1f1d8860d85897a8e021e6382f3eea10577f968ff6df6c45fe624ce65ca25932f679a42a404bc3681efe03fcd45ef73bb3a8f79ba784f80f55ea8a3c367408f30381299617f50c8cf8fbb21d0f1e1d70b0131a7b6fbe",
+			"e42e4d9538a189316e3154b821c1bafb390f78b2f010ea404e6ac063deb8c0852fcd412e098e231e43427bd2be1330bb47b4039ad57b30ae1fc94e34993b162ff4d695e42d59d9777ea18d3848d9d336c25d2acb93adcad009bcfb9cde12286df267ada283063de0bb1505565b2eb6c90e31c48798ecdc71a71756a9110ff373",
+			"4ac054dda0a38a65d0ecf7afd3c2812300027c8789655e47aecf1ecc1a2426b17444c7482c99e5907afd9c25b991990490bb9c686f43e79b4471a23a703d4b02f23c669737a886a7ec28bddb92c3a98de63ebf878aa363a501a60055c048bea11840c4717beae7eee28c3cfa42857b3d130188571943a7bd747de831bd6444e0",
+			"09afc76d51c2cccbc129c2315df66c2be7295a231203b8ab2dd7f95c2772c68e500bc72e20c602abc9964663b7a03a389be128c56971ce81001a0b875e7fd17822db9d69792ddf6a23a151bf470079c518279aef3e75611f8f828994a9988f4a8a256ddb8bae161e658d5a2a09bcfe839c6396dc06ee5c8ff3c22d3b1f9deb7e",
+		}}},
+	} {
+		// An oversized DST is reduced to H("H2C-OVERSIZE-DST-" || DST)
+		params, err := NewHtoCParams(v.suite, v.DST)
+		Panic(err)
+		for k, length := range []int{0x20, 0x80} {
+			for i, msg := range h2cMsgs {
+				if got := hex.EncodeToString(params.ExpandMessage(msg, params.DST, length)); got != v.uniform[k][i] {
+					t.Fatalf("expand_message(%q, %s, %d) = %s", msg, v.DST, length, got)
+				}
+			}
+		}
+	}
+
+	// Only the suites of RFC 9380 on the NIST curves, and their XOF variants
+	// of at least the security of the curve
+	for _, suite := range []string{"P384_XOF:SHAKE128_SSWU_RO_", "P256_XMD:SHA-512_SSWU_RO_", "P384_XMD:SHA-256_SSWU_RO_", "P256_XMD:SHA-256_SVDW_RO_", "P256_XMD:SHA-256_SSWU_RO"} {
+		if _, err := NewHtoCParams(suite, "unused-DST"); err == nil {
+			t.Fatalf("accepted the undefined suite %s", suite)
+		}
+	}
+	if _, err := (Session{Suite: "P384_XMD:SHA-384_SSWU_RO_"}).HashToCurve(); err == nil {
+		t.Fatalf("accepted a session suite off P-256")
+	}
+	if _, err := (Session{Suite: "P256_XOF:SHAKE128_SSWU_NU_"}).HashToCurve(); err != nil {
+		t.Fatalf("refused a session suite with expand_message_xof: %s", err)
+	}
+}
+
+func TestSSWUP256(t *testing.T) {
+	params, err := NewHtoCParams(h2cSuite, DefaultDST)
+	Panic(err)
+
+	// The Montgomery products agree with big.Int, including next to p
+	q := params.q
+	edges := []*big.Int{big.NewInt(0), big.NewInt(1), new(big.Int).Sub(q, big.NewInt(1)), new(big.Int).Sub(q, big.NewInt(2))}
+	for i := 0; i < 200; i++ {
+		edges = append(edges, new(big.Int).Mod(OS2IP(RandomBytes(32)), q))
+	}
+	for i, a := range edges {
+		b := edges[(i*7+3)%len(edges)]
+		var x, y, xy, xx p256Element
+		p256FromBig(&x, a)
+		p256FromBig(&y, b)
+		p256Mul(&xy, &x, &y)
+		p256Square(&xx, &x)
+		if p256ToBig(&xy).Cmp(new(big.Int).Mod(new(big.Int).Mul(a, b), q)) != 0 || p256ToBig(&xx).Cmp(new(big.Int).Mod(new(big.Int).Mul(a, a), q)) != 0 {
+			t.Fatalf("%s * %s differs from big.Int", a.Text(16), b.Text(16))
+		}
+		p256Inv(&xy, &x)
+		if a.Sign() != 0 && p256ToBig(&xy).Cmp(new(big.Int).ModInverse(a, q)) != 0 {
+			t.Fatalf("1 / %s differs from big.Int", a.Text(16))
+		}
+	}
+
+	// The limb-based map agrees with the big.Int one, including on u = 0
+	inputs := [][]byte{make([]byte, 48)}
+	for i := 0; i < 200; i++ {
+		inputs = append(inputs, RandomBytes(48))
+	}
+	for _, b := range inputs {
+		var u, X, Y, Z p256Element
+		p256FromWide(&u, b)
+		p256MapToCurveSWU(&X, &Y, &Z, &u)
+		P := p256ToAffine(&X, &Y, &Z)
+
+		v := new(big.Int).Mod(OS2IP(b), params.q)
+		if p256ToBig(&u).Cmp(v) != 0 {
+			t.Fatalf("%x reduces to %s, want %s", b, p256ToBig(&u).Text(16), v.Text(16))
+		}
+		Q := params.MapToCurveSWUStraight(v)
+		if P.x.Cmp(Q.x) != 0 || P.y.Cmp(Q.y) != 0 {
+			t.Fatalf("SSWU(%s) differs from the big.Int map", v.Text(16))
+		}
+	}
+}
+
+func TestHashToCurveDST(t *testing.T) {
+	if CheckDST(DefaultDST) != nil || CheckDST("short") == nil || CheckDST(strings.Repeat("x", 256)) == nil {
+		t.Fatalf("CheckDST accepts tags outside 16 to 255 bytes")
+	}
+	if _, err := NewHtoCParams(h2cSuite, ""); err == nil {
+		t.Fatalf("NewHtoCParams accepted an empty DST")
+	}
+
+	var P, Q DHElement
+	curve := elliptic.P256()
+	a, _ := NewHtoCParams(h2cSuite, DefaultDST)
+	b, _ := NewHtoCParams(h2cSuite, "OTHER-APP-V01-CS01-with-"+h2cSuite)
+	HashToCurve("abc", &P, curve, a)
+	HashToCurve("abc", &Q, curve, b)
+	if P.x.Cmp(Q.x) == 0 {
+		t.Fatalf("two DSTs hash abc to the same point")
+	}
+
+	// An oversized DST is reduced to H("H2C-OVERSIZE-DST-" || DST)
+	long := strings.Repeat("x", 300)
+	c, err := NewHtoCParams(h2cSuite, long)
+	Panic(err)
+	if c.DST != string(SHA256([]byte("H2C-OVERSIZE-DST-"+long))) {
+		t.Fatalf("oversized DST was not reduced")
+	}
+}
+
+func benchmarkToCurve(b *testing.B, suite string) {
 	var P DHElement
-	params, err := NewHtoCParams("P256_XMD:SHA-256_SSWU_RO_")
+	params, err := NewHtoCParams(suite, DefaultDST)
 	Panic(err)
 
 	for i := 0; i < b.N; i++ {
 		msg := RandomString(12)
-		HashToCurve_13(msg, &P, elliptic.P256(), params)
+		params.ToCurve(msg, &P)
 	}
 }
+
+func BenchmarkHashToCurveIETF13(b *testing.B) {
+	benchmarkToCurve(b, "P256_XMD:SHA-256_SSWU_RO_")
+}
+
+func BenchmarkEncodeToCurveRFC9380(b *testing.B) {
+	benchmarkToCurve(b, "P256_XMD:SHA-256_SSWU_NU_")
+}
+
+func BenchmarkHashToCurveXOF(b *testing.B) {
+	benchmarkToCurve(b, "P256_XOF:SHAKE128_SSWU_RO_")
+}
@@ -1,90 +1,163 @@
 package main
 
 import (
+	"encoding/hex"
 	"fmt"
-	"log"
+	"io"
 	"math/big"
 	"math/rand"
-	"os"
+	"path"
+	"strings"
 	"time"
-
-	"github.com/fatih/color"
 )
 
 // #############################################################################
 
 func (p *Party) RunParallel(R *HashMapValues, pool *WorkerPool, fn WorkerFunc, ctx WorkerCtx) {
-	res := pool.Run(fn, ctx)
+	res := p.RunPool(pool, fn, ctx)
 	for i := 0; i < len(res); i++ {
 		data, ok := res[i].data.(DHOutput)
 		Assert(ok)
-		R.DHData[res[i].id] = HashMapValue{data.Q, data.S}
+		R.Q.Set(res[i].id, data.Q[:])
+		R.S.Set(res[i].id, data.S[:])
+		if data.Ct.EG != nil {
+			R.EG.Set(res[i].id, data.Ct.EG)
+		}
 	}
 }
 
-func (p *Party) TComputation(proto int, R *HashMapValues) uint64 {
-	rSize := R.Size()
-	xSize := uint64(len(p.X))
-	nMuls := uint64(0)
-	nReducs := uint64(0)
-	nRandoms := uint64(0)
-	nBlinds := uint64(0)
-
-	if p.id == 0 {
-		nMuls += 1
-		nBlinds += xSize
-		nRandoms += (rSize - xSize)
-		nBlinds += rSize
-	} else {
-		nReducs += xSize
-		if proto == 1 {
-			nRandoms += (rSize - xSize)
-		} else if proto == 2 {
-			if p.id == 1 {
-				nRandoms += (rSize - xSize)
-			} else {
-				nReducs += (rSize - xSize)
-			}
-		}
+// R carries the sum ciphertexts when the parties add their own values, from
+// P_1's copy of those of M. Each job then also adds v (nil for zeros) to the
+// ciphertexts of its slot.
+func (p *Party) valueJob(R *HashMapValues, idx uint64, in interface{}, v []int) interface{} {
+	if R.EG.Len() == 0 {
+		return in
+	}
+	return AddValuesInput{in, R.EG.At(idx), v}
+}
+
+func (p *Party) valueWorker(R *HashMapValues, fn WorkerFunc, dhCtx DHCtx) (WorkerFunc, WorkerCtx) {
+	if R.EG.Len() == 0 {
+		return fn, dhCtx
+	}
+	return AddValuesWorker(fn), AddValuesCtx{dhCtx, &p.ctx, &p.agg_pk}
+}
+
+// P_1 starts R, with a copy of the ciphertexts of M when the parties add their
+// own values
+func (p *Party) initR(M *HashMapValues, R *HashMapValues, sum bool) {
+	*R = NewHashMap(M.nBits)
+	if sum && p.addValues {
+		R.EG = NewPointSlab(M.Size(), M.EG.stride)
+		copy(R.EG.data, M.EG.data)
 	}
+}
+
+// As RunParallel, but only sets the lane of R that belongs to p
+func (p *Party) RunParallelLane(R *HashMapValues, pool *WorkerPool, fn WorkerFunc, ctx WorkerCtx, lane int) {
+	res := p.RunPool(pool, fn, ctx)
+	for i := 0; i < len(res); i++ {
+		data, ok := res[i].data.(DHOutput)
+		Assert(ok)
+		R.Q.SetLane(res[i].id, lane, data.Q[:])
+		R.S.SetLane(res[i].id, lane, data.S[:])
+	}
+}
 
-	nMuls = nBlinds + nRandoms + (4 * nReducs)
-	return nMuls
+const (
+	PhaseInit = iota
+	PhaseRound1
+	PhaseRound2
+	PhaseRound3
+)
+
+var phaseNames = []string{"Init", "Round 1", "Round 2", "Round 3"}
+
+// Operations from here on are counted towards phase
+func (p *Party) Phase(phase int) {
+	p.log = p.logBase.With("phase", phaseNames[phase])
+	p.ctx.ecc.CountInto(&p.ops[phase])
+	p.metrics.SetPhase(phase)
+}
+
+// Runs pool, reporting its progress to the metrics endpoint and the progress
+// line if there are any
+func (p *Party) RunPool(pool *WorkerPool, fn WorkerFunc, ctx WorkerCtx) []WorkerOutput {
+	p.trackProgress(pool)
+	p.metrics.Track(pool)
+	defer p.metrics.Untrack(pool)
+	return pool.Run(fn, ctx)
 }
 
-func (p *Party) TCommunication(R *HashMapValues) uint64 {
+// EC point multiplications over all phases
+func (c *PartyCost) Computation() uint64 {
 	ret := uint64(0)
-	nElems := 2*R.Size() + 1
-	ret += 2 * nElems * uint64(R.DHData[0].S.ByteSize())
+	for _, o := range c.Ops {
+		ret += o.ScalarMult + o.BaseMult
+	}
 	return ret
 }
 
-// #############################################################################
+// Prints and returns the operations and bytes counted so far
+func (p *Party) LogCost() PartyCost {
+	c := PartyCost{*p.ops, *p.comm}
+	logger := p.logBase.With("section", "COST")
 
-func (p *Party) Init(id, n, nBits int, dPath, lPath string, ctx *EGContext) {
-	p.id = id
+	logger.Info(fmt.Sprintf("Computation: %d EC point mul. (|X_%d| = %d)", c.Computation(), p.id, len(p.X)), "ec_mults", c.Computation(), "set_size", len(p.X))
+	for i, o := range c.Ops {
+		logger.Info(fmt.Sprintf("\t%s: %d scalar mul., %d base mul., %d add., %d hash-to-curve, %d AEAD, %d BSGS steps", phaseNames[i], o.ScalarMult, o.BaseMult, o.Add, o.HashToCurve, o.AEAD, o.BSGSSteps),
+			"phase", phaseNames[i], "scalar_mults", o.ScalarMult, "base_mults", o.BaseMult, "adds", o.Add, "hash_to_curve", o.HashToCurve, "aead", o.AEAD, "bsgs_steps", o.BSGSSteps)
+	}
+	c.Comm.Log(logger)
+	return c
+}
 
-	if p.id <= 5 {
-		p.log_color = map[int]color.Attribute{0: color.FgHiRed, 1: color.FgHiCyan, 2: color.FgHiYellow, 3: color.FgHiGreen, 4: color.FgHiBlue, 5: color.FgHiMagenta}[p.id]
+// Every party broadcasts its partial public key and the delegate sends L to
+// the parties. Counted as compressed points, whatever the key files look like.
+func (p *Party) CountSetup(nParties int, isDelegate bool) {
+	pkSize := uint64(len(DHPoint{}))
+	p.comm.Send(RoundSetup, pkSize, nParties)
+	p.comm.Recv(RoundSetup, pkSize*uint64(nParties))
+	if isDelegate {
+		p.comm.Send(RoundSetup, pkSize, nParties)
 	} else {
-		p.log_color = color.FgHiWhite
+		p.comm.Recv(RoundSetup, pkSize)
 	}
+}
 
-	color.Set(p.log_color)
-	defer color.Unset()
+// #############################################################################
 
-	p.log = log.New(os.Stdout, fmt.Sprintf("{LOG}\t\tParty %d => ", p.id), 0)
-	defer Timer(time.Now(), p.log, "Init")
+// Used unless a deployment sets its own h2c_suite and h2c_dst
+const h2cSuite = "P256_XMD:SHA-256_SSWU_RO_"
+const dstPrefix = "MPS-OPERATIONS-V01-CS01-with-"
+const DefaultDST = dstPrefix + h2cSuite
 
+// Logs go to stdout and are appended to lPath
+func (p *Party) Init(id, n, nBits int, dPath, lPath string, ctx *EGContext) {
+	p.id = id
 	p.n = n
 	p.nBits = nBits
 	p.ctx = *ctx
+	p.ops = new(PhaseOps)
+	p.comm = new(CommStats)
+	p.logBase = NewLogger(id, lPath)
+	p.Phase(PhaseInit)
+	defer Timer(time.Now(), p.log, "Init")
+
 	p.X = ReadFile(dPath)
 	p.partial_sk = ctx.ecc.RandomScalar()
+	p.SetSession(Session{})
+}
+
+// Replaces the key generated by Init with the one written by keygen
+func (p *Party) LoadKeys(keyDir string) {
+	p.partial_sk = new(big.Int).SetBytes(ReadHex(path.Join(keyDir, fmt.Sprintf("%d.sk", p.id)))[0])
 
-	var err error
-	p.h2c, err = NewHtoCParams("P256_XMD:SHA-256_SSWU_RO_")
-	Panic(err)
+	pks := make([]DHElement, p.n+1)
+	for i := range pks {
+		pks[i] = DHElementFromBytes(&p.ctx.ecc, ReadHex(path.Join(keyDir, fmt.Sprintf("%d.pk", i)))[0])
+	}
+	p.Set_AggPubKey(pks)
 }
 
 func (p *Party) Partial_PubKey() DHElement {
@@ -102,164 +175,497 @@ func (p *Party) Set_AggPubKey(pks []DHElement) {
 	}
 }
 
-func (p *Party) Partial_Decrypt(ct *EGCiphertext) []DHElement {
-	return p.ctx.EGMP_Decrypt(p.partial_sk, ct)
+// Only released for a ct whose transcript agrees with the messages p has seen
+// The partial decryptions of all columns, one after the other
+func (p *Party) Partial_Decrypt(cts []EGCiphertext, t Transcript) ([]DHElement, error) {
+	p.Phase(PhaseRound3)
+	span := p.StartSpan("Partial_Decrypt")
+	defer p.EndSpan(span)
+	span.SetAttr("moduli", p.ctx.nModuli)
+	span.SetAttr("columns", len(cts))
+
+	if err := p.CheckTranscript(t, cts); err != nil {
+		p.log.Error(fmt.Sprintf("Refusing to decrypt: %s", err))
+		return nil, err
+	}
+	hash := hex.EncodeToString(t.Hash(p.sid))
+	p.log.Info(fmt.Sprintf("Transcript %s checked", hash[:16]), "transcript", hash)
+	var partial []DHElement
+	for i := range cts {
+		partial = append(partial, p.ctx.EGMP_Decrypt(p.partial_sk, &cts[i])...)
+	}
+	return partial, nil
 }
 
-func (p *Party) BlindEncrypt(M, R *HashMapValues, sum bool) *HashMapFinal {
+func (p *Party) BlindEncrypt(L DHElement, M, R *HashMapValues, sum bool) *HashMapFinal {
 	if p.id != p.n {
 		return nil
 	}
 
 	defer Timer(time.Now(), p.log, "BlindEncrypt")
+	span := p.StartSpan("BlindEncrypt")
+	defer p.EndSpan(span)
 
 	var final HashMapFinal
-	length := len(R.DHData)
-	Assert(length == len(R.EncData))
+	length := R.Size()
+	Assert(length == M.Size())
+	span.SetAttr("slots", length)
 
-	final.Q = make([]DHElement, length)
+	// R is not used after this point, so B takes over its Q slab
+	final.Q = R.Q
 	final.AES = make([][]byte, length)
-
-	pool := NewWorkerPool(uint64(length))
-	for i := 0; i < length; i++ {
-		final.Q[i] = R.DHData[i].Q
-		pool.InChan <- WorkerInput{id: uint64(i), data: EncryptInput{&M.EncData[i], &R.DHData[i].S}}
+	final.lanes = 1
+
+	pool := NewWorkerPool(length)
+	for i := uint64(0); i < length; i++ {
+		input := EncryptInput{S: R.S.At(i)}
+		if R.EG.Len() > 0 {
+			input.EG = R.EG.At(i)
+		} else if sum {
+			input.EG = M.EG.At(i)
+		} else {
+			input.AES = p.innerLayer(M.AES[i])
+		}
+		pool.InChan <- WorkerInput{id: i, data: input}
 	}
 	var res []WorkerOutput
 	if sum {
-		res = pool.Run(EncryptEGWorker, EncryptCtx{&p.ctx, &p.agg_pk})
+		res = p.RunPool(pool, EncryptEGWorker, EncryptCtx{&p.ctx, &p.agg_pk})
 	} else {
-		res = pool.Run(EncryptAESWorker, nil)
+		res = p.RunPool(pool, EncryptAESWorker, EncryptCtx{&p.ctx, &p.agg_pk})
 	}
-	Assert(len(res) == length)
+	Assert(uint64(len(res)) == length)
 
 	for i := 0; i < len(res); i++ {
 		data, ok := res[i].data.(EncryptOutput)
 		Assert(ok)
 		final.AES[res[i].id] = data
 	}
+	p.EncryptDummies(&final, R, M.EG.stride)
 	p.Shuffle(&final)
+	final.T = R.T
+	p.Witness(p.n, MessageDigest(p.sid, final.Write))
 	return &final
 }
 
+// With dp, each party adds an encryption of its share of the noise of each
+// sum to R, which the delegate adds to the sums
+func (p *Party) AddNoiseShare(M, R *HashMapValues, sum bool) {
+	if p.dp == nil || !sum {
+		return
+	}
+	var m big.Int
+	shares := p.dp.SumShares()
+	Assert(len(shares)*int(66*p.ctx.nModuli) == M.EG.stride)
+
+	noise := make([]EGCiphertext, len(shares))
+	for j := range shares {
+		m.SetInt64(shares[j])
+		p.ctx.EG_Encrypt(&p.agg_pk, &m, &noise[j])
+	}
+	if len(R.Noise) > 0 {
+		prev := p.ctx.EG_DeserializeAll(R.Noise)
+		for j := range noise {
+			p.ctx.EG_AddInplace(&noise[j], &prev[j])
+		}
+	}
+	R.Noise = p.ctx.EG_SerializeAll(noise)
+}
+
+// With dp, each party adds its share of the count noise as dummies to R. Of
+// its Dummies() pairs, CountDummies() are matches, Q = rG and S = rL, which
+// alpha maps to each other, and the rest are random points. Only the delegate
+// can tell them apart, and it only sees them mixed into B. The dummies of
+// earlier parties are scaled by fresh scalars, which keeps matches matching,
+// and shuffled, so that no one can trace them back to their party.
+func (p *Party) AddDummies(L DHElement, R *HashMapValues) {
+	if p.dp == nil {
+		return
+	}
+	ecc := &p.ctx.ecc
+	var Q, S DHElement
+	for i := uint64(0); i < R.DQ.Len(); i++ {
+		r := ecc.RandomScalar()
+		ecc.EC_Multiply(r, DHElementFromBytes(ecc, R.DQ.At(i)), &Q)
+		ecc.EC_Multiply(r, DHElementFromBytes(ecc, R.DS.At(i)), &S)
+		q, s := Q.Compress(), S.Compress()
+		R.DQ.Set(i, q[:])
+		R.DS.Set(i, s[:])
+	}
+
+	matches := p.dp.CountDummies()
+	for i := 0; i < p.dp.Dummies(); i++ {
+		if i < matches {
+			r := ecc.RandomScalar()
+			ecc.EC_BaseMultiply(r, &Q)
+			ecc.EC_Multiply(r, L, &S)
+		} else {
+			ecc.RandomElement(&Q)
+			ecc.RandomElement(&S)
+		}
+		q, s := Q.Compress(), S.Compress()
+		R.DQ = PointSlab{append(R.DQ.data, q[:]...), len(q)}
+		R.DS = PointSlab{append(R.DS.data, s[:]...), len(s)}
+	}
+	p.dp.rng.Shuffle(int(R.DQ.Len()), func(i, j int) {
+		R.DQ.Swap(uint64(i), uint64(j))
+		R.DS.Swap(uint64(i), uint64(j))
+	})
+	p.log.Debug(fmt.Sprintf("Added %d dummies", p.dp.Dummies()), "dummies", p.dp.Dummies())
+}
+
+// With dp and without sums, B carries dummyPayload in place of the inner
+// layer, the same for every slot
+func (p *Party) innerLayer(ct []byte) []byte {
+	if p.dp != nil {
+		return dummyPayload
+	}
+	return ct
+}
+
+// P_n encrypts the dummies of R into slots of B, with encryptions of zero for
+// the sums. Each dummy fills one lane of its slot, and the other lanes never
+// open.
+func (p *Party) EncryptDummies(final *HashMapFinal, R *HashMapValues, egStride int) {
+	if p.dp == nil {
+		return
+	}
+	var Q DHElement
+	cts := make([]EGCiphertext, egStride/int(66*p.ctx.nModuli))
+	for i := uint64(0); i < R.DQ.Len(); i++ {
+		pt := p.innerLayer(nil)
+		if egStride > 0 {
+			for j := range cts {
+				p.ctx.EG_EncryptZero(&p.agg_pk, &cts[j])
+			}
+			pt = p.ctx.EG_SerializeAll(cts)
+		}
+		final.Q.data = append(final.Q.data, R.DQ.At(i)...)
+		final.AES = append(final.AES, p.ctx.ecc.AEAD_Encrypt(pt, AES_KDF(R.DS.At(i), p.ctx.ecc.sid)))
+		for k := 1; k < final.lanes; k++ {
+			p.ctx.ecc.RandomElement(&Q)
+			q := Q.Compress()
+			final.Q.data = append(final.Q.data, q[:]...)
+			final.AES = append(final.AES, p.ctx.ecc.AEAD_Encrypt(pt, RandomBytes(32)))
+		}
+	}
+	final.Noise = R.Noise
+}
+
+// The lanes of a slot stay together, but are shuffled among themselves
 func (p *Party) Shuffle(R *HashMapFinal) {
-	rand.Seed(time.Now().UnixNano())
-	rand.Shuffle(len(R.Q), func(i, j int) {
-		R.Q[i], R.Q[j] = R.Q[j], R.Q[i]
+	span := p.StartSpan("Shuffle")
+	defer p.EndSpan(span)
+	slots := len(R.AES) / R.lanes
+	span.SetAttr("slots", slots)
+
+	swap := func(i, j int) {
+		R.Q.Swap(uint64(i), uint64(j))
 		R.AES[i], R.AES[j] = R.AES[j], R.AES[i]
+	}
+	rand.Seed(time.Now().UnixNano())
+	rand.Shuffle(slots, func(i, j int) {
+		for k := 0; k < R.lanes; k++ {
+			swap(i*R.lanes+k, j*R.lanes+k)
+		}
 	})
-	p.log.Printf("Shuffled %d slots\n", len(R.Q))
+	if R.lanes > 1 {
+		for i := 0; i < slots; i++ {
+			rand.Shuffle(R.lanes, func(j, k int) { swap(i*R.lanes+j, i*R.lanes+k) })
+		}
+	}
+	p.log.Info(fmt.Sprintf("Shuffled %d slots", slots), "slots", slots)
+}
+
+// P_n encrypts the ciphertext of each slot of M once for every t-subset of the
+// parties, under the sum of their lanes. It opens iff all of them hold the
+// delegate's element. Each sum is scaled by a fresh scalar, so the delegate
+// cannot solve for the lanes of single parties, but it sees C(k, t) lanes open
+// for an element held by k parties and so learns k, the accepted leakage of
+// OT-MPSI.
+func (p *Party) ThresholdEncrypt(M, R *HashMapValues, t int, sum bool) *HashMapFinal {
+	if p.id != p.n {
+		return nil
+	}
+
+	defer Timer(time.Now(), p.log, "ThresholdEncrypt")
+	span := p.StartSpan("ThresholdEncrypt")
+	defer p.EndSpan(span)
+
+	var final HashMapFinal
+	length := M.Size()
+	subsets := Subsets(p.n, t)
+	final.lanes = len(subsets)
+	final.Q = NewPointSlab(length*uint64(final.lanes), len(DHPoint{}))
+	final.AES = make([][]byte, length*uint64(final.lanes))
+	span.SetAttr("slots", length)
+	span.SetAttr("lanes", final.lanes)
+
+	pool := NewWorkerPool(length)
+	for i := uint64(0); i < length; i++ {
+		input := CombineInput{Q: R.Q.At(i), S: R.S.At(i)}
+		if sum {
+			input.EG = M.EG.At(i)
+		} else {
+			input.AES = p.innerLayer(M.AES[i])
+		}
+		pool.InChan <- WorkerInput{id: i, data: input}
+	}
+	res := p.RunPool(pool, CombineEncryptWorker, CombineCtx{&p.ctx, &p.agg_pk, subsets})
+	Assert(uint64(len(res)) == length)
+
+	for i := 0; i < len(res); i++ {
+		data, ok := res[i].data.(CombineOutput)
+		Assert(ok)
+		for j := range data.Q {
+			k := res[i].id*uint64(final.lanes) + uint64(j)
+			final.Q.Set(k, data.Q[j][:])
+			final.AES[k] = data.AES[j]
+		}
+	}
+	p.log.Info(fmt.Sprintf("Combined %d lanes per slot", final.lanes), "lanes", final.lanes)
+	p.EncryptDummies(&final, R, M.EG.stride)
+	p.Shuffle(&final)
+	final.T = R.T
+	p.Witness(p.n, MessageDigest(p.sid, final.Write))
+	return &final
 }
 
 // #############################################################################
 
+// Round 1 of protocol proto; t only applies to OT-MPSI
+func (p *Party) Round1(proto, t int, L DHElement, M, R *HashMapValues) *HashMapFinal {
+	sum := (proto%2 == 1)
+	switch {
+	case proto <= 1:
+		return p.MPSI(L, M, R, sum)
+	case proto <= 3:
+		return p.MPSIU(L, M, R, sum)
+	}
+	return p.OTMPSI(L, M, R, t, sum)
+}
+
+// Every slot is reduced or randomized, then encrypted again by P_n
+func (p *Party) phaseSlots(M *HashMapValues) uint64 {
+	if p.id == p.n {
+		return 2 * M.Size()
+	}
+	return M.Size()
+}
+
 // Multiparty Private Set Intersection (optionally, sum)
 func (p *Party) MPSI(L DHElement, M *HashMapValues, R *HashMapValues, sum bool) *HashMapFinal {
-	color.Set(p.log_color)
+	p.Phase(PhaseRound1)
 
 	proto := "MPSI-Sum"
 	if !sum {
 		proto = "MPSI"
 	}
 	defer Timer(time.Now(), p.log, proto)
+	span := p.StartSpan(proto)
+	defer p.EndSpan(span)
+	span.SetAttr("slots", M.Size())
+	p.StartProgress(proto, p.phaseSlots(M))
+	defer p.EndProgress()
+	in := p.InputTranscript(M, R)
 
 	// Initialize R if you are P_1
 	if p.id == 1 {
-		*R = NewHashMap(M.nBits)
+		p.initR(M, R, sum)
 	}
 
 	// For all w in X, DH Reduce R[index(w)]
 	unmodified := GetBitMap(M.Size())
-	pool := NewWorkerPool(uint64(len(p.X)))
-
-	for w := range p.X {
-		idx := GetIndex(w, R.nBits)
-		if !unmodified.CheckedRemove(idx) {
-			continue
+	dhCtx := DHCtx{ctx: &p.ctx.ecc, L: L, isP1: (p.id == 1), h2c: p.h2c}
+	p.Step("reduced", func() {
+		pool := NewWorkerPool(uint64(len(p.X)))
+		for w, v := range p.X {
+			idx := GetIndex(w, R.nBits, p.sid)
+			if !unmodified.CheckedRemove(idx) {
+				continue
+			}
+			pool.InChan <- WorkerInput{id: idx, data: p.valueJob(R, idx, MPSIReduceInput{w, R.Q.At(idx), R.S.At(idx), M.S.At(idx)}, v)}
 		}
-		pool.InChan <- WorkerInput{id: idx, data: MPSIReduceInput{w, R.DHData[idx].Q, R.DHData[idx].S, M.DHData[idx].S}}
-	}
+		pool.nJobs = uint64(M.Size()) - unmodified.GetCardinality()
+		fn, ctx := p.valueWorker(R, MPSIReduceWorker, dhCtx)
+		p.RunParallel(R, pool, fn, ctx)
+	}, func(w io.Writer) { R.Write(w); writeBitmap(w, unmodified) }, func(r io.Reader) { *R = ReadHashMapValues(r); unmodified = readBitmap(r) })
 
 	njobs := uint64(M.Size()) - unmodified.GetCardinality()
-	pool.nJobs = njobs
+	p.modified = njobs
 
-	p.log.Printf("Modified %d slots (%.3f x expected)\n", njobs, float64(njobs)/E_FullSlots(float64(M.Size()), float64(len(p.X))))
-
-	dhCtx := DHCtx{ctx: &p.ctx.ecc, L: L, isP1: (p.id == 1), h2c: p.h2c}
-	p.RunParallel(R, pool, MPSIReduceWorker, dhCtx)
+	p.log.Info(fmt.Sprintf("Modified %d slots (%.3f x expected)", njobs, float64(njobs)/E_FullSlots(float64(M.Size()), float64(len(p.X)))), "modified", njobs)
+	span.SetAttr("modified", njobs)
 
 	// Randomize all unmodified indices
-	pool = NewWorkerPool(uint64(unmodified.GetCardinality()))
+	pool := NewWorkerPool(uint64(unmodified.GetCardinality()))
 	k := unmodified.Iterator()
 	for k.HasNext() {
-		pool.InChan <- WorkerInput{id: k.Next(), data: RandomizeInput{}}
+		idx := k.Next()
+		pool.InChan <- WorkerInput{id: idx, data: p.valueJob(R, idx, RandomizeInput{}, nil)}
+	}
+	fn, ctx := p.valueWorker(R, RandomizeWorker, dhCtx)
+	p.RunParallel(R, pool, fn, ctx)
+	p.log.Info(fmt.Sprintf("Randomized %d slots", unmodified.GetCardinality()), "randomized", unmodified.GetCardinality())
+	span.SetAttr("randomized", unmodified.GetCardinality())
+
+	p.AddNoiseShare(M, R, sum)
+	p.AddDummies(L, R)
+	R.T = in
+	if p.id != p.n {
+		p.Witness(p.id, MessageDigest(p.sid, R.Write))
 	}
-	p.RunParallel(R, pool, RandomizeWorker, dhCtx)
-	p.log.Printf("Randomized %d slots\n", unmodified.GetCardinality())
 
 	// Shuffle and return B if you are P_{n-1}
-	return p.BlindEncrypt(M, R, sum)
+	return p.BlindEncrypt(L, M, R, sum)
 }
 
 func (p *Party) MPSIU(L DHElement, M *HashMapValues, R *HashMapValues, sum bool) *HashMapFinal {
-	color.Set(p.log_color)
+	p.Phase(PhaseRound1)
 
 	proto := "MPSIU-Sum"
 	if !sum {
 		proto = "MPSIU"
 	}
 	defer Timer(time.Now(), p.log, proto)
+	span := p.StartSpan(proto)
+	defer p.EndSpan(span)
+	span.SetAttr("slots", M.Size())
+	p.StartProgress(proto, p.phaseSlots(M))
+	defer p.EndProgress()
+	in := p.InputTranscript(M, R)
 
 	// Initialize R if you are P_1
 	if p.id == 1 {
-		*R = NewHashMap(M.nBits)
+		p.initR(M, R, sum)
 	}
 
 	// For all w in X, R[index(w)]= DH_Reduce(M[index(w)])
 	unmodified := GetBitMap(M.Size())
-	pool := NewWorkerPool(uint64(len(p.X)))
-
-	for w := range p.X {
-		idx := GetIndex(w, M.nBits)
-		if !unmodified.CheckedRemove(idx) {
-			continue
+	dhCtx := DHCtx{ctx: &p.ctx.ecc, L: L, isP1: (p.id == 1), h2c: p.h2c}
+	p.Step("reduced", func() {
+		pool := NewWorkerPool(uint64(len(p.X)))
+		for w, v := range p.X {
+			idx := GetIndex(w, M.nBits, p.sid)
+			if !unmodified.CheckedRemove(idx) {
+				continue
+			}
+			pool.InChan <- WorkerInput{id: idx, data: p.valueJob(R, idx, HashAndReduceInput{w, M.S.At(idx)}, v)}
 		}
-		pool.InChan <- WorkerInput{id: idx, data: HashAndReduceInput{w, M.DHData[idx].S}}
-	}
+		pool.nJobs = uint64(M.Size()) - unmodified.GetCardinality()
+		fn, ctx := p.valueWorker(R, HashAndReduceWorker, dhCtx)
+		p.RunParallel(R, pool, fn, ctx)
+	}, func(w io.Writer) { R.Write(w); writeBitmap(w, unmodified) }, func(r io.Reader) { *R = ReadHashMapValues(r); unmodified = readBitmap(r) })
 
-	njobs := uint64(M.Size()) - unmodified.GetCardinality()
-	pool.nJobs = njobs
-	dhCtx := DHCtx{ctx: &p.ctx.ecc, L: L, isP1: (p.id == 1), h2c: p.h2c}
 	modified := M.Size() - unmodified.GetCardinality()
+	p.modified = modified
 
-	p.log.Printf("Modified %d slots (%.3f x expected)\n", modified, float64(modified)/E_FullSlots(float64(M.Size()), float64(len(p.X))))
-	p.RunParallel(R, pool, HashAndReduceWorker, dhCtx)
+	p.log.Info(fmt.Sprintf("Modified %d slots (%.3f x expected)", modified, float64(modified)/E_FullSlots(float64(M.Size()), float64(len(p.X)))), "modified", modified)
+	span.SetAttr("modified", modified)
 
-	pool = NewWorkerPool(unmodified.GetCardinality())
+	pool := NewWorkerPool(unmodified.GetCardinality())
 	k := unmodified.Iterator()
 	var workerFn WorkerFunc
 	if p.id == 1 {
 		// Randomize all unmodified indices
 		for k.HasNext() {
-			pool.InChan <- WorkerInput{id: k.Next(), data: RandomizeInput{}}
+			idx := k.Next()
+			pool.InChan <- WorkerInput{id: idx, data: p.valueJob(R, idx, RandomizeInput{}, nil)}
 		}
 		workerFn = RandomizeWorker
 	} else {
 		// DH Reduce all unmodified indices
 		for k.HasNext() {
 			idx := k.Next()
-			pool.InChan <- WorkerInput{id: idx, data: ReduceInput{R.DHData[idx].Q, R.DHData[idx].S}}
+			pool.InChan <- WorkerInput{id: idx, data: p.valueJob(R, idx, ReduceInput{R.Q.At(idx), R.S.At(idx)}, nil)}
 		}
 		workerFn = ReduceWorker
 	}
 
-	p.RunParallel(R, pool, workerFn, dhCtx)
+	fn, ctx := p.valueWorker(R, workerFn, dhCtx)
+	p.RunParallel(R, pool, fn, ctx)
 	op := "Randomized"
 	if p.id != 1 {
 		op = "Reduced"
 	}
-	p.log.Printf("%s %d unmodified slots\n", op, unmodified.GetCardinality())
+	p.log.Info(fmt.Sprintf("%s %d unmodified slots", op, unmodified.GetCardinality()), strings.ToLower(op), unmodified.GetCardinality())
+	span.SetAttr(strings.ToLower(op), unmodified.GetCardinality())
+
+	p.AddNoiseShare(M, R, sum)
+	p.AddDummies(L, R)
+	R.T = in
+	if p.id != p.n {
+		p.Witness(p.id, MessageDigest(p.sid, R.Write))
+	}
 
 	// Shuffle and return B if you are P_{n-1}
-	return p.BlindEncrypt(M, R, sum)
+	return p.BlindEncrypt(L, M, R, sum)
+}
+
+// Over-threshold MPSI (optionally, sum): the delegate's elements held by at
+// least t of the n parties. Each party reduces its own lane of R, as in MPSIU,
+// and P_n combines the lanes.
+func (p *Party) OTMPSI(L DHElement, M *HashMapValues, R *HashMapValues, t int, sum bool) *HashMapFinal {
+	p.Phase(PhaseRound1)
+
+	proto := "OT-MPSI-Sum"
+	if !sum {
+		proto = "OT-MPSI"
+	}
+	defer Timer(time.Now(), p.log, proto)
+	span := p.StartSpan(proto)
+	defer p.EndSpan(span)
+	span.SetAttr("slots", M.Size())
+	span.SetAttr("threshold", t)
+	p.StartProgress(proto, p.phaseSlots(M))
+	defer p.EndProgress()
+	in := p.InputTranscript(M, R)
+
+	// Initialize R if you are P_1
+	if p.id == 1 {
+		*R = NewLaneHashMap(M.nBits, p.n)
+	}
+	lane := p.id - 1
+
+	// For all w in X, R[index(w)][lane] = DH_Reduce(M[index(w)])
+	unmodified := GetBitMap(M.Size())
+	dhCtx := DHCtx{ctx: &p.ctx.ecc, L: L, isP1: (p.id == 1), h2c: p.h2c}
+	p.Step("reduced", func() {
+		pool := NewWorkerPool(uint64(len(p.X)))
+		for w := range p.X {
+			idx := GetIndex(w, M.nBits, p.sid)
+			if !unmodified.CheckedRemove(idx) {
+				continue
+			}
+			pool.InChan <- WorkerInput{id: idx, data: HashAndReduceInput{w, M.S.At(idx)}}
+		}
+		pool.nJobs = uint64(M.Size()) - unmodified.GetCardinality()
+		p.RunParallelLane(R, pool, HashAndReduceWorker, dhCtx, lane)
+	}, func(w io.Writer) { R.Write(w); writeBitmap(w, unmodified) }, func(r io.Reader) { *R = ReadHashMapValues(r); unmodified = readBitmap(r) })
+
+	modified := M.Size() - unmodified.GetCardinality()
+	p.modified = modified
+
+	p.log.Info(fmt.Sprintf("Modified %d slots (%.3f x expected)", modified, float64(modified)/E_FullSlots(float64(M.Size()), float64(len(p.X)))), "modified", modified)
+	span.SetAttr("modified", modified)
+
+	// Randomize the rest of the lane
+	pool := NewWorkerPool(unmodified.GetCardinality())
+	k := unmodified.Iterator()
+	for k.HasNext() {
+		pool.InChan <- WorkerInput{id: k.Next(), data: RandomizeInput{}}
+	}
+	p.RunParallelLane(R, pool, RandomizeWorker, dhCtx, lane)
+	p.log.Info(fmt.Sprintf("Randomized %d slots", unmodified.GetCardinality()), "randomized", unmodified.GetCardinality())
+	span.SetAttr("randomized", unmodified.GetCardinality())
+
+	p.AddNoiseShare(M, R, sum)
+	p.AddDummies(L, R)
+	R.T = in
+	if p.id != p.n {
+		p.Witness(p.id, MessageDigest(p.sid, R.Write))
+	}
+
+	// Combine, encrypt and shuffle if you are P_n
+	return p.ThresholdEncrypt(M, R, t, sum)
 }
@@ -3,41 +3,101 @@ package main
 import (
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // #############################################################################
 
 func NewWorkerPool(nJobs uint64) *WorkerPool {
 	return &WorkerPool{
-		make(InputChannel, nJobs),
-		make(OutputChannel, nJobs),
-		nJobs,
+		InChan:  make(InputChannel, nJobs),
+		OutChan: make(OutputChannel, nJobs),
+		nJobs:   nJobs,
 	}
 }
 
-func StartWorker(fn WorkerFunc, ctx WorkerCtx, InChan InputChannel, OutChan OutputChannel) {
+func StartWorker(fn WorkerFunc, ctx WorkerCtx, InChan InputChannel, OutChan OutputChannel, done *uint64) {
 	for {
 		job := <-InChan
 		if job.id == 0 && job.data == nil {
 			break
 		}
 		OutChan <- WorkerOutput{id: job.id, data: fn(ctx, job.data)}
+		atomic.AddUint64(done, 1)
 	}
 }
 
+func (p *WorkerPool) Done() uint64 {
+	return atomic.LoadUint64(&p.done)
+}
+
+// Jobs not yet picked up by a worker
+func (p *WorkerPool) QueueDepth() int {
+	return len(p.InChan)
+}
+
+// fn is called every interval while the pool runs and once when it is done
+func (p *WorkerPool) OnProgress(interval time.Duration, fn ProgressFunc) {
+	p.progress, p.interval = fn, interval
+}
+
+// Starts reporting progress; the returned function stops and sends the last report
+func (p *WorkerPool) reportProgress() func() {
+	start := time.Now()
+	report := func() {
+		done := p.Done()
+		p.progress(done, p.nJobs, ETA(time.Since(start), done, p.nJobs))
+	}
+
+	ticker := time.NewTicker(p.interval)
+	quit, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				report()
+			case <-quit:
+				return
+			}
+		}
+	}()
+	return func() {
+		ticker.Stop()
+		close(quit)
+		<-stopped
+		report()
+	}
+}
+
+// Remaining time if the rest of the jobs take as long as the first done
+func ETA(elapsed time.Duration, done, total uint64) time.Duration {
+	if done == 0 || done >= total {
+		return 0
+	}
+	return time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+}
+
 func (p *WorkerPool) Run(fn WorkerFunc, ctx WorkerCtx) []WorkerOutput {
+	stop := func() {}
+	if p.progress != nil {
+		stop = p.reportProgress()
+	}
+
 	l := runtime.NumCPU()
 	var wg sync.WaitGroup
 	for i := 0; i < l; i++ {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			StartWorker(fn, ctx, p.InChan, p.OutChan)
+			StartWorker(fn, ctx, p.InChan, p.OutChan, &p.done)
 		}()
 	}
 
 	close(p.InChan)
 	wg.Wait()
+	stop()
 	out := make([]WorkerOutput, p.nJobs)
 	for i := uint64(0); i < p.nJobs; i++ {
 		out[i] = <-p.OutChan
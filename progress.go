@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// #############################################################################
+
+const progressInterval = 500 * time.Millisecond
+
+// Set while an unfinished progress line is on screen, under stdoutMu
+var progressShown bool
+
+// Reports the progress of the pools run until EndProgress as one line, if
+// progress is enabled
+func (p *Party) StartProgress(label string, total uint64) {
+	if p.showProgress {
+		p.progress = &ProgressLine{label: label, total: total, start: time.Now()}
+	}
+}
+
+func (p *Party) EndProgress() {
+	if p.progress == nil {
+		return
+	}
+	p.ShowProgress(p.progress.total, true)
+	p.progress = nil
+}
+
+func (p *Party) trackProgress(pool *WorkerPool) {
+	line := p.progress
+	if line == nil {
+		return
+	}
+	base := line.base
+	line.base += pool.nJobs
+	pool.OnProgress(progressInterval, func(done, _ uint64, _ time.Duration) {
+		p.ShowProgress(base+done, false)
+	})
+}
+
+// Redraws the progress line in the color format, logs a record otherwise
+func (p *Party) ShowProgress(done uint64, final bool) {
+	line := p.progress
+	if logSettings.level > slog.LevelInfo {
+		return
+	}
+	eta := ETA(time.Since(line.start), done, line.total).Round(100 * time.Millisecond)
+	percent := 100.0
+	if line.total > 0 {
+		percent = 100 * float64(done) / float64(line.total)
+	}
+
+	if logSettings.format != "color" {
+		p.log.Info(fmt.Sprintf("%s: %d/%d slots (%.1f%%), ETA %s", line.label, done, line.total, percent, eta), "task", line.label, "done", done, "total", line.total, "eta", eta.Seconds())
+		return
+	}
+
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	end := ""
+	if final {
+		end = "\n"
+	}
+	color.New(PartyColor(p.id)).Fprintf(os.Stdout, "\r{PROGRESS}\tParty %d => %s: %d/%d slots (%.1f%%), ETA %s\x1b[K%s", p.id, line.label, done, line.total, percent, eta, end)
+	progressShown = !final
+}
+
+// #############################################################################
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// #############################################################################
+
+var sweepHeader = []string{"protocol", "n", "x0", "xi", "i", "b", "moduli", "trial", "seed", "init_s", "delegate_start_s", "parties_s", "delegate_finish_s", "joint_decryption_s", "total_s", "mem_peak_mb", "count", "true_count", "sum", "true_sum", "computation_delegate", "computation_parties", "communication_delegate_bytes", "communication_parties_bytes"}
+
+// Expands "start:stop[:step]" where step is +k (default +1) or xk
+func ParseRange(s string) ([]int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) == 1 {
+		v, err := strconv.Atoi(strings.TrimSpace(s))
+		return []int{v}, err
+	}
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("invalid range %q", s)
+	}
+
+	start, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return nil, err
+	}
+	stop, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	step, mult := 1, false
+	if len(parts) == 3 {
+		st := strings.TrimSpace(parts[2])
+		mult = strings.HasPrefix(st, "x")
+		step, err = strconv.Atoi(strings.TrimLeft(st, "+x"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if step < 1 || (mult && step < 2) || start > stop || (mult && start < 1) {
+		return nil, fmt.Errorf("invalid range %q", s)
+	}
+
+	var ret []int
+	for v := start; v <= stop; {
+		ret = append(ret, v)
+		if mult {
+			v *= step
+		} else {
+			v += step
+		}
+	}
+	return ret, nil
+}
+
+// sweep.<key> may be absent (use def), a scalar, a range or a list of either
+func SweepInts(key string, def int) []int {
+	raw := viper.Get("sweep." + key)
+	if raw == nil {
+		return []int{def}
+	}
+
+	var items []interface{}
+	if list, ok := raw.([]interface{}); ok {
+		items = list
+	} else {
+		items = []interface{}{raw}
+	}
+
+	var ret []int
+	for _, item := range items {
+		vals, err := ParseRange(fmt.Sprint(item))
+		Panic(err)
+		ret = append(ret, vals...)
+	}
+	return ret
+}
+
+func SweepStrings(key string, def string) []string {
+	if !viper.IsSet("sweep." + key) {
+		return []string{def}
+	}
+	return viper.GetStringSlice("sweep." + key)
+}
+
+// #############################################################################
+
+// Runs every combination of the sweep lists for the configured number of
+// trials, appending one row per trial to the output file
+func RunSweep(cfg Config) {
+	trials := viper.GetInt("sweep.trials")
+	if trials < 1 {
+		trials = 1
+	}
+	out := viper.GetString("sweep.output")
+	if out == "" {
+		out = "sweep.csv"
+	}
+	out = path.Join(cfg.resDir, out)
+	_ = os.Mkdir(cfg.resDir, os.ModePerm)
+
+	protos := SweepStrings("protocol", protoNames[cfg.proto])
+	ns := SweepInts("n", cfg.nParties)
+	x0s := SweepInts("x0", cfg.sizes[0])
+	xis := SweepInts("xi", cfg.sizes[1])
+	is := SweepInts("i", cfg.intCard)
+	bs := SweepInts("b", cfg.nBits)
+	mods := SweepInts("moduli", int(cfg.nModuli))
+
+	rows := 0
+	for _, protoName := range protos {
+		for _, n := range ns {
+			for _, x0 := range x0s {
+				for _, xi := range xis {
+					for _, i := range is {
+						for _, b := range bs {
+							for _, mod := range mods {
+								c := cfg
+								c.proto = -1
+								for j, name := range protoNames {
+									if name == protoName {
+										c.proto = j
+									}
+								}
+								c.nParties, c.sizes, c.intCard, c.nBits, c.nModuli = n, UniformSizes(n, x0, xi), i, b, uint(mod)
+
+								if c.proto < 0 || n < 2 || i > x0 || (c.proto <= 1 && i > xi) || (c.proto >= 4 && c.threshold > n) || b < 10 || mod < 0 {
+									Report("{SWEEP}\t\t").Printf("Skipping invalid combination %s n=%d x0=%d xi=%d i=%d b=%d moduli=%d\n", protoName, n, x0, xi, i, b, mod)
+									continue
+								}
+
+								for t := 0; t < trials; t++ {
+									if cfg.seed != 0 {
+										c.seed = cfg.seed + int64(t)
+									}
+									Report("{SWEEP}\t\t").Printf("%s n=%d x0=%d xi=%d i=%d b=%d moduli=%d trial %d/%d\n", protoName, n, x0, xi, i, b, mod, t+1, trials)
+									Blank()
+									res := RunTrial(c)
+									AppendSweepRow(out, &c, t, &res)
+									rows++
+								}
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+	Blank()
+	if rows == 0 {
+		Report("{SWEEP}\t\t").Printf("No valid combination, nothing written to %s\n", out)
+		return
+	}
+	Report("{SWEEP}\t\t").Printf("Results written to %s\n", out)
+}
+
+func AppendSweepRow(fname string, cfg *Config, trial int, res *TrialResult) {
+	sec := func(i int) string {
+		return strconv.FormatFloat(res.phases[i].Seconds(), 'f', 6, 64)
+	}
+	total := res.phases[0] + res.phases[1] + res.phases[2] + res.phases[3] + res.phases[4]
+
+	var compParties, commParties uint64
+	for _, c := range res.costs[1:] {
+		compParties += c.Computation()
+		commParties += c.Comm.Sent() + c.Comm.Received()
+	}
+
+	// Columns are separated by ";"
+	sum := ""
+	if cfg.proto%2 == 1 {
+		sums := make([]string, len(res.sum))
+		for j := range res.sum {
+			sums[j] = res.sum[j].Text(10)
+		}
+		sum = strings.Join(sums, ";")
+	}
+	trueSum := make([]string, len(res.trueSum))
+	for j := range res.trueSum {
+		trueSum[j] = strconv.Itoa(int(res.trueSum[j]))
+	}
+
+	row := []string{protoNames[cfg.proto], strconv.Itoa(cfg.nParties), strconv.Itoa(cfg.sizes[0]), strconv.Itoa(cfg.sizes[1]), strconv.Itoa(cfg.intCard), strconv.Itoa(cfg.nBits), strconv.Itoa(int(cfg.EGParams().nModuli)), strconv.Itoa(trial), strconv.FormatInt(res.seed, 10), sec(0), sec(1), sec(2), sec(3), sec(4), strconv.FormatFloat(total.Seconds(), 'f', 6, 64), strconv.FormatFloat(float64(res.memPeak)/1e6, 'f', 3, 64), strconv.Itoa(int(res.card)), strconv.Itoa(int(res.trueCard)), sum, strings.Join(trueSum, ";"), strconv.FormatUint(res.costs[0].Computation(), 10), strconv.FormatUint(compParties, 10), strconv.FormatUint(res.costs[0].Comm.Sent()+res.costs[0].Comm.Received(), 10), strconv.FormatUint(commParties, 10)}
+
+	file, err := os.OpenFile(fname, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	Panic(err)
+	stats, err := file.Stat()
+	Panic(err)
+	if stats.Size() == 0 {
+		WriteArray(file, []string{strings.Join(sweepHeader, ",")})
+	}
+	WriteArray(file, []string{strings.Join(row, ",")})
+	file.Close()
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// #############################################################################
+
+func (c SpanContext) IsValid() bool {
+	return c.TraceID != [16]byte{} && c.SpanID != [8]byte{}
+}
+
+func (c SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%x-%x-01", c.TraceID, c.SpanID)
+}
+
+func ParseTraceparent(s string) (SpanContext, error) {
+	var c SpanContext
+	parts := strings.Split(strings.TrimSpace(s), "-")
+	if len(parts) != 4 || parts[0] != "00" {
+		return c, fmt.Errorf("invalid traceparent %q", s)
+	}
+	t, err1 := hex.DecodeString(parts[1])
+	p, err2 := hex.DecodeString(parts[2])
+	if err1 != nil || err2 != nil || len(t) != 16 || len(p) != 8 {
+		return c, fmt.Errorf("invalid traceparent %q", s)
+	}
+	copy(c.TraceID[:], t)
+	copy(c.SpanID[:], p)
+	return c, nil
+}
+
+// #############################################################################
+
+func NewTracer(party int, protocol, session string) *Tracer {
+	return &Tracer{resource: [][2]interface{}{{"service.name", "mps_operations"}, {"party.id", party}, {"protocol", protocol}, {"session", session}}}
+}
+
+// Starts a span in the trace of parent, or in a new trace if parent is invalid
+func (t *Tracer) Start(name string, parent SpanContext) *Span {
+	if t == nil {
+		return nil
+	}
+	s := &Span{tracer: t, name: name, start: time.Now()}
+	if parent.IsValid() {
+		s.ctx.TraceID, s.parent = parent.TraceID, parent.SpanID
+	} else {
+		copy(s.ctx.TraceID[:], RandomBytes(16))
+	}
+	copy(s.ctx.SpanID[:], RandomBytes(8))
+	return s
+}
+
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.ctx
+}
+
+func (s *Span) SetAttr(key string, value interface{}) {
+	if s != nil {
+		s.attrs = append(s.attrs, [2]interface{}{key, value})
+	}
+}
+
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.end = time.Now()
+	s.tracer.mu.Lock()
+	s.tracer.spans = append(s.tracer.spans, s)
+	s.tracer.mu.Unlock()
+}
+
+// #############################################################################
+
+// Phase spans nest under the open span of the party, or else under the span
+// that produced the last message it received
+func (p *Party) StartSpan(name string) *Span {
+	parent := p.parent
+	if p.span != nil {
+		parent = p.span.Context()
+	}
+	s := p.tracer.Start(name, parent)
+	if s != nil {
+		s.SetAttr("party.id", p.id)
+		s.prev, p.span = p.span, s
+	}
+	return s
+}
+
+// Outgoing messages carry the context of the last top-level span
+func (p *Party) EndSpan(s *Span) {
+	if s == nil {
+		return
+	}
+	s.End()
+	p.span = s.prev
+	if p.span == nil {
+		p.last = s.Context()
+	}
+}
+
+// Nil when trace_file is not set
+func (cfg *Config) StartTracing(p *Party, session string) *Tracer {
+	if cfg.traceFile == "" {
+		return nil
+	}
+	p.tracer = NewTracer(p.id, protoNames[cfg.proto], session)
+	return p.tracer
+}
+
+func (cfg *Config) TracePath() string {
+	return path.Join(cfg.resDir, cfg.traceFile)
+}
+
+// The span context travels next to the message, in fpath.traceparent, which
+// is written before the message so it is there when the message appears
+func WriteTraceparent(fpath string, c SpanContext) {
+	if !c.IsValid() {
+		// Do not leave a stale context from an earlier run
+		_ = os.Remove(fpath + ".traceparent")
+		return
+	}
+	Panic(os.WriteFile(fpath+".traceparent", []byte(c.Traceparent()+"\n"), 0644))
+}
+
+// Zero if the sender was not tracing
+func ReadTraceparent(fpath string) SpanContext {
+	b, err := os.ReadFile(fpath + ".traceparent")
+	if err != nil {
+		return SpanContext{}
+	}
+	c, err := ParseTraceparent(string(b))
+	Panic(err)
+	return c
+}
+
+// WriteMessage, along with the context of the last span of p
+func (p *Party) SendMessage(fpath string, fn func(io.Writer)) uint64 {
+	WriteTraceparent(fpath, p.last)
+	return WriteMessage(fpath, fn)
+}
+
+// ReadMessage; the next spans of p follow the span that sent it
+func (p *Party) ReceiveMessage(fpath string, fn func(io.Reader)) uint64 {
+	n := ReadMessage(fpath, p.log, fn)
+	if c := ReadTraceparent(fpath); c.IsValid() {
+		p.parent = c
+	}
+	return n
+}
+
+// #############################################################################
+
+func otlpValue(v interface{}) map[string]interface{} {
+	switch x := v.(type) {
+	case int:
+		return map[string]interface{}{"intValue": strconv.Itoa(x)}
+	case uint:
+		return map[string]interface{}{"intValue": strconv.FormatUint(uint64(x), 10)}
+	case uint64:
+		return map[string]interface{}{"intValue": strconv.FormatUint(x, 10)}
+	case bool:
+		return map[string]interface{}{"boolValue": x}
+	default:
+		return map[string]interface{}{"stringValue": fmt.Sprint(x)}
+	}
+}
+
+func otlpAttrs(attrs [][2]interface{}) []map[string]interface{} {
+	ret := make([]map[string]interface{}, len(attrs))
+	for i, a := range attrs {
+		ret[i] = map[string]interface{}{"key": a[0], "value": otlpValue(a[1])}
+	}
+	return ret
+}
+
+// Appends the finished spans of tracers to fpath as one line of OTLP/JSON
+// (an ExportTraceServiceRequest), as written by the OpenTelemetry file exporter
+func ExportSpans(fpath string, tracers ...*Tracer) {
+	var resourceSpans []interface{}
+	for _, t := range tracers {
+		if t == nil {
+			continue
+		}
+		t.mu.Lock()
+		spans := make([]interface{}, len(t.spans))
+		for i, s := range t.spans {
+			span := map[string]interface{}{
+				"traceId":           hex.EncodeToString(s.ctx.TraceID[:]),
+				"spanId":            hex.EncodeToString(s.ctx.SpanID[:]),
+				"name":              s.name,
+				"kind":              1,
+				"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+				"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+				"attributes":        otlpAttrs(s.attrs),
+			}
+			if s.parent != [8]byte{} {
+				span["parentSpanId"] = hex.EncodeToString(s.parent[:])
+			}
+			spans[i] = span
+		}
+		t.spans = nil
+		t.mu.Unlock()
+
+		resourceSpans = append(resourceSpans, map[string]interface{}{
+			"resource":   map[string]interface{}{"attributes": otlpAttrs(t.resource)},
+			"scopeSpans": []interface{}{map[string]interface{}{"scope": map[string]interface{}{"name": "mps_operations"}, "spans": spans}},
+		})
+	}
+	if len(resourceSpans) == 0 {
+		return
+	}
+
+	line, err := json.Marshal(map[string]interface{}{"resourceSpans": resourceSpans})
+	Panic(err)
+	file, err := os.OpenFile(fpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	Panic(err)
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	Panic(err)
+}
+
+// #############################################################################
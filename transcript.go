@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/big"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// #############################################################################
+
+// Domain separator of label within the session sid
+func SessionTag(label string, sid []byte) string {
+	return label + ":" + hex.EncodeToString(sid)
+}
+
+// Fills in the default suite and DST
+func (s Session) Resolve() Session {
+	if s.Suite == "" {
+		s.Suite = h2cSuite
+	}
+	if s.DST == "" {
+		s.DST = dstPrefix + s.Suite
+	}
+	return s
+}
+
+// Hash-to-curve parameters of the session, on P-256 like the rest of the
+// protocol. Identifiers hash with the DST of the deployment, so that their
+// points can be cached across sessions, and the blinding scales them by the
+// session scalar.
+func (s Session) HashToCurve() (*HtoCParams, error) {
+	s = s.Resolve()
+	params, err := NewHtoCParams(s.Suite, s.DST)
+	if err != nil {
+		return nil, err
+	}
+	if params.curve != elliptic.P256() {
+		return nil, fmt.Errorf("hash-to-curve suite %s is not on P-256", s.Suite)
+	}
+	params.session = SessionScalar(s.ID, params.curve)
+	return params, nil
+}
+
+// Nonzero scalar of the session sid. The point of an identifier w in the
+// session is k H(w), which differs in every session.
+func SessionScalar(sid []byte, curve elliptic.Curve) *big.Int {
+	N := curve.Params().N
+	k := new(big.Int).SetBytes(BLAKE2B(sid, "H2CSession"))
+	k.Mod(k, new(big.Int).Sub(N, &one))
+	return k.Add(k, &one)
+}
+
+// s k mod N, for blinding the point H(w) of an identifier with s
+func (params *HtoCParams) Blind(s DHScalar) DHScalar {
+	ret := new(big.Int).Mul(s, params.session)
+	return ret.Mod(ret, params.curve.Params().N)
+}
+
+// Binds hashing, key derivation and the transcript of p to the session s
+func (p *Party) SetSession(s Session) {
+	var err error
+	p.h2c, err = s.HashToCurve()
+	Panic(err)
+
+	p.sid = s.ID
+	p.ctx.ecc.sid = s.ID
+	p.seen = make(map[int][]byte)
+}
+
+// #############################################################################
+
+// Digest of the message written by fn, within the session sid
+func MessageDigest(sid []byte, fn func(io.Writer)) []byte {
+	h, err := blake2b.New256(nil)
+	Panic(err)
+	_, err = h.Write([]byte(SessionTag("Transcript", sid)))
+	Panic(err)
+	fn(h)
+	return h.Sum(nil)
+}
+
+func (t Transcript) Hash(sid []byte) []byte {
+	return BLAKE2B(bytes.Join(t, nil), SessionTag("Transcript", sid))
+}
+
+func (t Transcript) Write(w io.Writer) {
+	writeAES(w, t)
+}
+
+func ReadTranscript(r io.Reader) Transcript {
+	return readAES(r)
+}
+
+// #############################################################################
+
+// Records message pos (M = 0, R_i = i, B = n, ct = n + 1) sent or received by p
+func (p *Party) Witness(pos int, digest []byte) {
+	p.seen[pos] = digest
+}
+
+// Digests of M, R_1, ..., R_{id-1}, to which the output of p is bound
+func (p *Party) InputTranscript(M, R *HashMapValues) Transcript {
+	p.Witness(0, MessageDigest(p.sid, M.Write))
+	if p.id == 1 {
+		return Transcript{p.seen[0]}
+	}
+	Assert(len(R.T) == p.id-1)
+	p.Witness(p.id-1, MessageDigest(p.sid, R.Write))
+	return append(append(Transcript{}, R.T...), p.seen[p.id-1])
+}
+
+// Refuses a transcript that leaves out or alters a message p has seen, or
+// that was not completed by cts
+func (p *Party) CheckTranscript(t Transcript, cts []EGCiphertext) error {
+	if len(t) != p.n+2 {
+		return fmt.Errorf("transcript has %d messages, want %d", len(t), p.n+2)
+	}
+	p.Witness(p.n+1, MessageDigest(p.sid, func(w io.Writer) { WriteCiphertexts(w, &p.ctx, cts) }))
+	for pos, digest := range p.seen {
+		if !bytes.Equal(t[pos], digest) {
+			return fmt.Errorf("message %d of the transcript differs from the one party %d saw", pos, p.id)
+		}
+	}
+	return nil
+}
+
+func (p *Party) writeSeen(w io.Writer) {
+	writeUint64(w, uint64(len(p.seen)))
+	for pos, digest := range p.seen {
+		writeUint64(w, uint64(pos))
+		writeBlob(w, digest)
+	}
+}
+
+func (p *Party) readSeen(r io.Reader) {
+	for n := readUint64(r); n > 0; n-- {
+		pos := int(readUint64(r))
+		p.Witness(pos, readBlob(r))
+	}
+}
+
+// #############################################################################
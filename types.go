@@ -2,11 +2,15 @@ package main
 
 import (
 	"crypto/elliptic"
-	"log"
+	"io"
+	"log/slog"
 	"math/big"
+	"math/rand"
+	"net/http"
+	"sync"
 	"time"
 
-	"github.com/fatih/color"
+	"golang.org/x/crypto/sha3"
 )
 
 // #############################################################################
@@ -14,19 +18,37 @@ import (
 type Party struct {
 	ctx          EGContext
 	agg_pk       DHElement
-	X            map[string]int
+	X            map[string][]int
 	id, n, nBits int
-	log          *log.Logger
+	log          *slog.Logger
+	logBase      *slog.Logger
 	partial_sk   *big.Int
 	h2c          *HtoCParams
-	log_color    color.Attribute
+	modified     uint64
+	comm         *CommStats
+	ops          *PhaseOps
+	metrics      *Metrics
+	tracer       *Tracer
+	showProgress bool
+	addValues    bool // add own values to the sums of MPSI-Sum and MPSIU-Sum
+	progress     *ProgressLine
+	ckpt         *Checkpoint
+	dp           *DPNoise
+	span         *Span       // innermost open span
+	parent, last SpanContext // spans that sent the last input and output
+	sid          []byte
+	seen         map[int][]byte // digests of the messages p sent or received
 }
 
 type Delegate struct {
-	party  Party
-	aesKey []byte
-	L      DHElement
-	alpha  DHScalar
+	party      Party
+	aesKey     []byte
+	L          DHElement
+	alpha      DHScalar
+	transcript Transcript
+	moments    bool // encrypt the squares of the values as extra columns
+	// Matched identifiers and their values, filled only when non-nil
+	intersection map[string][]int
 }
 
 // #############################################################################
@@ -34,8 +56,18 @@ type Delegate struct {
 type DHContext struct {
 	G     DHElement
 	Curve elliptic.Curve
+	ops   *OpCounts
+	sid   []byte // session the derived AES keys are bound to
 }
 
+// Operations performed through a DHContext, updated atomically by the workers
+type OpCounts struct {
+	ScalarMult, BaseMult, Add, HashToCurve, AEAD, BSGSSteps uint64
+}
+
+// Operation counts of a party in Init, Round 1, Round 2 and Round 3
+type PhaseOps [4]OpCounts
+
 type DHScalar *big.Int
 type DHElement struct {
 	x, y *big.Int
@@ -49,32 +81,51 @@ type EGContext struct {
 	nModuli uint
 }
 
+type DHPoint [33]byte
+
+type PointSlab struct {
+	data   []byte
+	stride int
+}
+
 type EGCiphertext struct {
 	c1, c2 []DHElement
 }
 
 type Ciphertext struct {
-	EG  EGCiphertext
+	EG  []byte
 	AES []byte
 }
 
 type HashMapValues struct {
-	EncData []Ciphertext
-	DHData  []HashMapValue
-	nBits   int
+	Q, S   PointSlab
+	EG     PointSlab
+	AES    [][]byte
+	nBits  int
+	T      Transcript // digests of the messages before R_i
+	Noise  []byte     // encrypted sum of the noise shares so far, one ciphertext per column
+	DQ, DS PointSlab  // dummy matches of the parties so far, with dp
 }
 
-type HashMapValue struct {
-	Q, S DHElement
+type HashMapFinal struct {
+	Q     PointSlab
+	AES   [][]byte
+	T     Transcript
+	lanes int // entries per slot, one for each t-subset of the parties in OT-MPSI
+	Noise []byte
 }
 
-type HashMapFinal struct {
-	Q   []DHElement
-	AES [][]byte
+// Parameters every party of a run agrees on at keygen
+type Session struct {
+	ID         []byte
+	Suite, DST string // hash-to-curve suite and DST, empty for the defaults
 }
 
+// Digests of the messages of a run, in order: M, R_1, ..., R_{n-1}, B, ct
+type Transcript [][]byte
+
 type Set struct {
-	data map[string]int
+	data map[string][]int
 }
 
 type ChanMsg struct {
@@ -93,12 +144,166 @@ type WorkerPool struct {
 	InChan  InputChannel
 	OutChan OutputChannel
 	nJobs   uint64
+	done    uint64 // jobs finished so far, updated atomically
+
+	progress ProgressFunc
+	interval time.Duration
+}
+
+// Reports done out of total jobs and the estimated time left
+type ProgressFunc func(done, total uint64, eta time.Duration)
+
+// Progress of a phase over all of its worker pools
+type ProgressLine struct {
+	label       string
+	total, base uint64 // jobs of the phase, jobs of its finished pools
+	start       time.Time
+}
+
+// Progress of a party, served in the OpenMetrics text format
+type Metrics struct {
+	party   int
+	comm    *CommStats
+	mu      sync.Mutex
+	phase   int
+	pool    *WorkerPool
+	slots   [4]uint64
+	elapsed [4]time.Duration
+	start   time.Time
+	server  *http.Server
+	Addr    string
+}
+
+// W3C trace context of a span, carried alongside messages as a traceparent
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+}
+
+type Span struct {
+	tracer     *Tracer
+	name       string
+	ctx        SpanContext
+	parent     [8]byte
+	start, end time.Time
+	attrs      [][2]interface{}
+	prev       *Span
+}
+
+// Collects the finished spans of one party until ExportSpans
+type Tracer struct {
+	mu       sync.Mutex
+	resource [][2]interface{}
+	spans    []*Span
+}
+
+// Results of the steps of a party, kept under checkpoint_dir/<session>/<id>
+// so that a restarted party resumes after the last finished step
+type Checkpoint struct {
+	dir   string
+	party *Party
 }
 
 type Stopwatch struct {
 	start time.Time
 }
 
+type Config struct {
+	proto, nParties, intCard, lim, nBits int
+	sizes                                []int
+	dataDir, resDir, keyDir, msgDir      string
+	seed                                 int64
+	nModuli                              uint // 0 sizes the moduli for the largest sum
+	eProfile                             bool
+	metricsPort                          int
+	logFormat, logLevel, session         string
+	traceFile                            string
+	progress                             bool
+	checkpointDir                        string
+	h2cCacheDir, h2cCacheSecret          string
+	suite, dst                           string // hash-to-curve suite and DST, empty for the defaults
+	threshold                            int    // parties that must hold an element in OT-MPSI
+	cols                                 int    // associated values per identifier
+	moments                              bool   // also sum the squares of the values
+	reveal                               bool   // the delegate learns the matched identifiers
+	partyValues                          bool   // also sum the values of the non-delegate parties
+	dp                                   string // noise mechanism of the outputs, empty for exact outputs
+	epsilon, delta                       float64
+	epsilonBudget, deltaBudget           float64
+	dpLedgerDir                          string
+}
+
+// Calibrated noise of the count and of each sum
+type DPNoise struct {
+	mech   string
+	shares int       // parties that add a share of each noise
+	count  float64   // scale of the count noise
+	shift  int       // dummy matches each party adds on average
+	sums   []float64 // scale of the noise of each sum
+	rng    *rand.Rand
+}
+
+// Sums below 2^maxBits of at most 2^countBits terms decrypt
+type EGParams struct {
+	nModuli, maxBits, countBits uint
+}
+
+// Bytes sent and received in Setup, Round 1 and Round 3 (Round 2 is local)
+type CommStats struct {
+	sent, recv [3]uint64
+}
+
+type PartyCost struct {
+	Ops  PhaseOps
+	Comm CommStats
+}
+
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+type TrialResult struct {
+	seed           int64
+	card, trueCard float64
+	sum            []big.Int // one per column, then one sum of squares per column with moments
+	trueSum        []float64
+	times          []time.Duration
+	phases         [5]time.Duration
+	costs          []PartyCost
+	memPeak        uint64
+}
+
+type MemoryPeak struct {
+	peak uint64
+	stop chan bool
+	done chan bool
+}
+
+// #############################################################################
+
+type PairOverlap struct {
+	A, B int
+	Frac float64
+}
+
+type WorkloadParams struct {
+	Sizes    []int
+	IntCard  int
+	Lim      int
+	IDs      string
+	Values   string
+	ZipfS    float64
+	SpreadS  float64
+	Overlaps []PairOverlap
+	Cols     int
+}
+
 // #############################################################################
 
 type HashFunction func([]byte) []byte
@@ -109,13 +314,34 @@ type HtoCParams struct {
 	k, m, L, h int
 	H          HashFunction
 	b, s       int
+	xof        func() sha3.ShakeHash // expand_message_xof instead of _xmd if set
+	curve      elliptic.Curve
+	RO         bool // hash_to_curve, or encode_to_curve
+	suite      string
+	session    *big.Int // scalar of the session, applied by the blinding
+	cache      *H2CCache
+}
+
+// Hash-to-curve outputs reused across the sessions of a deployment, with the
+// same suite and DST
+type H2CCache struct {
+	path         string
+	key, tag     []byte
+	points       map[string][]byte // x || y of each identifier, as loaded
+	used         sync.Map          // points looked up or added since Load
+	hits, misses uint64
+	log          *slog.Logger
 }
 
+// Elements of the P-256 base field in Montgomery form (x * 2^256 mod p), as
+// little-endian 64-bit limbs. All operations on them run in constant time.
+type p256Element [4]uint64
+
 // #############################################################################
 
 type BlindInput struct {
 	w string
-	v int
+	v []int
 }
 
 type H2CInput string
@@ -124,26 +350,39 @@ type RandomizeInput struct{}
 
 type HashAndReduceInput struct {
 	w string
-	P DHElement
+	P []byte
 }
 
 type MPSIReduceInput struct {
 	w            string
-	Rj0, Rj1, Mj DHElement
+	Rj0, Rj1, Mj []byte
 }
 
 type ReduceInput struct {
-	H, P DHElement
+	H, P []byte
+}
+
+// The job in of a slot, whose ciphertexts EG are then increased by v (nil for
+// zeros)
+type AddValuesInput struct {
+	in interface{}
+	EG []byte
+	v  []int
 }
 
 type EncryptInput struct {
-	ct *Ciphertext
-	S  *DHElement
+	EG, AES []byte
+	S       []byte
+}
+
+type CombineInput struct {
+	Q, S    []byte // the lanes of all parties
+	EG, AES []byte
 }
 
 type UnblindInput struct {
 	AES []byte
-	Q   DHElement
+	Q   []byte
 }
 
 type BlindCtxInt struct {
@@ -154,11 +393,13 @@ type BlindCtxInt struct {
 }
 
 type BlindCtxSum struct {
-	pk    DHElement
-	ctx   *EGContext
-	alpha DHScalar
-	sk    DHScalar
-	h2c   *HtoCParams
+	pk      DHElement
+	ctx     *EGContext
+	alpha   DHScalar
+	sk      DHScalar
+	h2c     *HtoCParams
+	cols    int // ciphertexts per slot
+	moments bool
 }
 
 type H2CCtx elliptic.Curve
@@ -175,15 +416,32 @@ type EncryptCtx struct {
 	apk *DHElement
 }
 
+type AddValuesCtx struct {
+	dh  DHCtx
+	ctx *EGContext
+	apk *DHElement
+}
+
+type CombineCtx struct {
+	ctx     *EGContext
+	apk     *DHElement
+	subsets [][]int
+}
+
 type H2COutput DHElement
 
 type DHOutput struct {
 	Ct   Ciphertext
-	Q, S DHElement
+	Q, S DHPoint
 }
 
 type EncryptOutput []byte
 
+type CombineOutput struct {
+	Q   []DHPoint
+	AES [][]byte
+}
+
 type UnblindOutput int
 
 // #############################################################################
@@ -4,13 +4,16 @@ import (
 	"bufio"
 	crand "crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
 	"math/big"
 	"math/rand"
 	"os"
 	"path"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -23,8 +26,9 @@ import (
 
 // #############################################################################
 
-func GetIndex(key string, nBits int) uint64 {
-	return HashPrefix([]byte(key), nBits)
+// Slot of key in a map of 2^nBits slots, within the session sid
+func GetIndex(key string, nBits int, sid []byte) uint64 {
+	return HashPrefix([]byte(key), nBits, sid)
 }
 
 func GetBitMap(sz uint64) *roaring64.Bitmap {
@@ -36,8 +40,26 @@ func GetBitMap(sz uint64) *roaring64.Bitmap {
 // #############################################################################
 
 func NewHashMap(nBits int) HashMapValues {
-	m := 1 << nBits
-	return HashMapValues{make([]Ciphertext, m), make([]HashMapValue, m), nBits}
+	m := uint64(1) << nBits
+	return HashMapValues{Q: NewPointSlab(m, len(DHPoint{})), S: NewPointSlab(m, len(DHPoint{})), nBits: nBits}
+}
+
+// R of OT-MPSI carries a Q and an S lane for each of the parties
+func NewLaneHashMap(nBits, lanes int) HashMapValues {
+	m := uint64(1) << nBits
+	return HashMapValues{Q: NewPointSlab(m, lanes*len(DHPoint{})), S: NewPointSlab(m, lanes*len(DHPoint{})), nBits: nBits}
+}
+
+// Delegate's map M only carries S and one ciphertext (EG or AES) per slot
+func NewDelegateHashMap(nBits int, egStride int) HashMapValues {
+	m := uint64(1) << nBits
+	M := HashMapValues{S: NewPointSlab(m, len(DHPoint{})), nBits: nBits}
+	if egStride > 0 {
+		M.EG = NewPointSlab(m, egStride)
+	} else {
+		M.AES = make([][]byte, m)
+	}
+	return M
 }
 
 func (m *HashMapValues) Size() uint64 {
@@ -46,6 +68,42 @@ func (m *HashMapValues) Size() uint64 {
 
 // #############################################################################
 
+func NewPointSlab(n uint64, stride int) PointSlab {
+	return PointSlab{make([]byte, n*uint64(stride)), stride}
+}
+
+func (s *PointSlab) Len() uint64 {
+	if s.stride == 0 {
+		return 0
+	}
+	return uint64(len(s.data) / s.stride)
+}
+
+// Returns the i-th entry; the slice aliases the slab
+func (s *PointSlab) At(i uint64) []byte {
+	start := i * uint64(s.stride)
+	return s.data[start : start+uint64(s.stride) : start+uint64(s.stride)]
+}
+
+func (s *PointSlab) Set(i uint64, b []byte) {
+	Assert(len(b) == s.stride)
+	copy(s.At(i), b)
+}
+
+// Sets the lane-th point of entry i, in a slab of several points per entry
+func (s *PointSlab) SetLane(i uint64, lane int, b []byte) {
+	copy(s.At(i)[lane*len(b):(lane+1)*len(b)], b)
+}
+
+func (s *PointSlab) Swap(i, j uint64) {
+	a, b := s.At(i), s.At(j)
+	for k := range a {
+		a[k], b[k] = b[k], a[k]
+	}
+}
+
+// #############################################################################
+
 func BLAKE2S(msg []byte, domainSep string) []byte {
 	h := blake2s.Sum256(append([]byte(domainSep), msg...))
 	return []byte(h[:])
@@ -56,14 +114,13 @@ func BLAKE2B(msg []byte, domainSep string) []byte {
 	return []byte(h[:])
 }
 
-func AES_KDF(msg []byte) []byte {
-	h := blake2b.Sum256(msg)
-	return []byte(h[:])
+func AES_KDF(msg, sid []byte) []byte {
+	return BLAKE2B(msg, SessionTag("AES_KDF", sid))
 }
 
-func HashPrefix(msg []byte, sz int) uint64 {
+func HashPrefix(msg []byte, sz int, sid []byte) uint64 {
 	Assert(sz < 64)
-	h := BLAKE2S(msg, "HashPrefix")
+	h := BLAKE2S(msg, SessionTag("HashPrefix", sid))
 	mask := (uint64(1) << uint64(sz)) - uint64(1)
 	return binary.BigEndian.Uint64(h) & mask
 }
@@ -80,8 +137,9 @@ func RandomPrime(n int) *big.Int {
 	return p
 }
 
+var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ!@#$%^&*(1234567890")
+
 func RandomString(n int) string {
-	var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ!@#$%^&*(1234567890")
 	b := make([]rune, n)
 	for i := range b {
 		b[i] = letterRunes[rand.Intn(len(letterRunes))]
@@ -89,10 +147,19 @@ func RandomString(n int) string {
 	return string(b)
 }
 
+func RandomStringFrom(rng *rand.Rand, n int) string {
+	b := make([]rune, n)
+	for i := range b {
+		b[i] = letterRunes[rng.Intn(len(letterRunes))]
+	}
+	return string(b)
+}
+
 // #############################################################################
 
-func ReadFile(fpath string) map[string]int {
-	ret := make(map[string]int)
+// One identifier per line, followed by its tab-separated values
+func ReadFile(fpath string) map[string][]int {
+	ret := make(map[string][]int)
 	file, err := os.Open(fpath)
 	Panic(err)
 	defer file.Close()
@@ -101,30 +168,73 @@ func ReadFile(fpath string) map[string]int {
 	for scanner.Scan() {
 		arr := strings.Split(scanner.Text(), "\t")
 		w := arr[0]
-		v, err := strconv.Atoi(arr[1])
-		Panic(err)
+		v := make([]int, len(arr)-1)
+		for j := range v {
+			var err error
+			v[j], err = strconv.Atoi(arr[j+1])
+			Panic(err)
+		}
 		ret[w] = v
 	}
 	Panic(scanner.Err())
 	return ret
 }
 
-func WriteFile(fpath string, strs map[string]int) {
+func WriteFile(fpath string, strs map[string][]int) {
 	os.Remove(fpath)
 	file, err := os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY, 0644)
 	Panic(err)
 	WriteMap(file, strs)
 }
 
-func WriteMap(file *os.File, strs map[string]int) {
+func WriteMap(file *os.File, strs map[string][]int) {
 	datawriter := bufio.NewWriter(file)
-	for k, v := range strs {
-		_, _ = datawriter.WriteString(k + "\t" + strconv.Itoa(v) + "\n")
+	for _, k := range SortedKeys(strs) {
+		_, _ = datawriter.WriteString(k + "\t" + JoinInts(strs[k], "\t") + "\n")
 	}
 	datawriter.Flush()
 	file.Close()
 }
 
+// The result file of the delegate, whose sums may not fit an int
+func ReadResult(fpath string) map[string][]*big.Int {
+	ret := make(map[string][]*big.Int)
+	file, err := os.Open(fpath)
+	Panic(err)
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		arr := strings.Split(scanner.Text(), "\t")
+		v := make([]*big.Int, len(arr)-1)
+		for j := range v {
+			var ok bool
+			v[j], ok = new(big.Int).SetString(arr[j+1], 10)
+			Assert(ok)
+		}
+		ret[arr[0]] = v
+	}
+	Panic(scanner.Err())
+	return ret
+}
+
+func WriteResult(fpath string, result map[string][]*big.Int) {
+	strs := make([]string, 0, len(result))
+	for k, vs := range result {
+		line := k
+		for _, v := range vs {
+			line += "\t" + v.Text(10)
+		}
+		strs = append(strs, line)
+	}
+	sort.Strings(strs)
+	os.Remove(fpath)
+	file, err := os.OpenFile(fpath, os.O_CREATE|os.O_WRONLY, 0644)
+	Panic(err)
+	WriteArray(file, strs)
+	file.Close()
+}
+
 func WriteArray(file *os.File, strs []string) {
 	datawriter := bufio.NewWriter(file)
 	for _, data := range strs {
@@ -139,22 +249,49 @@ func AppendFile(fpath string, strs []string) {
 	stats, err := file.Stat()
 	Panic(err)
 	if stats.Size() == 0 {
-		WriteArray(file, []string{strings.Join([]string{"protocol", "n", "x0", "xi", "b", "i", "i_computed", "init_*", "DelegateStart", "protocol_*", "DelegateFinish"}, ",")})
+		WriteArray(file, []string{strings.Join([]string{"protocol", "n", "x0", "xi", "b", "l", "seed", "i", "i_computed", "sent_*", "recv_*", "init_*", "DelegateStart", "protocol_*", "DelegateFinish", "JointDecryption"}, ",")})
 	}
 	WriteArray(file, strs)
 	file.Close()
 }
 
+// One hex-encoded value per line
+func WriteHex(fpath string, vals ...[]byte) {
+	strs := make([]string, len(vals))
+	for i, v := range vals {
+		strs[i] = hex.EncodeToString(v)
+	}
+	Panic(os.WriteFile(fpath, []byte(strings.Join(strs, "\n")+"\n"), 0600))
+}
+
+func ReadHex(fpath string) [][]byte {
+	b, err := os.ReadFile(fpath)
+	Panic(err)
+	var ret [][]byte
+	for _, line := range strings.Fields(string(b)) {
+		v, err := hex.DecodeString(line)
+		Panic(err)
+		ret = append(ret, v)
+	}
+	return ret
+}
+
 // #############################################################################
 
 type SampleData struct {
-	X_ADs   []map[string]int
+	X_ADs   []map[string][]int
 	dataDir string
+	Seed    int64
+	rng     *rand.Rand
 }
 
-func NewSampleData(nParties, N0, Ni, intCard, lim int, dataDir string, read, mpsi bool) *SampleData {
+// The same seed and parameters always produce the same data; seed 0 picks a
+// fresh seed, which is recorded in data.Seed.
+// sizes[i] is |X_i|, with sizes[0] the delegate's set, and each identifier
+// has cols associated values
+func NewSampleData(sizes []int, intCard, lim, cols int, dataDir string, read, mpsi bool, seed int64) *SampleData {
 	var data SampleData
-	data.X_ADs = make([]map[string]int, nParties)
+	data.X_ADs = make([]map[string][]int, len(sizes))
 	data.dataDir = dataDir
 
 	if read {
@@ -162,13 +299,14 @@ func NewSampleData(nParties, N0, Ni, intCard, lim int, dataDir string, read, mps
 		return &data
 	}
 
-	rand.Seed(time.Now().Unix())
+	data.SetSeed(seed)
 
 	if mpsi {
-		data.GenerateI(N0, Ni, intCard, lim)
+		data.GenerateI(sizes, intCard, lim)
 	} else {
-		data.GenerateIU(N0, Ni, intCard, lim)
+		data.GenerateIU(sizes, intCard, lim)
 	}
+	data.AddColumns(cols, func() int { return data.rng.Intn(lim) })
 
 	data.Write()
 	data.Read()
@@ -176,32 +314,80 @@ func NewSampleData(nParties, N0, Ni, intCard, lim int, dataDir string, read, mps
 	return &data
 }
 
-func (d *SampleData) GenerateI(N0, Ni, intCard, lim int) {
+func NewWorkloadData(p *WorkloadParams, dataDir string, mpsi bool, seed int64) *SampleData {
+	var data SampleData
+	data.X_ADs = make([]map[string][]int, len(p.Sizes))
+	data.dataDir = dataDir
+	data.SetSeed(seed)
+
+	if mpsi {
+		data.GenerateWorkloadI(p)
+	} else {
+		data.GenerateWorkloadIU(p)
+	}
+
+	data.Write()
+	data.Read()
+
+	return &data
+}
+
+func (d *SampleData) SetSeed(seed int64) {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	d.Seed = seed
+	d.rng = rand.New(rand.NewSource(seed))
+}
+
+// Appends values to every identifier until it has cols. They are drawn after
+// the data is generated, so a seed yields the same first column for any cols.
+func (d *SampleData) AddColumns(cols int, newValue func() int) {
+	if cols <= 1 {
+		return
+	}
+	all := make(map[string][]int)
+	for _, X := range d.X_ADs {
+		for w, v := range X {
+			all[w] = v
+		}
+	}
+	for _, w := range SortedKeys(all) {
+		v := append([]int{}, all[w]...)
+		for len(v) < cols {
+			v = append(v, newValue())
+		}
+		all[w] = v
+	}
+	for _, X := range d.X_ADs {
+		for w := range X {
+			X[w] = all[w]
+		}
+	}
+}
+
+func (d *SampleData) GenerateI(sizes []int, intCard, lim int) {
 	nParties := len(d.X_ADs)
 	sets := make([]Set, nParties)
 	var I, U Set
-	I.SetRandomN(intCard, 12, lim)
-	U.SetRandomN(Ni*nParties*2, 12, lim)
+	I.SetRandomN(d.rng, intCard, 12, lim)
+	U.SetRandomN(d.rng, 2*SumSizes(sizes), 12, lim)
 	intersection := I.Serialize()
 	for i := 0; i < nParties; i++ {
 		sets[i] = *NewSet(intersection)
 	}
-	Ucount := U.Clone()
-	for w := range Ucount.data {
-		Ucount.data[w] = 0
-	}
+	Ucount := make(map[string]int)
+	Ukeys := SortedKeys(U.data)
 
 	for i := 0; i < nParties; i++ {
-		rem := N0
-		if i > 0 {
-			rem = Ni
-		}
+		rem := sizes[i]
+		Assert(rem >= intCard)
 		for sets[i].Size() < rem {
-			w := Ucount.GetRandom()
-			v := Ucount.data[w]
+			w := Ukeys[d.rng.Intn(len(Ukeys))]
+			v := Ucount[w]
 			if v < nParties-1 && !sets[i].Contains(w) {
 				sets[i].Add(w, U.data[w])
-				Ucount.data[w] = v + 1
+				Ucount[w] = v + 1
 			}
 		}
 		d.X_ADs[i] = sets[i].Serialize()
@@ -216,47 +402,52 @@ func (d *SampleData) GenerateI(N0, Ni, intCard, lim int) {
 	Assert(inter.Size() == intCard)
 }
 
-func (d *SampleData) GenerateIU(N0, Ni, intCard, lim int) {
+func (d *SampleData) GenerateIU(sizes []int, intCard, lim int) {
 	nParties := len(d.X_ADs)
 	sets := make([]Set, nParties)
 
 	var I, U1, U2 Set
-	I.SetRandomN(intCard, 12, lim)
-	U1.SetRandomN(N0-intCard, 12, lim)
-	U2.SetRandomN(Ni*nParties*2, 12, lim)
+	I.SetRandomN(d.rng, intCard, 12, lim)
+	U1.SetRandomN(d.rng, sizes[0]-intCard, 12, lim)
+	U2.SetRandomN(d.rng, 2*SumSizes(sizes[1:]), 12, lim)
 
 	intersection := I.Serialize()
 	sets[0] = *NewSet(intersection)
 	sets[0] = *sets[0].Union(&U1)
 	d.X_ADs[0] = sets[0].Serialize()
-	Assert(len(d.X_ADs[0]) == N0)
+	Assert(len(d.X_ADs[0]) == sizes[0])
 
 	for i := 1; i < nParties; i++ {
-		sets[i] = *NewSet(map[string]int{})
+		sets[i] = *NewSet(map[string][]int{})
 	}
 
-	for w, v := range intersection {
-		num := rand.Intn(nParties-1) + 1
-		j := 0
-		for j < num {
-			idx := rand.Intn(nParties-1) + 1
-			if !sets[idx].Contains(w) {
-				sets[idx].Add(w, v)
-				j++
+	// Each w in I goes to a random non-empty subset of the parties with room
+	for _, w := range SortedKeys(intersection) {
+		v := intersection[w]
+		var open []int
+		for i := 1; i < nParties; i++ {
+			if sets[i].Size() < sizes[i] {
+				open = append(open, i)
 			}
 		}
+		Assert(len(open) > 0)
+		num := d.rng.Intn(len(open)) + 1
+		for _, j := range d.rng.Perm(len(open))[:num] {
+			sets[open[j]].Add(w, v)
+		}
 	}
 
 	Uarr := U2.Clone()
+	Ukeys := SortedKeys(Uarr.data)
 	for i := 1; i < nParties; i++ {
-		for sets[i].Size() < Ni {
-			w := Uarr.GetRandom()
+		for sets[i].Size() < sizes[i] {
+			w := Ukeys[d.rng.Intn(len(Ukeys))]
 			if !sets[i].Contains(w) {
 				sets[i].Add(w, Uarr.data[w])
 			}
 		}
 		d.X_ADs[i] = sets[i].Serialize()
-		Assert(len(d.X_ADs[i]) == Ni)
+		Assert(len(d.X_ADs[i]) == sizes[i])
 	}
 
 	union := &sets[1]
@@ -280,8 +471,8 @@ func (d *SampleData) Read() {
 	}
 }
 
-func (d *SampleData) ComputeStats(mpsi bool) []float64 {
-	ret := Cardinality(d.X_ADs, mpsi)
+func (d *SampleData) ComputeStats(t int, all bool) []float64 {
+	ret := Cardinality(d.X_ADs, t, all)
 	retFl := make([]float64, len(ret))
 	for i, v := range ret {
 		retFl[i] = float64(v)
@@ -306,9 +497,9 @@ func Panic(err error) {
 
 // #############################################################################
 
-func Timer(start time.Time, log *log.Logger, text string) {
+func Timer(start time.Time, logger *slog.Logger, text string) {
 	elapsed := time.Since(start)
-	log.Printf("%s took %s", text, elapsed)
+	logger.Info(fmt.Sprintf("%s took %s", text, elapsed), "op", text, "elapsed", elapsed)
 }
 
 func (w *Stopwatch) Reset() {
@@ -318,11 +509,43 @@ func (w *Stopwatch) Elapsed() time.Duration {
 	return time.Since(w.start)
 }
 
+// Samples the heap every 50ms; Stop returns the largest HeapAlloc seen
+func (m *MemoryPeak) Start() {
+	m.peak = 0
+	m.stop = make(chan bool)
+	m.done = make(chan bool)
+	runtime.GC()
+
+	go func() {
+		var stats runtime.MemStats
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			runtime.ReadMemStats(&stats)
+			if stats.HeapAlloc > m.peak {
+				m.peak = stats.HeapAlloc
+			}
+			select {
+			case <-m.stop:
+				close(m.done)
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (m *MemoryPeak) Stop() uint64 {
+	close(m.stop)
+	<-m.done
+	return m.peak
+}
+
 // #############################################################################
 
-func NewSet(strs map[string]int) *Set {
+func NewSet(strs map[string][]int) *Set {
 	var set Set
-	set.data = make(map[string]int)
+	set.data = make(map[string][]int)
 	for w, v := range strs {
 		set.data[w] = v
 	}
@@ -337,7 +560,7 @@ func (s *Set) Size() int {
 	return len(s.data)
 }
 
-func (s *Set) Add(w string, v int) {
+func (s *Set) Add(w string, v []int) {
 	s.data[w] = v
 }
 
@@ -350,20 +573,41 @@ func (s *Set) Contains(w string) bool {
 	return ok
 }
 
+// Keeps the values of s, which other parties may hold different values for
 func (s *Set) Intersection(r *Set) *Set {
-	i := make(map[string]int)
-	for w, v := range r.data {
-		vPrime, ok := s.data[w]
-		if ok {
-			Assert(v == vPrime)
-			i[w] = v
+	// Iterate over the smaller set
+	small, large := r, s
+	if s.Size() < r.Size() {
+		small, large = s, r
+	}
+	i := make(map[string][]int)
+	for w := range small.data {
+		if large.Contains(w) {
+			i[w] = s.data[w]
 		}
 	}
 	return &Set{i}
 }
 
+// Adds to the values of each identifier those of the sets that hold it
+func (s *Set) AddValues(others []Set) *Set {
+	ret := make(map[string][]int)
+	for w, v := range s.data {
+		sum := append([]int{}, v...)
+		for i := range others {
+			if u, ok := others[i].data[w]; ok {
+				for j := range sum {
+					sum[j] += u[j]
+				}
+			}
+		}
+		ret[w] = sum
+	}
+	return &Set{ret}
+}
+
 func (s *Set) Union(r *Set) *Set {
-	u := make(map[string]int)
+	u := make(map[string][]int)
 	for w, v := range s.data {
 		u[w] = v
 	}
@@ -374,7 +618,7 @@ func (s *Set) Union(r *Set) *Set {
 }
 
 func (s *Set) Difference(r *Set) *Set {
-	u := make(map[string]int)
+	u := make(map[string][]int)
 	for w, v := range s.data {
 		u[w] = v
 	}
@@ -384,67 +628,193 @@ func (s *Set) Difference(r *Set) *Set {
 	return &Set{u}
 }
 
-func (s *Set) SetRandomN(n int, strl, lim int) {
-	s.data = make(map[string]int)
+func (s *Set) SetRandomN(rng *rand.Rand, n int, strl, lim int) {
+	s.data = make(map[string][]int)
 	for len(s.data) < n {
-		t := RandomString(strl)
+		t := RandomStringFrom(rng, strl)
 		_, ok := s.data[t]
 		if !ok {
-			s.data[t] = rand.Int() % lim
+			s.data[t] = []int{rng.Intn(lim)}
 		}
 	}
 }
 
-func (s *Set) GetRandom() string {
-	for w := range s.data {
-		return w
+// Map iteration order is random, so generators walk keys in sorted order
+func SortedKeys(m map[string][]int) []string {
+	keys := make([]string, 0, len(m))
+	for w := range m {
+		keys = append(keys, w)
 	}
-	return ""
+	sort.Strings(keys)
+	return keys
 }
 
-func (s *Set) Serialize() map[string]int {
-	ret := make(map[string]int)
+func (s *Set) Serialize() map[string][]int {
+	ret := make(map[string][]int)
 	for w, v := range s.data {
 		ret[w] = v
 	}
 	return ret
 }
 
-func (s *Set) ADSum() int {
-	sum := 0
+// Sum of each of the cols columns of associated values
+func (s *Set) ADSum(cols int) []int {
+	sum := make([]int, cols)
 	for _, v := range s.data {
 		// fmt.Println(w, "=>", v)
-		sum += v
+		for j := range sum {
+			sum[j] += v[j]
+		}
 	}
 	return sum
 }
 
+// Sum of squares of each of the cols columns of associated values
+func (s *Set) ADSumSquares(cols int) []int {
+	sum := make([]int, cols)
+	for _, v := range s.data {
+		for j := range sum {
+			sum[j] += v[j] * v[j]
+		}
+	}
+	return sum
+}
+
+// Population variance of count values from their sum and sum of squares
+func Variance(count, sum, sumSq float64) float64 {
+	mean := sum / count
+	return sumSq/count - mean*mean
+}
+
+// Number of associated values per identifier of X, 1 if X is empty
+func Columns(X map[string][]int) int {
+	for _, v := range X {
+		return len(v)
+	}
+	return 1
+}
+
+func EqualInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func FormatFloats(v []float64, sep string) string {
+	strs := make([]string, len(v))
+	for i := range v {
+		strs[i] = strconv.Itoa(int(v[i]))
+	}
+	return strings.Join(strs, sep)
+}
+
+func JoinInts(v []int, sep string) string {
+	strs := make([]string, len(v))
+	for i := range v {
+		strs[i] = strconv.Itoa(v[i])
+	}
+	return strings.Join(strs, sep)
+}
+
 // #############################################################################
 
-func Cardinality(X_ADs []map[string]int, mpsi bool) []int {
+// Count, sum of each column and sum of squares of each column of the elements
+// of X_0 held by at least t of the other parties: t = n for MPSI and t = 1 for
+// MPSIU. With all, the values of the other parties that hold an element are
+// added to those of X_0.
+func Cardinality(X_ADs []map[string][]int, t int, all bool) []int {
 	nParties := len(X_ADs)
+	cols := Columns(X_ADs[0])
 	sets := make([]Set, nParties)
 	for i := 0; i < nParties; i++ {
 		sets[i] = *NewSet(X_ADs[i])
 	}
+	Assert(t >= 1 && t <= nParties-1)
 
-	if mpsi {
-		inter := &sets[0]
-		for i := 1; i < nParties; i++ {
-			inter = inter.Intersection(&sets[i])
+	var matched *Set
+	if t == nParties-1 {
+		// Intersect smallest sets first so intermediate results stay small
+		order := make([]int, nParties-1)
+		for i := range order {
+			order[i] = i + 1
 		}
-		for w := range inter.data {
+		sort.Slice(order, func(a, b int) bool { return sets[order[a]].Size() < sets[order[b]].Size() })
+
+		matched = &sets[0]
+		for _, i := range order {
+			matched = matched.Intersection(&sets[i])
+		}
+		for w := range matched.data {
 			Assert(sets[0].Contains(w))
 		}
-		return []int{inter.Size(), inter.ADSum()}
-	} else {
+	} else if t == 1 {
 		union := &sets[1]
 		for i := 2; i < nParties; i++ {
 			union = union.Union(&sets[i])
 		}
-		union = sets[0].Intersection(union)
-		return []int{union.Size(), union.ADSum()}
+		matched = sets[0].Intersection(union)
+	} else {
+		matched = NewSet(map[string][]int{})
+		for w, v := range sets[0].data {
+			held := 0
+			for i := 1; i < nParties; i++ {
+				if sets[i].Contains(w) {
+					held++
+				}
+			}
+			if held >= t {
+				matched.Add(w, v)
+			}
+		}
+	}
+
+	if all {
+		matched = matched.AddValues(sets[1:])
+	}
+	return append(append([]int{matched.Size()}, matched.ADSum(cols)...), matched.ADSumSquares(cols)...)
+}
+
+// All t-subsets of {0, ..., n-1}, in lexicographic order
+func Subsets(n, t int) [][]int {
+	var ret [][]int
+	C := make([]int, t)
+	var rec func(i, start int)
+	rec = func(i, start int) {
+		if i == t {
+			ret = append(ret, append([]int{}, C...))
+			return
+		}
+		for j := start; j <= n-t+i; j++ {
+			C[i] = j
+			rec(i+1, j+1)
+		}
+	}
+	rec(0, 0)
+	return ret
+}
+
+func SumSizes(sizes []int) int {
+	sum := 0
+	for _, sz := range sizes {
+		sum += sz
+	}
+	return sum
+}
+
+// |X_0| = N0 and |X_i| = Ni for 1 <= i <= nParties
+func UniformSizes(nParties, N0, Ni int) []int {
+	sizes := make([]int, nParties+1)
+	sizes[0] = N0
+	for i := 1; i <= nParties; i++ {
+		sizes[i] = Ni
 	}
+	return sizes
 }
 
 // #############################################################################
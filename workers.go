@@ -15,10 +15,21 @@ func BlindEGWorker(a WorkerCtx, b interface{}) interface{} {
 	arg, ok := b.(BlindInput)
 	Assert(ok)
 
-	HashToCurve_13(arg.w, &h, ctx.ctx.ecc.Curve, ctx.h2c)
-	ctx.ctx.ecc.EC_Multiply(ctx.alpha, h, &output.S)
-	m.SetInt64(int64(arg.v))
-	ctx.ctx.EG_Encrypt(&ctx.pk, &m, &output.Ct.EG)
+	// With moments, the squares follow the values
+	var S DHElement
+	cts := make([]EGCiphertext, ctx.cols)
+	ctx.ctx.ecc.EC_HashToCurve(arg.w, ctx.h2c, &h)
+	ctx.ctx.ecc.EC_Multiply(ctx.h2c.Blind(ctx.alpha), h, &S)
+	for j := range arg.v {
+		m.SetInt64(int64(arg.v[j]))
+		ctx.ctx.EG_Encrypt(&ctx.pk, &m, &cts[j])
+		if ctx.moments {
+			m.Mul(&m, &m)
+			ctx.ctx.EG_Encrypt(&ctx.pk, &m, &cts[len(arg.v)+j])
+		}
+	}
+	output.S = S.Compress()
+	output.Ct.EG = ctx.ctx.EG_SerializeAll(cts)
 	return output
 }
 
@@ -30,9 +41,11 @@ func BlindAESWorker(a WorkerCtx, b interface{}) interface{} {
 	arg, ok := b.(BlindInput)
 	Assert(ok)
 
-	HashToCurve_13(arg.w, &h, ctx.ctx.Curve, ctx.h2c)
-	ctx.ctx.EC_Multiply(ctx.alpha, h, &output.S)
-	output.Ct.AES = AEAD_Encrypt([]byte(arg.w), ctx.sk)
+	var S DHElement
+	ctx.ctx.EC_HashToCurve(arg.w, ctx.h2c, &h)
+	ctx.ctx.EC_Multiply(ctx.h2c.Blind(ctx.alpha), h, &S)
+	output.S = S.Compress()
+	output.Ct.AES = ctx.ctx.AEAD_Encrypt([]byte(arg.w), ctx.sk)
 	return output
 }
 
@@ -40,8 +53,10 @@ func RandomizeWorker(a WorkerCtx, b interface{}) interface{} {
 	ctx, ok := a.(DHCtx)
 	Assert(ok)
 	var output DHOutput
-	ctx.ctx.RandomElement(&output.Q)
-	ctx.ctx.RandomElement(&output.S)
+	var Q, S DHElement
+	ctx.ctx.RandomElement(&Q)
+	ctx.ctx.RandomElement(&S)
+	output.Q, output.S = Q.Compress(), S.Compress()
 	return output
 }
 
@@ -49,8 +64,14 @@ func RandomizeEGDelegateWorker(a WorkerCtx, b interface{}) interface{} {
 	ctx, ok := a.(BlindCtxSum)
 	Assert(ok)
 	var output DHOutput
-	ctx.ctx.ecc.RandomElement(&output.S)
-	ctx.ctx.EG_EncryptZero(&ctx.pk, &output.Ct.EG)
+	var S DHElement
+	cts := make([]EGCiphertext, ctx.cols)
+	ctx.ctx.ecc.RandomElement(&S)
+	for j := range cts {
+		ctx.ctx.EG_EncryptZero(&ctx.pk, &cts[j])
+	}
+	output.S = S.Compress()
+	output.Ct.EG = ctx.ctx.EG_SerializeAll(cts)
 	return output
 }
 
@@ -58,7 +79,9 @@ func RandomizeAESDelegateWorker(a WorkerCtx, b interface{}) interface{} {
 	ctx, ok := a.(BlindCtxInt)
 	Assert(ok)
 	var output DHOutput
-	ctx.ctx.RandomElement(&output.S)
+	var S DHElement
+	ctx.ctx.RandomElement(&S)
+	output.S = S.Compress()
 	output.Ct.AES = RandomBytes(12)
 	return output
 }
@@ -69,7 +92,10 @@ func ReduceWorker(a WorkerCtx, b interface{}) interface{} {
 	arg, ok := b.(ReduceInput)
 	Assert(ok)
 	var output DHOutput
-	output.Q, output.S = ctx.ctx.DH_Reduce(ctx.L, arg.H, arg.P)
+	H := DHElementFromBytes(ctx.ctx, arg.H)
+	P := DHElementFromBytes(ctx.ctx, arg.P)
+	Q, S := ctx.ctx.DH_Reduce(ctx.L, H, P)
+	output.Q, output.S = Q.Compress(), S.Compress()
 	return output
 }
 
@@ -80,8 +106,9 @@ func HashAndReduceWorker(a WorkerCtx, b interface{}) interface{} {
 	Assert(ok)
 	var output DHOutput
 	var H DHElement
-	HashToCurve_13(string(arg.w), &H, ctx.ctx.Curve, ctx.h2c)
-	output.Q, output.S = ctx.ctx.DH_Reduce(ctx.L, H, arg.P)
+	ctx.ctx.EC_HashToCurve(string(arg.w), ctx.h2c, &H)
+	Q, S := ctx.ctx.DH_ReduceHashed(ctx.L, H, DHElementFromBytes(ctx.ctx, arg.P), ctx.h2c)
+	output.Q, output.S = Q.Compress(), S.Compress()
 	return output
 }
 
@@ -92,12 +119,13 @@ func MPSIReduceWorker(a WorkerCtx, b interface{}) interface{} {
 	Assert(ok)
 	var output DHOutput
 	var H DHElement
-	HashToCurve_13(string(arg.w), &H, ctx.ctx.Curve, ctx.h2c)
-	output.Q, output.S = ctx.ctx.DH_Reduce(ctx.L, H, arg.Mj)
+	ctx.ctx.EC_HashToCurve(string(arg.w), ctx.h2c, &H)
+	Q, S := ctx.ctx.DH_ReduceHashed(ctx.L, H, DHElementFromBytes(ctx.ctx, arg.Mj), ctx.h2c)
 	if !ctx.isP1 {
-		ctx.ctx.EC_Add(output.Q, arg.Rj0, &output.Q)
-		ctx.ctx.EC_Add(output.S, arg.Rj1, &output.S)
+		ctx.ctx.EC_Add(Q, DHElementFromBytes(ctx.ctx, arg.Rj0), &Q)
+		ctx.ctx.EC_Add(S, DHElementFromBytes(ctx.ctx, arg.Rj1), &S)
 	}
+	output.Q, output.S = Q.Compress(), S.Compress()
 	return output
 }
 
@@ -107,12 +135,12 @@ func UnblindEGWorker(a WorkerCtx, b interface{}) interface{} {
 	arg, ok := b.(UnblindInput)
 	Assert(ok)
 	var S DHElement
-	Assert(zero.Cmp(arg.Q.x) != 0)
-	ctx.ctx.ecc.EC_Multiply(ctx.alpha, arg.Q, &S)
-	ctBytes, err := AEAD_Decrypt(arg.AES, AES_KDF(S.Serialize()))
+	Q := DHElementFromBytes(&ctx.ctx.ecc, arg.Q)
+	Assert(Q.x != nil && zero.Cmp(Q.x) != 0)
+	ctx.ctx.ecc.EC_Multiply(ctx.alpha, Q, &S)
+	ctBytes, err := ctx.ctx.ecc.AEAD_Decrypt(arg.AES, AES_KDF(S.Serialize(), ctx.ctx.ecc.sid))
 	if err == nil {
-		ct := ctx.ctx.EG_Deserialize(ctBytes)
-		return &ct
+		return ctx.ctx.EG_DeserializeAll(ctBytes)
 	}
 	return nil
 }
@@ -124,26 +152,99 @@ func UnblindAESWorker(a WorkerCtx, b interface{}) interface{} {
 	Assert(ok)
 
 	var S DHElement
-	ctx.ctx.EC_Multiply(ctx.alpha, arg.Q, &S)
-	ctBytes, err := AEAD_Decrypt(arg.AES, AES_KDF(S.Serialize()))
+	ctx.ctx.EC_Multiply(ctx.alpha, DHElementFromBytes(ctx.ctx, arg.Q), &S)
+	ctBytes, err := ctx.ctx.AEAD_Decrypt(arg.AES, AES_KDF(S.Serialize(), ctx.ctx.sid))
 	if err == nil {
 		return string(ctBytes)
 	}
 	return ""
 }
 
+// Runs fn on the job of a slot, then adds the party's encrypted values to the
+// ciphertexts of the slot. Slots without a value are rerandomized, so the next
+// party cannot tell which slots changed.
+func AddValuesWorker(fn WorkerFunc) WorkerFunc {
+	return func(a WorkerCtx, b interface{}) interface{} {
+		ctx, ok := a.(AddValuesCtx)
+		Assert(ok)
+		arg, ok := b.(AddValuesInput)
+		Assert(ok)
+		output, ok := fn(ctx.dh, arg.in).(DHOutput)
+		Assert(ok)
+
+		var m big.Int
+		var ct EGCiphertext
+		cts := ctx.ctx.EG_DeserializeAll(arg.EG)
+		Assert(arg.v == nil || len(arg.v) == len(cts))
+		for j := range cts {
+			if arg.v == nil {
+				ctx.ctx.EG_Rerandomize(ctx.apk, &cts[j])
+				continue
+			}
+			m.SetInt64(int64(arg.v[j]))
+			ctx.ctx.EG_Encrypt(ctx.apk, &m, &ct)
+			ctx.ctx.EG_AddInplace(&cts[j], &ct)
+		}
+		output.Ct.EG = ctx.ctx.EG_SerializeAll(cts)
+		return output
+	}
+}
+
 func EncryptEGWorker(a WorkerCtx, b interface{}) interface{} {
 	ctx, _ := a.(EncryptCtx)
 	arg, _ := b.(EncryptInput)
 
-	ctx.ctx.EG_Rerandomize(ctx.apk, &arg.ct.EG)
-	return EncryptOutput(AEAD_Encrypt(ctx.ctx.EG_Serialize(&arg.ct.EG), AES_KDF(arg.S.Serialize())))
+	cts := ctx.ctx.EG_DeserializeAll(arg.EG)
+	for j := range cts {
+		ctx.ctx.EG_Rerandomize(ctx.apk, &cts[j])
+	}
+	return EncryptOutput(ctx.ctx.ecc.AEAD_Encrypt(ctx.ctx.EG_SerializeAll(cts), AES_KDF(arg.S, ctx.ctx.ecc.sid)))
 }
 
 func EncryptAESWorker(a WorkerCtx, b interface{}) interface{} {
+	ctx, _ := a.(EncryptCtx)
 	arg, _ := b.(EncryptInput)
 
-	return EncryptOutput(AEAD_Encrypt(arg.ct.AES, AES_KDF(arg.S.Serialize())))
+	return EncryptOutput(ctx.ctx.ecc.AEAD_Encrypt(arg.AES, AES_KDF(arg.S, ctx.ctx.ecc.sid)))
+}
+
+// The sums of the lanes of each subset, scaled by fresh scalars, and the
+// ciphertext of the slot encrypted under each
+func CombineEncryptWorker(a WorkerCtx, b interface{}) interface{} {
+	ctx, _ := a.(CombineCtx)
+	arg, _ := b.(CombineInput)
+	ecc := &ctx.ctx.ecc
+	sz := len(DHPoint{})
+
+	pt := arg.AES
+	if arg.EG != nil {
+		cts := ctx.ctx.EG_DeserializeAll(arg.EG)
+		for j := range cts {
+			ctx.ctx.EG_Rerandomize(ctx.apk, &cts[j])
+		}
+		pt = ctx.ctx.EG_SerializeAll(cts)
+	}
+
+	var output CombineOutput
+	for _, C := range ctx.subsets {
+		var Q, S DHElement
+		for k, i := range C {
+			Qi := DHElementFromBytes(ecc, arg.Q[i*sz:(i+1)*sz])
+			Si := DHElementFromBytes(ecc, arg.S[i*sz:(i+1)*sz])
+			if k == 0 {
+				Q, S = Qi, Si
+			} else {
+				ecc.EC_Add(Q, Qi, &Q)
+				ecc.EC_Add(S, Si, &S)
+			}
+		}
+		rho := ecc.RandomScalar()
+		ecc.EC_Multiply(rho, Q, &Q)
+		ecc.EC_Multiply(rho, S, &S)
+		output.Q = append(output.Q, Q.Compress())
+		output.AES = append(output.AES, ecc.AEAD_Encrypt(pt, AES_KDF(S.Serialize(), ecc.sid)))
+	}
+	return output
 }
 
 // #############################################################################
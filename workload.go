@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// #############################################################################
+
+var firstNames = []string{"james", "mary", "john", "patricia", "robert", "jennifer", "michael", "linda", "william", "elizabeth", "david", "barbara", "richard", "susan", "joseph", "jessica", "thomas", "sarah", "charles", "karen", "wei", "fatima", "mohammed", "ana", "ivan", "yuki", "priya", "olga", "chen", "maria"}
+var lastNames = []string{"smith", "johnson", "williams", "brown", "jones", "garcia", "miller", "davis", "rodriguez", "martinez", "hernandez", "lopez", "gonzalez", "wilson", "anderson", "thomas", "taylor", "moore", "jackson", "martin", "lee", "perez", "thompson", "white", "harris", "sanchez", "clark", "ramirez", "lewis", "robinson"}
+
+// Ordered by popularity, picked with a Zipf distribution
+var emailDomains = []string{"gmail.com", "yahoo.com", "hotmail.com", "outlook.com", "aol.com", "icloud.com", "mail.ru", "qq.com", "protonmail.com", "gmx.de", "web.de", "yandex.ru"}
+
+type workloadGen struct {
+	p       *WorkloadParams
+	rng     *rand.Rand
+	values  *rand.Zipf
+	domains *rand.Zipf
+	spread  *rand.Zipf
+	seen    map[string]bool
+	sets    []Set
+}
+
+func newWorkloadGen(p *WorkloadParams, rng *rand.Rand, maxSpread int) *workloadGen {
+	g := workloadGen{p: p, rng: rng, seen: make(map[string]bool)}
+	if p.Values == "zipf" {
+		g.values = rand.NewZipf(rng, p.ZipfS, 1, uint64(p.Lim-1))
+		Assert(g.values != nil) // requires zipf_s > 1
+	}
+	g.domains = rand.NewZipf(rng, 1.5, 1, uint64(len(emailDomains)-1))
+	if maxSpread > 1 {
+		g.spread = rand.NewZipf(rng, p.SpreadS, 1, uint64(maxSpread-1))
+		Assert(g.spread != nil) // requires spread_s > 1
+	}
+	g.sets = make([]Set, len(p.Sizes))
+	for i := range g.sets {
+		g.sets[i] = *NewSet(map[string][]int{})
+	}
+	return &g
+}
+
+func (g *workloadGen) newID() string {
+	for {
+		var w string
+		switch g.p.IDs {
+		case "email":
+			w = firstNames[g.rng.Intn(len(firstNames))] + []string{".", "_", ""}[g.rng.Intn(3)] + lastNames[g.rng.Intn(len(lastNames))]
+			if g.rng.Intn(2) == 0 {
+				w += fmt.Sprintf("%d", g.rng.Intn(10000))
+			}
+			w += "@" + emailDomains[g.domains.Uint64()]
+		case "phone":
+			w = fmt.Sprintf("+1%d%03d%04d", 200+g.rng.Intn(800), g.rng.Intn(1000), g.rng.Intn(10000))
+		default:
+			w = RandomStringFrom(g.rng, 12)
+		}
+		if !g.seen[w] {
+			g.seen[w] = true
+			return w
+		}
+	}
+}
+
+func (g *workloadGen) newValues() []int {
+	return []int{g.newValue()}
+}
+
+func (g *workloadGen) newValue() int {
+	if g.values != nil {
+		return int(g.values.Uint64())
+	}
+	return g.rng.Intn(g.p.Lim)
+}
+
+func (g *workloadGen) hasRoom(i int) bool {
+	return g.sets[i].Size() < g.p.Sizes[i]
+}
+
+// Adds fresh identifiers shared by 1..maxSpread of the given parties, with the
+// number of holders drawn from a Zipf distribution, until all of them are full
+func (g *workloadGen) fill(parties []int) {
+	for {
+		var open []int
+		for _, i := range parties {
+			if g.hasRoom(i) {
+				open = append(open, i)
+			}
+		}
+		if len(open) == 0 {
+			return
+		}
+
+		deg := 1
+		if g.spread != nil {
+			deg += int(g.spread.Uint64())
+		}
+		if deg > len(open) {
+			deg = len(open)
+		}
+
+		w, v := g.newID(), g.newValues()
+		for _, j := range g.rng.Perm(len(open))[:deg] {
+			g.sets[open[j]].Add(w, v)
+		}
+	}
+}
+
+func (g *workloadGen) addOverlaps() {
+	for _, o := range g.p.Overlaps {
+		Assert(o.A != o.B && o.A >= 0 && o.B >= 0 && o.A < len(g.sets) && o.B < len(g.sets))
+		k := g.p.Sizes[o.A]
+		if g.p.Sizes[o.B] < k {
+			k = g.p.Sizes[o.B]
+		}
+		k = int(o.Frac * float64(k))
+		for j := 0; j < k && g.hasRoom(o.A) && g.hasRoom(o.B); j++ {
+			w, v := g.newID(), g.newValues()
+			g.sets[o.A].Add(w, v)
+			g.sets[o.B].Add(w, v)
+		}
+	}
+}
+
+// #############################################################################
+
+// Intersection identifiers are held by every party; all other identifiers are
+// held by at most nParties-1 parties, so |I| is exactly p.IntCard
+func (d *SampleData) GenerateWorkloadI(p *WorkloadParams) {
+	nParties := len(d.X_ADs)
+	g := newWorkloadGen(p, d.rng, nParties-1)
+
+	for j := 0; j < p.IntCard; j++ {
+		w, v := g.newID(), g.newValues()
+		for i := 0; i < nParties; i++ {
+			g.sets[i].Add(w, v)
+		}
+	}
+	g.addOverlaps()
+
+	all := make([]int, nParties)
+	for i := range all {
+		all[i] = i
+	}
+	g.fill(all)
+
+	for i := 0; i < nParties; i++ {
+		d.X_ADs[i] = g.sets[i].Serialize()
+		Assert(len(d.X_ADs[i]) == p.Sizes[i])
+	}
+	d.AddColumns(p.Cols, g.newValue)
+	Assert(Cardinality(d.X_ADs, len(d.X_ADs)-1, false)[0] == p.IntCard)
+}
+
+// Intersection identifiers are held by the delegate and a random non-empty
+// subset of the others with room left; overlaps involving P_0 add to the true
+// |I|
+func (d *SampleData) GenerateWorkloadIU(p *WorkloadParams) {
+	nParties := len(d.X_ADs)
+	g := newWorkloadGen(p, d.rng, nParties-1)
+
+	// Holders beyond the first only take room the remaining identifiers can
+	// spare
+	spare := -p.IntCard
+	for i := 1; i < nParties; i++ {
+		spare += p.Sizes[i]
+	}
+	Assert(spare >= 0)
+	for j := 0; j < p.IntCard; j++ {
+		var open []int
+		for i := 1; i < nParties; i++ {
+			if g.hasRoom(i) {
+				open = append(open, i)
+			}
+		}
+		perm, k := g.rng.Perm(len(open)), g.rng.Intn(len(open))+1
+		if k-1 > spare {
+			k = spare + 1
+		}
+		spare -= k - 1
+
+		w, v := g.newID(), g.newValues()
+		g.sets[0].Add(w, v)
+		for _, i := range perm[:k] {
+			g.sets[open[i]].Add(w, v)
+		}
+	}
+	g.addOverlaps()
+	g.fill([]int{0})
+
+	others := make([]int, nParties-1)
+	for i := range others {
+		others[i] = i + 1
+	}
+	g.fill(others)
+
+	for i := 0; i < nParties; i++ {
+		d.X_ADs[i] = g.sets[i].Serialize()
+		Assert(len(d.X_ADs[i]) == p.Sizes[i])
+	}
+	d.AddColumns(p.Cols, g.newValue)
+}